@@ -1,22 +1,29 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
-	"strconv"
-	"strings"
 	"time"
 )
 
 const (
-	zstdName   = "zstd"
-	xdeltaName = "xdelta"
+	zstdName    = "zstd"
+	xdeltaName  = "xdelta"
+	bsdiffName  = "bsdiff"
+	zstdGoName  = "zstdgo"
+	nardiffName = "nardiff"
 )
 
+// bases bigger than this aren't read onto the heap, see memBase
+var memBaseMax int64 = 64 << 20
+
+var algoNames = []string{zstdName, xdeltaName, bsdiffName, zstdGoName, nardiffName}
+
 type (
 	DiffAlgo interface {
 		Name() string
@@ -29,13 +36,21 @@ type (
 		// TODO: consider *os.File or io.Reader instead?
 		Base    string
 		Request string
-		Output  io.Writer
+		// If RequestReader is set, the requested nar is streamed from it instead of read
+		// from the file named by Request. RequestSize is its size, or -1 if unknown.
+		RequestReader io.Reader
+		RequestSize   int64
+		Output        io.Writer
 	}
 
 	ExpandArgs struct {
-		Base   io.Reader
-		Delta  io.Reader
-		Output io.Writer
+		Base io.Reader
+		// If BaseAt is set, it has the same contents as Base, with random access. Algos
+		// that need random access should use it instead of copying Base.
+		BaseAt   io.ReaderAt
+		BaseSize int64
+		Delta    io.Reader
+		Output   io.Writer
 	}
 
 	xd3Algo struct{ level int }
@@ -47,9 +62,7 @@ func (a *xd3Algo) SetLevel(level int) { a.level = level }
 
 func (a *xd3Algo) Create(ctx context.Context, args CreateArgs) (*DiffStats, error) {
 	start := time.Now()
-	xdelta := exec.CommandContext(
-		ctx,
-		xdelta3Bin,
+	xdArgs := []string{
 		"-v",                        // verbose
 		fmt.Sprintf("-%d", a.level), // level
 		"-S", "lzma",                // secondary compression
@@ -58,8 +71,18 @@ func (a *xd3Algo) Create(ctx context.Context, args CreateArgs) (*DiffStats, erro
 		"-c",            // stdout
 		"-e",            // encode
 		"-s", args.Base, // base
-		args.Request,
-	)
+	}
+	var cr *countReader
+	if args.RequestReader != nil {
+		// xdelta reads from stdin if there's no input file
+		cr = &countReader{r: args.RequestReader}
+	} else {
+		xdArgs = append(xdArgs, args.Request)
+	}
+	xdelta := exec.CommandContext(ctx, xdelta3Bin, xdArgs...)
+	if cr != nil {
+		xdelta.Stdin = cr
+	}
 	cw := countWriter{w: args.Output}
 	xdelta.Stdout = &cw
 	xdeltaErrPipe, err := xdelta.StderrPipe()
@@ -80,9 +103,13 @@ func (a *xd3Algo) Create(ctx context.Context, args CreateArgs) (*DiffStats, erro
 		return nil, fmt.Errorf("xdelta sterr pipe copy: %w", copyErr)
 	}
 
+	narSize := fileSize(args.Request)
+	if cr != nil {
+		narSize = cr.c
+	}
 	stats := &DiffStats{
 		DiffSize:   cw.c,
-		NarSize:    fileSize(args.Request),
+		NarSize:    narSize,
 		Algo:       a.Name(),
 		Level:      a.level,
 		CmpTotalMs: time.Now().Sub(start).Milliseconds(),
@@ -93,6 +120,40 @@ func (a *xd3Algo) Create(ctx context.Context, args CreateArgs) (*DiffStats, erro
 }
 
 func (_ *xd3Algo) Expand(ctx context.Context, args ExpandArgs) (*DiffStats, error) {
+	// check the whole delta first, so we don't fall back after writing output
+	start := time.Now()
+	deltaFile, err := spoolDelta(args.Delta)
+	if err != nil {
+		return nil, err
+	}
+	defer deltaFile.Close()
+	supported := vcdiffSupported(deltaFile)
+	if _, err = deltaFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	} else if !supported {
+		args.Delta = deltaFile
+		return expandXd3Exec(ctx, args)
+	}
+	delta := bufio.NewReaderSize(deltaFile, 64*1024)
+
+	base, baseSize, cleanup, err := args.seekableBase()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if err = vcdiffDecode(ctx, base, baseSize, delta, args.Output); err != nil {
+		return nil, fmt.Errorf("vcdiff decode: %w", err)
+	}
+
+	stats := &DiffStats{
+		ExpTotalMs: time.Now().Sub(start).Milliseconds(),
+	}
+	return stats, nil
+}
+
+// expandXd3Exec expands using the xdelta3 binary.
+func expandXd3Exec(ctx context.Context, args ExpandArgs) (*DiffStats, error) {
 	start := time.Now()
 	xdelta := exec.CommandContext(
 		ctx,
@@ -153,20 +214,51 @@ func (_ *xd3Algo) Expand(ctx context.Context, args ExpandArgs) (*DiffStats, erro
 	return stats, nil
 }
 
+// spoolsUnsizedRequest returns true if the algo writes a streamed requested nar to a temp
+// file when it doesn't know its size.
+func spoolsUnsizedRequest(a DiffAlgo) bool {
+	_, ok := a.(*zstAlgo)
+	return ok
+}
+
 func (a *zstAlgo) Name() string       { return zstdName }
 func (a *zstAlgo) SetLevel(level int) { a.level = level }
 
 func (a *zstAlgo) Create(ctx context.Context, args CreateArgs) (*DiffStats, error) {
+	if args.RequestReader != nil && args.RequestSize < 0 {
+		// zstd needs to know the size to use --patch-from with stdin, so we have to
+		// write it out.
+		reqFile, err := os.CreateTemp("", "reqnar")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(reqFile.Name())
+		err = ioCopy(reqFile, args.RequestReader, nil, -1)
+		reqFile.Close()
+		if err != nil {
+			return nil, err
+		}
+		args.Request, args.RequestReader = reqFile.Name(), nil
+	}
+
 	start := time.Now()
-	zstd := exec.CommandContext(
-		ctx,
-		zstdBin,
+	zstdArgs := []string{
 		fmt.Sprintf("-%d", a.level), // level
 		"--single-thread",           // improve compression (sometimes?)
 		"-c",                        // stdout
 		"--patch-from", args.Base,   // base
-		args.Request,
-	)
+	}
+	var cr *countReader
+	if args.RequestReader != nil {
+		cr = &countReader{r: args.RequestReader}
+		zstdArgs = append(zstdArgs, fmt.Sprintf("--stream-size=%d", args.RequestSize))
+	} else {
+		zstdArgs = append(zstdArgs, args.Request)
+	}
+	zstd := exec.CommandContext(ctx, zstdBin, zstdArgs...)
+	if cr != nil {
+		zstd.Stdin = cr
+	}
 	cw := countWriter{w: args.Output}
 	zstd.Stdout = &cw
 	zstdErrPipe, err := zstd.StderrPipe()
@@ -187,9 +279,13 @@ func (a *zstAlgo) Create(ctx context.Context, args CreateArgs) (*DiffStats, erro
 		return nil, fmt.Errorf("zstd sterr pipe copy: %w", err)
 	}
 
+	narSize := fileSize(args.Request)
+	if cr != nil {
+		narSize = cr.c
+	}
 	stats := &DiffStats{
 		DiffSize:   cw.c,
-		NarSize:    fileSize(args.Request),
+		NarSize:    narSize,
 		Algo:       a.Name(),
 		Level:      a.level,
 		CmpTotalMs: time.Now().Sub(start).Milliseconds(),
@@ -200,6 +296,11 @@ func (a *zstAlgo) Create(ctx context.Context, args CreateArgs) (*DiffStats, erro
 }
 
 func (_ *zstAlgo) Expand(ctx context.Context, args ExpandArgs) (*DiffStats, error) {
+	if args.BaseAt != nil {
+		// same format, and reads the base from BaseAt instead of spooling it through Base
+		return (&zstgoAlgo{}).Expand(ctx, args)
+	}
+
 	// zstd requires physical file :(
 	baseFile, err := os.CreateTemp("", "basenar")
 	if err != nil {
@@ -253,27 +354,88 @@ func (_ *zstAlgo) Expand(ctx context.Context, args ExpandArgs) (*DiffStats, erro
 func getAlgo(name string) DiffAlgo {
 	switch name {
 	case xdeltaName:
-		return &xd3Algo{level: 6}
+		return &xd3Algo{level: defaultLevel(name)}
 	case zstdName:
-		return &zstAlgo{level: 9}
+		return &zstAlgo{level: defaultLevel(name)}
+	case bsdiffName:
+		return &bsdAlgo{level: defaultLevel(name)}
+	case zstdGoName:
+		return &zstgoAlgo{level: defaultLevel(name)}
+	case nardiffName:
+		return &nardiffAlgo{level: defaultLevel(name)}
 	default:
 		return nil
 	}
 }
 
-func pickAlgo(accept []string) DiffAlgo {
-	for _, a := range accept {
-		name, level, found := strings.Cut(a, "-")
-		if algo := getAlgo(name); algo != nil {
-			if found {
-				if levelInt, err := strconv.Atoi(level); err == nil {
-					algo.SetLevel(levelInt)
-				}
-			}
-			return algo
+// getExpandAlgo is like getAlgo but may substitute an in-process implementation of the same
+// format if the binary is missing.
+func getExpandAlgo(name string) DiffAlgo {
+	if name == zstdName {
+		if _, err := exec.LookPath(zstdBin); err != nil {
+			return getAlgo(zstdGoName)
 		}
 	}
-	return nil
+	return getAlgo(name)
+}
+
+func defaultLevel(name string) int {
+	switch name {
+	case xdeltaName:
+		return 6
+	case zstdName:
+		return 9
+	case bsdiffName:
+		return 6
+	case nardiffName:
+		return 9
+	default:
+		return 0
+	}
+}
+
+func maxLevel(name string) int {
+	switch name {
+	case xdeltaName:
+		return 9
+	case zstdName:
+		return 19
+	case bsdiffName:
+		return 9
+	case nardiffName:
+		return 19
+	default:
+		return 0
+	}
+}
+
+// seekableBase returns random access to the base: BaseAt if set, otherwise Base spooled to a
+// temp file.
+func (args *ExpandArgs) seekableBase() (io.ReaderAt, int64, func(), error) {
+	if args.BaseAt != nil {
+		return args.BaseAt, args.BaseSize, func() {}, nil
+	}
+	b, cleanup, err := spoolBase(args.Base)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return bytes.NewReader(b), int64(len(b)), cleanup, nil
+}
+
+// memBase returns the contents of the base in memory. Algos that use it need the whole base
+// addressable, so a big BaseAt is copied once into a memory file and mapped, so it isn't in
+// TMPDIR and the kernel can page it out.
+func (args *ExpandArgs) memBase() ([]byte, func(), error) {
+	if args.BaseAt != nil && args.BaseSize > memBaseMax {
+		return memfdBase(io.NewSectionReader(args.BaseAt, 0, args.BaseSize))
+	} else if args.BaseAt != nil {
+		b := make([]byte, args.BaseSize)
+		if _, err := args.BaseAt.ReadAt(b, 0); err != nil {
+			return nil, nil, err
+		}
+		return b, func() {}, nil
+	}
+	return mapBase(args.Base)
 }
 
 type countWriter struct {
@@ -286,6 +448,17 @@ func (c *countWriter) Write(p []byte) (n int, err error) {
 	return c.w.Write(p)
 }
 
+type countReader struct {
+	r io.Reader
+	c int
+}
+
+func (c *countReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.c += n
+	return
+}
+
 func fileSize(fn string) int {
 	if fi, err := os.Stat(fn); err == nil {
 		return int(fi.Size())
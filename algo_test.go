@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func algoRoundTrip(t *testing.T, algo DiffAlgo, old, new []byte) int {
+	t.Helper()
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	req := filepath.Join(dir, "req")
+	os.WriteFile(base, old, 0644)
+	os.WriteFile(req, new, 0644)
+
+	var delta, out bytes.Buffer
+	ctx := context.Background()
+	if _, err := algo.Create(ctx, CreateArgs{Base: base, Request: req, Output: &delta}); err != nil {
+		t.Fatal(algo.Name(), "create", err)
+	}
+	size := delta.Len()
+	if _, err := algo.Expand(ctx, ExpandArgs{Base: bytes.NewReader(old), Delta: &delta, Output: &out}); err != nil {
+		t.Fatal(algo.Name(), "expand", err)
+	}
+	if !bytes.Equal(out.Bytes(), new) {
+		t.Fatal(algo.Name(), "round trip mismatch")
+	}
+	return size
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +29,8 @@ type (
 	AnDiff struct {
 		Id         string `json:"id,omitempty"`
 		*DiffStats `json:"stats,omitempty"`
+		Fallback   string `json:"fallback,omitempty"` // reason for downloading directly
+		Failed     string `json:"failed,omitempty"`   // why we couldn't use the diff
 	}
 
 	DiffStats struct {
@@ -42,6 +45,8 @@ type (
 		CmpSysMs   int64  `json:"cmpS,omitempty"`
 		ExpUserMs  int64  `json:"expU,omitempty"`
 		ExpSysMs   int64  `json:"expS,omitempty"`
+		// outcomes of expanding compressed files in the requested nar, by "algo:outcome"
+		Expand map[string]int `json:"expand,omitempty"`
 	}
 
 	analyzeOptions struct {
@@ -81,6 +86,8 @@ func analyzeLog(fn string, opts analyzeOptions) {
 	minT := time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)
 	maxT := time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)
 	var tActual int
+	var fallbacks int
+	dfmap := map[string]int{}
 
 	d := json.NewDecoder(f)
 	for {
@@ -105,7 +112,13 @@ func analyzeLog(fn string, opts analyzeOptions) {
 				tActual += int(r.FileSize)
 			}
 		} else if d := rec.D; d != nil {
-			if rec, ok := reqmap[d.Id]; ok {
+			if d.Failed != "" {
+				// diffed but unusable, probably followed by another request
+				dfmap[d.Failed]++
+			} else if d.Fallback != "" {
+				// downloaded directly, file size is already counted
+				fallbacks++
+			} else if rec, ok := reqmap[d.Id]; ok {
 				tActual -= int(rec.R.FileSize)
 				tActual += d.DiffSize
 				rec.D = d
@@ -126,20 +139,28 @@ func analyzeLog(fn string, opts analyzeOptions) {
 		minT.Format(time.RFC3339), maxT.Format(time.RFC3339), maxT.Sub(minT).Seconds())
 
 	i := itoaWithSegments
-	fmt.Printf("%s total requested  %s diffed  %s eq  %s not found  %s too small  %s too big  %s no base\n",
+	fmt.Printf("%s total requested  %s diffed  %s fallback  %s eq  %s not found  %s too small  %s too big  %s no base\n",
 		i(total),
 		i(len(diffed)),
+		i(fallbacks),
 		i(fmap[failedIdentical]),
 		i(fmap[failedNotFound]),
 		i(fmap[failedTooSmall]),
 		i(fmap[failedTooBig]),
 		i(fmap[failedNoBase]),
 	)
+	if len(dfmap) > 0 {
+		fmt.Printf("%s corrupt deltas  %s bad expansions\n", i(dfmap[failedCorrupt]), i(dfmap[failedAlgo]))
+	}
 
 	var tUncmp, tCmp, tDiff int
 	var tCmpT, tCmpU, tCmpS int64
 	var tExpT, tExpU, tExpS int64
+	expand := map[string]int{}
 	for _, d := range diffed {
+		for k, v := range d.D.Expand {
+			expand[k] += v
+		}
 		if d.D.DiffSize == 0 {
 			continue
 		}
@@ -164,6 +185,14 @@ func analyzeLog(fn string, opts analyzeOptions) {
 		float64(tCmpT)/1000, float64(tCmpU)/1000, float64(tCmpS)/1000,
 		float64(tExpT)/1000, float64(tExpU)/1000, float64(tExpS)/1000,
 	)
+	if len(expand) > 0 {
+		var parts []string
+		for k, v := range expand {
+			parts = append(parts, k+" "+i(v))
+		}
+		sort.Strings(parts)
+		fmt.Printf("embedded files %s\n", strings.Join(parts, "  "))
+	}
 }
 
 func itoaWithSegments(v int) string {
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// bsdiff (http://www.daemonology.net/bsdiff/) handles executables better than the copy/insert
+// deltas of xdelta and zstd: when code moves, every relative address changes a little, so
+// bsdiff emits a "diff" stream of bytewise differences against approximate matches, which is
+// mostly zeros and compresses very well.
+//
+// This uses Colin Percival's matching algorithm but a different container: a header followed
+// by an xz-compressed stream of records, each a control triple followed by its diff and extra
+// bytes. Unlike the original, this lets us apply the delta in one pass.
+//
+// Creating a delta needs the whole base in memory plus a suffix array of it, so it's limited
+// to smaller nars.
+
+type bsdAlgo struct{ level int }
+
+const (
+	bsdiffMagic   = "NSBSDIF1"
+	bsdiffMaxSize = 256 * 1024 * 1024
+)
+
+var errBadBsdiff = errors.New("bad bsdiff data")
+
+func (a *bsdAlgo) Name() string       { return bsdiffName }
+func (a *bsdAlgo) SetLevel(level int) { a.level = level }
+
+func (a *bsdAlgo) Create(ctx context.Context, args CreateArgs) (*DiffStats, error) {
+	start := time.Now()
+
+	if size := fileSize(args.Base); size > bsdiffMaxSize {
+		return nil, fmt.Errorf("base too big for bsdiff (%d)", size)
+	}
+	old, err := os.ReadFile(args.Base)
+	if err != nil {
+		return nil, err
+	}
+	var new []byte
+	if args.RequestReader != nil {
+		new, err = io.ReadAll(io.LimitReader(args.RequestReader, bsdiffMaxSize+1))
+	} else {
+		new, err = os.ReadFile(args.Request)
+	}
+	if err != nil {
+		return nil, err
+	} else if len(new) > bsdiffMaxSize {
+		return nil, fmt.Errorf("request too big for bsdiff (%d)", len(new))
+	}
+
+	cw := countWriter{w: args.Output}
+	if _, err := cw.Write(bsdiffHeader(len(new))); err != nil {
+		return nil, err
+	}
+
+	xz := exec.CommandContext(ctx, xzBin, "-c", fmt.Sprintf("-%d", a.level))
+	xz.Stdout = &cw
+	xz.Stderr = os.Stderr
+	xzIn, err := xz.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = xz.Start(); err != nil {
+		return nil, fmt.Errorf("xz start error: %w", err)
+	}
+
+	bw := bufio.NewWriterSize(xzIn, 128*1024)
+	diffErr := bsdiff(ctx, old, new, bw)
+	if diffErr == nil {
+		diffErr = bw.Flush()
+	}
+	xzIn.Close()
+
+	if err = xz.Wait(); err != nil {
+		return nil, fmt.Errorf("xz error: %w", err)
+	} else if diffErr != nil {
+		return nil, diffErr
+	}
+
+	stats := &DiffStats{
+		DiffSize:   cw.c,
+		NarSize:    len(new),
+		Algo:       a.Name(),
+		Level:      a.level,
+		CmpTotalMs: time.Now().Sub(start).Milliseconds(),
+		CmpUserMs:  xz.ProcessState.UserTime().Milliseconds(),
+		CmpSysMs:   xz.ProcessState.SystemTime().Milliseconds(),
+	}
+	return stats, nil
+}
+
+func (_ *bsdAlgo) Expand(ctx context.Context, args ExpandArgs) (*DiffStats, error) {
+	start := time.Now()
+
+	hdr := make([]byte, len(bsdiffMagic)+8)
+	if _, err := io.ReadFull(args.Delta, hdr); err != nil {
+		return nil, err
+	} else if string(hdr[:len(bsdiffMagic)]) != bsdiffMagic {
+		return nil, fmt.Errorf("%w: bad magic", errBadBsdiff)
+	}
+	newSize := int64(binary.LittleEndian.Uint64(hdr[len(bsdiffMagic):]))
+
+	old, oldSize, cleanup, err := args.seekableBase()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	xz := exec.CommandContext(ctx, xzBin, "-dc")
+	xz.Stdin = args.Delta
+	xz.Stderr = os.Stderr
+	xzOut, err := xz.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = xz.Start(); err != nil {
+		return nil, fmt.Errorf("xz start error: %w", err)
+	}
+
+	bw := bufio.NewWriterSize(args.Output, 128*1024)
+	patchErr := bspatch(old, oldSize, bufio.NewReaderSize(xzOut, 128*1024), bw, newSize)
+	if patchErr == nil {
+		patchErr = bw.Flush()
+	} else {
+		// make sure xz exits
+		io.Copy(io.Discard, xzOut)
+	}
+
+	if err = xz.Wait(); err != nil {
+		return nil, fmt.Errorf("xz error: %w", err)
+	} else if patchErr != nil {
+		return nil, patchErr
+	}
+
+	stats := &DiffStats{
+		ExpTotalMs: time.Now().Sub(start).Milliseconds(),
+		ExpUserMs:  xz.ProcessState.UserTime().Milliseconds(),
+		ExpSysMs:   xz.ProcessState.SystemTime().Milliseconds(),
+	}
+	return stats, nil
+}
+
+func bsdiffHeader(newSize int) []byte {
+	return binary.LittleEndian.AppendUint64([]byte(bsdiffMagic), uint64(newSize))
+}
+
+// bsdiff writes records transforming old into new. Each record is: varint diff length,
+// varint extra length, signed varint seek, then diff bytes (to be added to old), then extra
+// bytes (to be copied).
+func bsdiff(ctx context.Context, old, new []byte, w io.Writer) error {
+	I := qsufsort(old)
+	oldsize, newsize := len(old), len(new)
+
+	var rec []byte
+	var scan, pos, length int
+	var lastscan, lastpos, lastoffset int
+	for scan < newsize {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		oldscore := 0
+		scan += length
+		for scsc := scan; scan < newsize; scan++ {
+			length, pos = bsSearch(I, old, new[scan:], 0, oldsize)
+
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastoffset < oldsize && old[scsc+lastoffset] == new[scsc] {
+					oldscore++
+				}
+			}
+
+			if (length == oldscore && length != 0) || length > oldscore+8 {
+				break
+			}
+
+			if scan+lastoffset < oldsize && old[scan+lastoffset] == new[scan] {
+				oldscore--
+			}
+		}
+
+		if length == oldscore && scan != newsize {
+			continue
+		}
+
+		// extend forwards from last match
+		var s, sf, lenf int
+		for i := 0; lastscan+i < scan && lastpos+i < oldsize; {
+			if old[lastpos+i] == new[lastscan+i] {
+				s++
+			}
+			i++
+			if s*2-i > sf*2-lenf {
+				sf, lenf = s, i
+			}
+		}
+
+		// extend backwards from this match
+		lenb := 0
+		if scan < newsize {
+			var s, sb int
+			for i := 1; scan >= lastscan+i && pos >= i; i++ {
+				if old[pos-i] == new[scan-i] {
+					s++
+				}
+				if s*2-i > sb*2-lenb {
+					sb, lenb = s, i
+				}
+			}
+		}
+
+		// resolve overlap
+		if lastscan+lenf > scan-lenb {
+			overlap := (lastscan + lenf) - (scan - lenb)
+			var s, ss, lens int
+			for i := 0; i < overlap; i++ {
+				if new[lastscan+lenf-overlap+i] == old[lastpos+lenf-overlap+i] {
+					s++
+				}
+				if new[scan-lenb+i] == old[pos-lenb+i] {
+					s--
+				}
+				if s > ss {
+					ss, lens = s, i+1
+				}
+			}
+			lenf += lens - overlap
+			lenb -= lens
+		}
+
+		extra := (scan - lenb) - (lastscan + lenf)
+		seek := (pos - lenb) - (lastpos + lenf)
+
+		rec = rec[:0]
+		rec = binary.AppendUvarint(rec, uint64(lenf))
+		rec = binary.AppendUvarint(rec, uint64(extra))
+		rec = binary.AppendVarint(rec, int64(seek))
+		for i := 0; i < lenf; i++ {
+			rec = append(rec, new[lastscan+i]-old[lastpos+i])
+		}
+		rec = append(rec, new[lastscan+lenf:lastscan+lenf+extra]...)
+		if _, err := w.Write(rec); err != nil {
+			return err
+		}
+
+		lastscan = scan - lenb
+		lastpos = pos - lenb
+		lastoffset = pos - scan
+	}
+	return nil
+}
+
+// bspatch applies records from r to old and writes the result to w.
+func bspatch(old io.ReaderAt, oldSize int64, r *bufio.Reader, w io.Writer, newSize int64) error {
+	var oldpos, newpos int64
+	buf := make([]byte, 64*1024)
+	obuf := make([]byte, len(buf))
+	for {
+		lenf, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		extra, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errBadBsdiff, err)
+		}
+		seek, err := binary.ReadVarint(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errBadBsdiff, err)
+		}
+		if newpos+int64(lenf)+int64(extra) > newSize {
+			return fmt.Errorf("%w: output too long", errBadBsdiff)
+		} else if oldpos < 0 || oldpos+int64(lenf) > oldSize {
+			return fmt.Errorf("%w: diff out of range", errBadBsdiff)
+		}
+
+		for rem := int64(lenf); rem > 0; {
+			n := min(rem, int64(len(buf)))
+			if _, err := io.ReadFull(r, buf[:n]); err != nil {
+				return fmt.Errorf("%w: %v", errBadBsdiff, err)
+			} else if _, err := old.ReadAt(obuf[:n], oldpos); err != nil {
+				return err
+			}
+			for i := range buf[:n] {
+				buf[i] += obuf[i]
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			oldpos += n
+			rem -= n
+		}
+		if _, err := io.CopyN(w, r, int64(extra)); err != nil {
+			return fmt.Errorf("%w: %v", errBadBsdiff, err)
+		}
+		newpos += int64(lenf) + int64(extra)
+		oldpos += seek
+	}
+	if newpos != newSize {
+		return fmt.Errorf("%w: expected %d bytes, got %d", errBadBsdiff, newSize, newpos)
+	}
+	return nil
+}
+
+func bsMatchLen(a, b []byte) int {
+	i := 0
+	for ; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
+	}
+	return i
+}
+
+// bsSearch finds the longest match of new in old, using suffix array I.
+func bsSearch(I []int32, old, new []byte, st, en int) (int, int) {
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		o := old[I[x]:]
+		if bytes.Compare(o[:min(len(o), len(new))], new[:min(len(o), len(new))]) < 0 {
+			st = x
+		} else {
+			en = x
+		}
+	}
+	x := bsMatchLen(old[I[st]:], new)
+	y := bsMatchLen(old[I[en]:], new)
+	if x > y {
+		return x, int(I[st])
+	}
+	return y, int(I[en])
+}
+
+// qsufsort builds a suffix array using the Larsson-Sadakane algorithm.
+func qsufsort(old []byte) []int32 {
+	oldsize := int32(len(old))
+	I := make([]int32, oldsize+1)
+	V := make([]int32, oldsize+1)
+
+	var buckets [256]int32
+	for _, c := range old {
+		buckets[c]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i := 255; i > 0; i-- {
+		buckets[i] = buckets[i-1]
+	}
+	buckets[0] = 0
+
+	for i, c := range old {
+		buckets[c]++
+		I[buckets[c]] = int32(i)
+	}
+	I[0] = oldsize
+	for i, c := range old {
+		V[i] = buckets[c]
+	}
+	V[oldsize] = 0
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			I[buckets[i]] = -1
+		}
+	}
+	I[0] = -1
+
+	for h := int32(1); I[0] != -(oldsize + 1); h += h {
+		var length int32
+		var i int32
+		for i < oldsize+1 {
+			if I[i] < 0 {
+				length -= I[i]
+				i -= I[i]
+			} else {
+				if length != 0 {
+					I[i-length] = -length
+				}
+				length = V[I[i]] + 1 - i
+				bsSplit(I, V, i, length, h)
+				i += length
+				length = 0
+			}
+		}
+		if length != 0 {
+			I[i-length] = -length
+		}
+	}
+
+	for i := int32(0); i < oldsize+1; i++ {
+		I[V[i]] = i
+	}
+	return I
+}
+
+func bsSplit(I, V []int32, start, length, h int32) {
+	if length < 16 {
+		var j int32
+		for k := start; k < start+length; k += j {
+			j = 1
+			x := V[I[k]+h]
+			for i := int32(1); k+i < start+length; i++ {
+				if V[I[k+i]+h] < x {
+					x = V[I[k+i]+h]
+					j = 0
+				}
+				if V[I[k+i]+h] == x {
+					I[k+j], I[k+i] = I[k+i], I[k+j]
+					j++
+				}
+			}
+			for i := int32(0); i < j; i++ {
+				V[I[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				I[k] = -1
+			}
+		}
+		return
+	}
+
+	x := V[I[start+length/2]+h]
+	var jj, kk int32
+	for i := start; i < start+length; i++ {
+		if V[I[i]+h] < x {
+			jj++
+		}
+		if V[I[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i, j, k := start, int32(0), int32(0)
+	for i < jj {
+		if V[I[i]+h] < x {
+			i++
+		} else if V[I[i]+h] == x {
+			I[i], I[jj+j] = I[jj+j], I[i]
+			j++
+		} else {
+			I[i], I[kk+k] = I[kk+k], I[i]
+			k++
+		}
+	}
+
+	for jj+j < kk {
+		if V[I[jj+j]+h] == x {
+			j++
+		} else {
+			I[jj+j], I[kk+k] = I[kk+k], I[jj+j]
+			k++
+		}
+	}
+
+	if jj > start {
+		bsSplit(I, V, start, jj-start, h)
+	}
+
+	for i := int32(0); i < kk-jj; i++ {
+		V[I[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		I[jj] = -1
+	}
+
+	if start+length > kk {
+		bsSplit(I, V, kk, start+length-kk, h)
+	}
+}
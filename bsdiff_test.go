@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestBsdiff(t *testing.T) {
+	if _, err := exec.LookPath(xzBin); err != nil {
+		t.Skip("no xz")
+	}
+	r := rand.New(rand.NewSource(1))
+	old := make([]byte, 100000)
+	r.Read(old)
+	// some edits: change, insert, delete
+	new := append([]byte{}, old[:20000]...)
+	new = append(new, []byte("inserted")...)
+	new = append(new, old[20000:50000]...)
+	for i := 30000; i < 40000; i += 100 {
+		new[i]++
+	}
+	new = append(new, old[60000:]...)
+
+	for _, pair := range []struct{ old, new []byte }{
+		{old, new},
+		{nil, new},
+		{old, nil},
+		{[]byte("aaaaaaaaaaaaaaaaaaaa"), []byte("aaaaaaaaaaaaaaaaaaaab")},
+	} {
+		algoRoundTrip(t, getAlgo(bsdiffName), pair.old, pair.new)
+	}
+}
+
+// TestBsdiffElf builds two versions of a small program and compares delta sizes.
+func TestBsdiffElf(t *testing.T) {
+	if testing.Short() {
+		t.Skip("short")
+	} else if _, err := exec.LookPath(xzBin); err != nil {
+		t.Skip("no xz")
+	}
+
+	dir := t.TempDir()
+	build := func(name, extra string) []byte {
+		src := filepath.Join(dir, name+".go")
+		prog := "package main\nimport \"fmt\"\n" + extra + "\nfunc main() { fmt.Println(\"hello\") }\n"
+		os.WriteFile(src, []byte(prog), 0644)
+		out := filepath.Join(dir, name)
+		cmd := exec.Command("go", "build", "-o", out, src)
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+		if b, err := cmd.CombinedOutput(); err != nil {
+			t.Skip("can't build test program:", err, string(b))
+		}
+		b, _ := os.ReadFile(out)
+		return b
+	}
+	old := build("v1", "")
+	new := build("v2", "func init() { fmt.Println(\"shifts everything after it\") }")
+
+	for _, name := range []string{bsdiffName, zstdName, zstdGoName, xdeltaName} {
+		if name == zstdName {
+			if _, err := exec.LookPath(zstdBin); err != nil {
+				continue
+			}
+		} else if name == xdeltaName {
+			if _, err := exec.LookPath(xdelta3Bin); err != nil {
+				continue
+			}
+		}
+		size := algoRoundTrip(t, getAlgo(name), old, new)
+		t.Logf("%-7s %8d -> %8d", name, len(new), size)
+	}
+}
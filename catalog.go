@@ -2,18 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"hash/maphash"
 	"io"
+	"io/fs"
 	"log"
 	"math"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/golang/groupcache/lru"
 	"github.com/google/btree"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nar/ls"
 	"github.com/nix-community/go-nix/pkg/narinfo"
 	"github.com/nix-community/go-nix/pkg/nixbase32"
 	"github.com/nix-community/go-nix/pkg/nixpath"
@@ -34,6 +42,13 @@ type (
 
 		sysChecker *sysChecker
 		seed       maphash.Seed
+
+		chunks *chunkIndex
+
+		fracLock  sync.Mutex
+		fracCache *lru.Cache // base store path -> fraction of bytes in compressed files
+		// requested store name -> fraction of bytes in compressed files in its listing
+		listFracCache *lru.Cache
 	}
 
 	catalogResult struct {
@@ -45,8 +60,12 @@ type (
 	reList []*regexp.Regexp
 )
 
+// how long to wait for an upstream listing when deciding whether to expand
+const expandListingTimeout = 3 * time.Second
+
 var (
-	// packages that contain .xz files
+	// packages that contain compressed files. others are expanded if enough of their
+	// contents look compressed, these always are.
 	useExpandNarREs = reList{
 		// kernel itself (xz)
 		regexp.MustCompile(`^linux-[\d.-]+$`),
@@ -61,10 +80,15 @@ var (
 		regexp.MustCompile(`^wireless-regdb-[\d.-]+-xz$`),
 		regexp.MustCompile(`^sof-firmware-[\d.-]+-xz$`),
 		regexp.MustCompile(`^zd1211-firmware-[\d.-]+-xz$`),
+		// firmware packages (zstd)
+		regexp.MustCompile(`^[\w.-]+-firmware-[\w.-]+-zstd$`),
 		// separate kernel modules (xz)
 		regexp.MustCompile(`^v4l2loopback-unstable-[\d.-]+$`),
 		// man pages (gz)
 		regexp.MustCompile(`^.*-.*-man$`),
+		// mostly jars (zip)
+		regexp.MustCompile(`^(gradle|apache-maven|sbt|kotlin|ghidra)-[\d.-]+$`),
+		regexp.MustCompile(`^(idea|pycharm)-(community|ultimate|professional)-[\d.-]+$`),
 	}
 	skipREs = reList{
 		// compressed single files won't diff well anyway
@@ -77,7 +101,15 @@ func itemLess(a, b btItem) bool {
 }
 
 func newCatalog(cfg *config) *catalog {
-	c := &catalog{cfg: cfg, sysChecker: newSysChecker(cfg), seed: maphash.MakeSeed()}
+	c := &catalog{
+		cfg:        cfg,
+		sysChecker: newSysChecker(cfg),
+		seed:       maphash.MakeSeed(),
+		chunks:     newChunkIndex(cfg.ChunkIndexBytes),
+		fracCache:  lru.New(1000),
+
+		listFracCache: lru.New(1000),
+	}
 	c.bt.Store(btree.NewG[btItem](4, itemLess))
 	return c
 }
@@ -238,15 +270,19 @@ func (c *catalog) findBase(ni *narinfo.NarInfo, req string) (catalogResult, erro
 		return catalogResult{}, errors.New("no base found for " + req)
 	}
 
+	hash := nixbase32.EncodeToString(best.hash[:])
+	storePath := nixpath.StoreDir + "/" + hash + "-" + best.rest
+
 	var narFilter, filterMsg string
 	if useExpandNarREs.matchAny(best.rest) {
-		narFilter = narFilterExpandV2
+		narFilter = narFilterExpandV7
 		filterMsg = " [expanded]"
+	} else if c.worthExpanding(storePath, ni) {
+		narFilter = narFilterExpandV7
+		filterMsg = " [expanded by contents]"
 	}
 
 	log.Printf("catalog found base for %s -> %s%s", req, best.rest, filterMsg)
-	hash := nixbase32.EncodeToString(best.hash[:])
-	storePath := nixpath.StoreDir + "/" + hash + "-" + best.rest
 	return catalogResult{
 		storePath: storePath,
 		narFilter: narFilter,
@@ -254,6 +290,150 @@ func (c *catalog) findBase(ni *narinfo.NarInfo, req string) (catalogResult, erro
 	}, nil
 }
 
+// findChunkBases returns store paths that might share chunks with req, for when findBase
+// can't find a single good base. These have the same first segment but maybe a different
+// number of segments, e.g. other outputs or related packages.
+func (c *catalog) findChunkBases(ni *narinfo.NarInfo, req string) []string {
+	reqSys := c.sysChecker.getSysFromNarInfo(ni)
+	start := req
+	if dashes := findDashes(req); len(dashes) > 0 {
+		start = req[:dashes[0]+1]
+	}
+
+	type cand struct {
+		item  btItem
+		match int
+	}
+	var cands []cand
+	bt := c.bt.Load().(*btree.BTreeG[btItem])
+	bt.AscendRange(
+		btItem{rest: start},
+		btItem{rest: start + "\xff"},
+		func(i btItem) bool {
+			if i.sys == reqSys && i.rest != req {
+				cands = append(cands, cand{i, matchLen(req, i.rest)})
+			}
+			return true
+		})
+	// prefer longer matches, and later (probably more recent) ones among equal matches
+	sort.SliceStable(cands, func(i, j int) bool { return cands[i].match > cands[j].match })
+
+	var out []string
+	for _, cd := range cands {
+		if len(out) >= chunkMaxBases {
+			break
+		}
+		out = append(out, nixpath.StoreDir+"/"+nixbase32.EncodeToString(cd.item.hash[:])+"-"+cd.item.rest)
+	}
+	return out
+}
+
+// worthExpanding returns true if enough of the base (from the local store) and the target
+// (from the upstream listing, if we can get it) is in compressed files. The listing is only
+// fetched if the base is close to the threshold.
+func (c *catalog) worthExpanding(basePath string, ni *narinfo.NarInfo) bool {
+	minFrac := c.cfg.ExpandMinFraction
+	if minFrac <= 0 {
+		return false
+	} else if frac := c.baseCompressedFraction(basePath); frac < minFrac {
+		return false
+	} else if frac >= 2*minFrac {
+		// the target would have to be very different from its base to fall below
+		return true
+	}
+	frac, ok := c.listingCompressedFraction(ni.StorePath[len(nixpath.StoreDir)+1:])
+	return !ok || frac >= minFrac
+}
+
+func (c *catalog) baseCompressedFraction(storePath string) float64 {
+	c.fracLock.Lock()
+	v, ok := c.fracCache.Get(storePath)
+	c.fracLock.Unlock()
+	if ok {
+		return v.(float64)
+	}
+	var frac float64
+	if comp, total := localCompressedBytes(storePath); total > 0 {
+		frac = float64(comp) / float64(total)
+	}
+	c.fracLock.Lock()
+	c.fracCache.Add(storePath, frac)
+	c.fracLock.Unlock()
+	return frac
+}
+
+// listingCompressedFraction is like baseCompressedFraction for the upstream listing of a
+// store path. It returns false if it can't get the listing in time. That isn't cached, we'll
+// try again next time.
+func (c *catalog) listingCompressedFraction(storeName string) (float64, bool) {
+	c.fracLock.Lock()
+	v, ok := c.listFracCache.Get(storeName)
+	c.fracLock.Unlock()
+	if ok {
+		return v.(float64), true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), expandListingTimeout)
+	defer cancel()
+	root := c.sysChecker.getListing(ctx, storeName)
+	if root == nil {
+		return 0, false
+	}
+	var frac float64
+	if comp, total := listingCompressedBytes(&root.Root, storeName); total > 0 {
+		frac = float64(comp) / float64(total)
+	}
+	c.fracLock.Lock()
+	c.listFracCache.Add(storeName, frac)
+	c.fracLock.Unlock()
+	return frac, true
+}
+
+// localCompressedBytes returns the size of files under root that look compressed, and the
+// size of all files.
+func localCompressedBytes(root string) (comp, total int64) {
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+			if looksCompressed(d.Name()) {
+				comp += info.Size()
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// listingCompressedBytes is like localCompressedBytes for a nar listing.
+func listingCompressedBytes(node *ls.Node, name string) (comp, total int64) {
+	switch node.Type {
+	case nar.TypeRegular:
+		if looksCompressed(name) {
+			return node.Size, node.Size
+		}
+		return 0, node.Size
+	case nar.TypeDirectory:
+		for n, e := range node.Entries {
+			c, t := listingCompressedBytes(e, n)
+			comp += c
+			total += t
+		}
+	}
+	return
+}
+
+// looksCompressed returns true if the name of a file suggests the expander can do
+// something with it.
+func looksCompressed(name string) bool {
+	switch filepath.Ext(name) {
+	case ".xz", ".gz", ".tgz", ".zst", ".bz2":
+		return true
+	}
+	return isZipName(name)
+}
+
 func findDashes(s string) []int {
 	var dashes []int
 	for i := 0; i < len(s); {
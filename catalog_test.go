@@ -1,8 +1,15 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nar/ls"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+	"github.com/nix-community/go-nix/pkg/nixpath"
 )
 
 func TestFindDashes(t *testing.T) {
@@ -46,3 +53,63 @@ func TestMatchLen(t *testing.T) {
 		}
 	}
 }
+
+func TestCompressedBytes(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "lib", "modules"), 0755)
+	os.WriteFile(filepath.Join(dir, "lib", "modules", "a.ko.xz"), make([]byte, 300), 0644)
+	os.WriteFile(filepath.Join(dir, "lib", "app.jar"), make([]byte, 100), 0644)
+	os.WriteFile(filepath.Join(dir, "README.gz.txt"), make([]byte, 600), 0644)
+	os.Symlink("lib/app.jar", filepath.Join(dir, "link.gz"))
+	if comp, total := localCompressedBytes(dir); comp != 400 || total != 1000 {
+		t.Errorf("local: got %d/%d, expected 400/1000", comp, total)
+	}
+
+	root := &ls.Node{Type: nar.TypeDirectory, Entries: map[string]*ls.Node{
+		"share": {Type: nar.TypeDirectory, Entries: map[string]*ls.Node{
+			"ls.1.gz": {Type: nar.TypeRegular, Size: 50},
+			"x.tgz":   {Type: nar.TypeRegular, Size: 25},
+		}},
+		"bin":     {Type: nar.TypeRegular, Size: 25},
+		"link.xz": {Type: nar.TypeSymlink, LinkTarget: "bin"},
+	}}
+	if comp, total := listingCompressedBytes(root, "x"); comp != 75 || total != 100 {
+		t.Errorf("listing: got %d/%d, expected 75/100", comp, total)
+	}
+	// a single file store path
+	if comp, total := listingCompressedBytes(&ls.Node{Type: nar.TypeRegular, Size: 7}, "src.tar.zst"); comp != 7 || total != 7 {
+		t.Errorf("single file: got %d/%d, expected 7/7", comp, total)
+	}
+}
+
+func TestWorthExpanding(t *testing.T) {
+	dir := t.TempDir()
+	base := func(name string, comp int) string {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(p, 0755)
+		os.WriteFile(filepath.Join(p, "a.gz"), make([]byte, comp), 0644)
+		os.WriteFile(filepath.Join(p, "b"), make([]byte, 100-comp), 0644)
+		return p
+	}
+	low, mid, high := base("low", 10), base("mid", 40), base("high", 80)
+
+	// nothing listens there, so listings that aren't cached can't be fetched
+	cfg := &config{ExpandMinFraction: 0.3, Upstream: "127.0.0.1:1"}
+	c := newCatalog(cfg)
+	fewCompressed := hashA + "-few"
+	c.listFracCache.Add(fewCompressed, 0.1)
+	for _, tc := range []struct {
+		base, req string
+		exp       bool
+	}{
+		{low, hashB + "-other", false},
+		{mid, fewCompressed, false},
+		{mid, hashB + "-other", true}, // no listing, the base decides
+		{high, fewCompressed, true},   // the base is far enough above
+	} {
+		ni := &narinfo.NarInfo{StorePath: nixpath.StoreDir + "/" + tc.req}
+		if got := c.worthExpanding(tc.base, ni); got != tc.exp {
+			t.Errorf("%s for %s: got %v", filepath.Base(tc.base), tc.req, got)
+		}
+	}
+}
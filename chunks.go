@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Chunk transfer is an alternative to deltas for when there's no single similar base. The
+// differ splits the requested nar into content-defined chunks and returns a manifest of chunk
+// hashes. The substituter fills in what it can from chunks of local store paths, then asks
+// for just the missing chunks. The differ doesn't keep state between the two requests, it
+// downloads and chunks the nar again.
+//
+// The substituter doesn't chunk the whole store up front, that would mean reading all of it.
+// For each request, it indexes the few local paths that the catalog says are related (see
+// findChunkBases) and keeps them in memory, so later requests can use them too, up to
+// ChunkIndexBytes of nars.
+
+type (
+	chunkHash [sha256.Size]byte
+
+	chunkEntry struct {
+		hash chunkHash
+		size int
+	}
+
+	chunkRequest struct {
+		Protocol   int    `json:"protocol,omitempty"` // as in differRequest
+		ReqNarPath string `json:"reqNarPath"`
+		Upstream   string `json:"upstream,omitempty"`
+		Chunker    string `json:"chunker"`
+		Want       []int  `json:"want,omitempty"` // indexes of chunks to send (ascending), nil for manifest
+
+		// informational only:
+		ReqNarSize int64  `json:"reqNarSize"`
+		ReqName    string `json:"reqName"`
+	}
+
+	chunkHeader struct {
+		Protocol    int `json:",omitempty"` // as in differHeader
+		Chunker     string
+		Chunks      int    `json:",omitempty"` // manifest only
+		NarSize     int64  `json:",omitempty"` // manifest only
+		Compression string `json:",omitempty"` // of chunk data
+	}
+
+	// chunkIndex maps chunk hashes to locations in local store paths.
+	chunkIndex struct {
+		lock   sync.Mutex
+		chunks map[chunkHash]chunkLoc
+		paths  map[string]*chunkedPath // indexed store path -> its chunks
+		order  []string                // for eviction
+		bytes  int64
+		limit  int64
+	}
+
+	chunkedPath struct {
+		hashes []chunkHash
+		size   int64
+	}
+
+	chunkLoc struct {
+		storePath string
+		off       int64
+		size      int
+	}
+)
+
+const (
+	chunkerName   = "gear64k"
+	chunkAlgo     = "chunks"
+	chunkMin      = 16 * 1024
+	chunkAvg      = 64 * 1024
+	chunkMax      = 256 * 1024
+	chunkMaskS    = 0x0003590703530000 // harder to cut before avg
+	chunkMaskL    = 0x0000d90003530000 // easier to cut after avg
+	chunkEntryMax = sha256.Size + binary.MaxVarintLen64
+
+	// fall back to a direct download if we'd have to fetch more than this fraction
+	chunkMaxMissing = 0.8
+	// max candidate store paths to index for one request
+	chunkMaxBases = 8
+)
+
+var (
+	chunkGear = makeChunkGear()
+
+	errChunkMismatch = errors.New("chunk hash mismatch")
+)
+
+func makeChunkGear() (g [256]uint64) {
+	// splitmix64, so it's the same everywhere
+	x := uint64(0x6e69782d73616e64)
+	for i := range g {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		g[i] = z ^ (z >> 31)
+	}
+	return
+}
+
+// chunkCut returns the length of the first chunk of b. If b is shorter than chunkMax and
+// we're not at the end of the input, the result may be len(b), meaning more data is needed.
+func chunkCut(b []byte) int {
+	n := len(b)
+	if n <= chunkMin {
+		return n
+	} else if n > chunkMax {
+		n = chunkMax
+	}
+	normal := min(chunkAvg, n)
+	var h uint64
+	i := chunkMin
+	for ; i < normal; i++ {
+		h = h<<1 + chunkGear[b[i]]
+		if h&chunkMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = h<<1 + chunkGear[b[i]]
+		if h&chunkMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunkStream splits r into chunks and calls fn for each one. The slice passed to fn is only
+// valid during the call.
+func chunkStream(r io.Reader, fn func([]byte) error) error {
+	buf := make([]byte, 2*chunkMax)
+	start, end := 0, 0
+	eof := false
+	for {
+		if !eof && end-start < chunkMax {
+			copy(buf, buf[start:end])
+			end -= start
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+		c := chunkCut(buf[start:end])
+		if err := fn(buf[start : start+c]); err != nil {
+			return err
+		}
+		start += c
+	}
+}
+
+func appendChunkEntry(m []byte, c []byte) []byte {
+	h := sha256.Sum256(c)
+	m = append(m, h[:]...)
+	return binary.AppendUvarint(m, uint64(len(c)))
+}
+
+func parseManifest(m []byte) ([]chunkEntry, error) {
+	var entries []chunkEntry
+	r := bytes.NewReader(m)
+	for r.Len() > 0 {
+		var e chunkEntry
+		if _, err := io.ReadFull(r, e.hash[:]); err != nil {
+			return nil, err
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		} else if size == 0 || size > chunkMax {
+			return nil, fmt.Errorf("bad chunk size %d", size)
+		}
+		e.size = int(size)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func newChunkIndex(limit int64) *chunkIndex {
+	return &chunkIndex{
+		chunks: make(map[chunkHash]chunkLoc),
+		paths:  make(map[string]*chunkedPath),
+		limit:  limit,
+	}
+}
+
+// indexPaths adds chunks of the given store paths to the index, evicting older paths if
+// needed.
+func (ci *chunkIndex) indexPaths(ctx context.Context, storePaths []string) {
+	for _, p := range storePaths {
+		if ctx.Err() != nil {
+			return
+		}
+		ci.lock.Lock()
+		_, have := ci.paths[p]
+		if !have {
+			// reserve so nobody else indexes it at the same time
+			ci.paths[p] = &chunkedPath{}
+			ci.order = append(ci.order, p)
+		}
+		ci.lock.Unlock()
+		if have {
+			continue
+		}
+
+		var hashes []chunkHash
+		var locs []chunkLoc
+		var off int64
+		err := func() error {
+			sn, err := newStoreNar(p)
+			if err != nil {
+				return err
+			}
+			defer sn.Close()
+			return chunkStream(io.NewSectionReader(sn, 0, sn.Size()), func(c []byte) error {
+				hashes = append(hashes, sha256.Sum256(c))
+				locs = append(locs, chunkLoc{storePath: p, off: off, size: len(c)})
+				off += int64(len(c))
+				return ctx.Err()
+			})
+		}()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Print("chunk index error for ", p, ": ", err)
+			}
+			// so it can be tried again
+			ci.lock.Lock()
+			ci.remove(p)
+			ci.lock.Unlock()
+			continue
+		}
+
+		ci.lock.Lock()
+		if _, ok := ci.paths[p]; !ok {
+			// evicted while we were working on it
+			ci.order = append(ci.order, p)
+		}
+		ci.paths[p] = &chunkedPath{hashes: hashes, size: off}
+		for i, h := range hashes {
+			ci.chunks[h] = locs[i]
+		}
+		ci.bytes += off
+		ci.evict()
+		ci.lock.Unlock()
+	}
+}
+
+// evict removes the oldest paths until we're under the limit. Must hold lock.
+func (ci *chunkIndex) evict() {
+	for ci.bytes > ci.limit && len(ci.order) > 1 {
+		p := ci.order[0]
+		ci.order = ci.order[1:]
+		cp := ci.paths[p]
+		for _, h := range cp.hashes {
+			if loc := ci.chunks[h]; loc.storePath == p {
+				delete(ci.chunks, h)
+			}
+		}
+		ci.bytes -= cp.size
+		delete(ci.paths, p)
+	}
+}
+
+// remove forgets a path that isn't indexed yet. Must hold lock.
+func (ci *chunkIndex) remove(p string) {
+	delete(ci.paths, p)
+	for i, o := range ci.order {
+		if o == p {
+			ci.order = append(ci.order[:i], ci.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (ci *chunkIndex) lookup(h chunkHash) (chunkLoc, bool) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	loc, ok := ci.chunks[h]
+	return loc, ok
+}
+
+// differChunks returns either a chunk manifest for the requested nar, or the data of some of
+// its chunks.
+func (d *differServer) differChunks(w http.ResponseWriter, r *http.Request) (retStatus int, retMsg string, retErr error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, "", nil
+	}
+
+	var req chunkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, "json decode error", err
+	} else if req.Chunker != chunkerName {
+		return http.StatusBadRequest, "unknown chunker", nil
+	}
+	for i := 1; i < len(req.Want); i++ {
+		if req.Want[i] <= req.Want[i-1] {
+			return http.StatusBadRequest, "want must be ascending", nil
+		}
+	}
+	if req.Upstream == "" {
+		req.Upstream = d.cfg.Upstream
+	}
+
+	if err := d.dlSem.Acquire(r.Context(), 1); err != nil {
+		return http.StatusInternalServerError, "canceled", nil
+	}
+	defer d.dlSem.Release(1)
+
+	u := url.URL{Scheme: "http", Host: req.Upstream, Path: "/" + req.ReqNarPath}
+	ns, err := streamNar(u.String(), nil)
+	if err != nil {
+		return http.StatusInternalServerError, "nar download error", err
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			ns.Close()
+		}
+	}()
+
+	var manifest []byte
+	var chunks int
+	var narSize int64
+	if req.Want == nil {
+		// need the whole manifest before we can write the header
+		err = chunkStream(ns, func(c []byte) error {
+			manifest = appendChunkEntry(manifest, c)
+			chunks++
+			narSize += int64(len(c))
+			return nil
+		})
+		if err == nil {
+			closed = true
+			err = ns.Close()
+		}
+		if err != nil {
+			return http.StatusInternalServerError, "nar chunk error", err
+		}
+	}
+
+	mpw := multipart.NewWriter(w)
+	defer func() {
+		if closeErr := mpw.Close(); closeErr != nil && retErr == nil {
+			retErr = closeErr
+		}
+	}()
+
+	w.Header().Set("Content-Type", mpw.FormDataContentType())
+
+	h := chunkHeader{
+		Protocol: differResponseProtocol(req.Protocol),
+		Chunker:  chunkerName,
+		Chunks:   chunks,
+		NarSize:  narSize,
+	}
+	if req.Want != nil {
+		h.Compression = "zstd"
+	}
+	if err := writeJsonField(mpw, differHeaderName, h); err != nil {
+		return http.StatusInternalServerError, "multipart write header", err
+	}
+	bw, err := mpw.CreateFormFile(differBodyName, "chunks")
+	if err != nil {
+		return http.StatusInternalServerError, "multipart write body", err
+	}
+
+	t := differTrailer{Ok: true, Stats: &DiffStats{Algo: chunkAlgo}}
+	if req.Want == nil {
+		if _, err = bw.Write(manifest); err != nil {
+			return http.StatusInternalServerError, "multipart write body", err
+		}
+		t.Stats.DiffSize = len(manifest)
+		t.Stats.NarSize = int(narSize)
+	} else {
+		cw := countWriter{w: bw}
+		zw, err := zstd.NewWriter(&cw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return http.StatusInternalServerError, "zstd init", err
+		}
+		idx, want := 0, req.Want
+		err = chunkStream(ns, func(c []byte) error {
+			narSize += int64(len(c))
+			if len(want) > 0 && want[0] == idx {
+				want = want[1:]
+				if _, err := zw.Write(c); err != nil {
+					return err
+				}
+			}
+			idx++
+			return nil
+		})
+		if err == nil {
+			closed = true
+			err = ns.Close()
+		}
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && len(want) > 0 {
+			err = fmt.Errorf("want index %d out of range", want[0])
+		}
+		if err != nil {
+			t.Ok = false
+			t.Error = err.Error()
+		}
+		t.Stats.DiffSize = cw.c
+		t.Stats.NarSize = int(narSize)
+	}
+
+	if err := writeJsonField(mpw, differTrailerName, t); err != nil {
+		return http.StatusInternalServerError, "multipart write trailer", err
+	}
+	return 0, t.Stats.String(), nil
+}
+
+// chunkTransfer assembles the requested nar from chunks of local store paths plus missing
+// chunks from the differ.
+func (s *subst) chunkTransfer(ctx context.Context, recent *recent, w io.Writer) (int, string, error) {
+	// index local candidates while we wait for the manifest
+	indexCtx, cancelIndex := context.WithCancel(ctx)
+	defer cancelIndex()
+	indexDone := make(chan struct{})
+	go func() {
+		s.catalog.chunks.indexPaths(indexCtx, recent.chunkBases)
+		close(indexDone)
+	}()
+
+	req := chunkRequest{
+		Protocol:   differProtocolVersion,
+		ReqNarPath: recent.request.ReqNarPath,
+		Upstream:   recent.request.Upstream,
+		Chunker:    chunkerName,
+		ReqNarSize: recent.request.ReqNarSize,
+		ReqName:    recent.request.ReqName,
+	}
+	var manifest []byte
+	var entries []chunkEntry
+	status, msg, err := s.requestChunks(ctx, &req, func(h *chunkHeader, body io.Reader) error {
+		var err error
+		if manifest, err = io.ReadAll(io.LimitReader(body, int64(h.Chunks)*chunkEntryMax)); err != nil {
+			return err
+		} else if entries, err = parseManifest(manifest); err != nil {
+			return err
+		}
+		var size int64
+		for _, e := range entries {
+			size += int64(e.size)
+		}
+		if len(entries) != h.Chunks || size != h.NarSize {
+			return errors.New("chunk manifest doesn't match header")
+		}
+		return nil
+	})
+	if err != nil || status != 0 {
+		return status, msg, err
+	}
+
+	select {
+	case <-indexDone:
+	case <-ctx.Done():
+		return http.StatusInternalServerError, "canceled", nil
+	}
+
+	// find what we have locally. store paths don't change, so we only check that they're
+	// still there here, and check chunk hashes as we write.
+	lr := newChunkLocalReader()
+	defer lr.close()
+	local := make([]*chunkLoc, len(entries))
+	var total, missing int
+	for i, e := range entries {
+		total += e.size
+		if loc, ok := s.catalog.chunks.lookup(e.hash); ok && loc.size == e.size && lr.open(loc.storePath) == nil {
+			local[i] = &loc
+			continue
+		}
+		req.Want = append(req.Want, i)
+		missing += e.size
+	}
+	if total > 0 && float64(missing)/float64(total) > chunkMaxMissing {
+		log.Printf("only %d/%d bytes of %s found locally", total-missing, total, recent.request.ReqName)
+		return s.fallbackDirect(ctx, recent, w, fallbackNoChunks)
+	}
+
+	// write everything in order, fetching missing chunks if needed, and check the whole nar
+	// against the narinfo in case the manifest was wrong
+	var received int
+	check := newNarCheckWriter(w, recent.request.ReqNarSize)
+	writeAll := func(remote io.Reader) error {
+		buf := make([]byte, chunkMax)
+		for i, e := range entries {
+			var c []byte
+			if local[i] != nil {
+				var err error
+				if c, err = lr.read(*local[i], e.hash); err != nil {
+					return err
+				}
+			} else {
+				c = buf[:e.size]
+				if _, err := io.ReadFull(remote, c); err != nil {
+					return err
+				} else if sha256.Sum256(c) != e.hash {
+					return errChunkMismatch
+				}
+			}
+			if _, err := check.Write(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(req.Want) == 0 {
+		err = writeAll(nil)
+	} else {
+		status, msg, err = s.requestChunks(ctx, &req, func(h *chunkHeader, body io.Reader) error {
+			if h.Compression != "zstd" {
+				return fmt.Errorf("unknown chunk compression %q", h.Compression)
+			}
+			cr := &countReader{r: body}
+			zr, err := zstd.NewReader(cr, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			err = writeAll(zr)
+			received = cr.c
+			return err
+		})
+	}
+	if err != nil || status != 0 {
+		return status, msg, err
+	} else if err = check.finish(recent.narHash); err != nil {
+		if errors.Is(err, errNarHashMismatch) {
+			s.writeDiffFailed(recent, failedAlgo)
+		}
+		return http.StatusInternalServerError, "chunked nar mismatch", err
+	}
+
+	recent.stats = &DiffStats{
+		Algo:     chunkAlgo,
+		DiffSize: len(manifest) + received,
+		NarSize:  total,
+		BaseSize: total - missing,
+	}
+	s.writeAnalytics(AnRecord{
+		D: &AnDiff{
+			Id:        recent.id,
+			DiffStats: recent.stats,
+		},
+	})
+	return 0, recent.stats.String(), nil
+}
+
+// requestChunks makes a chunk request and calls fn with the header and body. It checks the
+// trailer after fn returns.
+func (s *subst) requestChunks(ctx context.Context, req *chunkRequest, fn func(*chunkHeader, io.Reader) error) (int, string, error) {
+	res, status, msg, err := s.postDiffer(ctx, differChunksPath, req)
+	if err != nil || status != 0 {
+		return status, msg, err
+	}
+	defer res.Body.Close()
+
+	boundary, err := getBoundary(res.Header.Get("Content-Type"))
+	if err != nil {
+		return http.StatusInternalServerError, "parse multipart", err
+	}
+	mpr := multipart.NewReader(res.Body, boundary)
+
+	var h chunkHeader
+	if err = readDifferJson(mpr, differHeaderName, &h); err != nil {
+		return http.StatusInternalServerError, "parse multipart header", err
+	} else if err = checkDifferProtocol(h.Protocol); err != nil {
+		return http.StatusInternalServerError, "parse multipart header", err
+	} else if h.Chunker != chunkerName {
+		return http.StatusInternalServerError, "wrong chunker", nil
+	}
+
+	br, err := readDifferBody(mpr)
+	if err != nil {
+		return http.StatusInternalServerError, "parse multipart body", err
+	}
+	fnErr := fn(&h, br)
+
+	// check trailer even if fn failed, it might explain why
+	var t differTrailer
+	if err = readDifferJson(mpr, differTrailerName, &t); err != nil {
+		if fnErr != nil {
+			return http.StatusInternalServerError, "chunk body", fnErr
+		}
+		return http.StatusInternalServerError, "parse multipart trailer", err
+	} else if !t.Ok {
+		return http.StatusInternalServerError, "differ chunk error", errors.New(t.Error)
+	} else if fnErr != nil {
+		return http.StatusInternalServerError, "chunk body", fnErr
+	}
+	return 0, "", nil
+}
+
+// chunkLocalReader reads chunks from local store paths, keeping them open.
+type chunkLocalReader struct {
+	nars map[string]*storeNar
+	buf  []byte
+}
+
+func newChunkLocalReader() *chunkLocalReader {
+	return &chunkLocalReader{nars: make(map[string]*storeNar), buf: make([]byte, chunkMax)}
+}
+
+// read returns the chunk at loc if it still has the expected hash. The result is only valid
+// until the next call.
+func (lr *chunkLocalReader) read(loc chunkLoc, h chunkHash) ([]byte, error) {
+	if err := lr.open(loc.storePath); err != nil {
+		return nil, err
+	}
+	c := lr.buf[:loc.size]
+	if _, err := lr.nars[loc.storePath].ReadAt(c, loc.off); err != nil {
+		return nil, err
+	} else if sha256.Sum256(c) != h {
+		return nil, errChunkMismatch
+	}
+	return c, nil
+}
+
+// open opens a store path to read chunks from, if it isn't already.
+func (lr *chunkLocalReader) open(storePath string) error {
+	if sn, ok := lr.nars[storePath]; ok {
+		if sn == nil {
+			return errNotFound
+		}
+		return nil
+	}
+	sn, err := newStoreNar(storePath)
+	if err != nil {
+		// don't try again for every chunk
+		lr.nars[storePath] = nil
+		return err
+	}
+	lr.nars[storePath] = sn
+	return nil
+}
+
+func (lr *chunkLocalReader) close() {
+	for _, sn := range lr.nars {
+		if sn != nil {
+			sn.Close()
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+func chunkAll(t *testing.T, b []byte) (sizes []int) {
+	err := chunkStream(bytes.NewReader(b), func(c []byte) error {
+		sizes = append(sizes, len(c))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestChunker(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 4000000)
+	r.Read(data)
+
+	sizes := chunkAll(t, data)
+	total := 0
+	for i, s := range sizes {
+		if s > chunkMax || (s < chunkMin && i < len(sizes)-1) {
+			t.Error("bad chunk size", s)
+		}
+		total += s
+	}
+	if total != len(data) {
+		t.Fatal("total", total)
+	}
+	t.Logf("%d chunks, avg %d", len(sizes), total/len(sizes))
+
+	// inserting near the start should only change the first couple chunks
+	shifted := append([]byte("inserted"), data...)
+	ss := chunkAll(t, shifted)
+	same := 0
+	for i, j := len(sizes)-1, len(ss)-1; i >= 0 && j >= 0 && sizes[i] == ss[j]; i, j = i-1, j-1 {
+		same++
+	}
+	if same < len(sizes)-2 {
+		t.Errorf("only %d/%d chunks survived insertion", same, len(sizes))
+	}
+
+	// manifest round trip
+	var m []byte
+	chunkStream(bytes.NewReader(data), func(c []byte) error {
+		m = appendChunkEntry(m, c)
+		return nil
+	})
+	entries, err := parseManifest(m)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != len(sizes) {
+		t.Fatal("entries", len(entries), len(sizes))
+	}
+	for i, e := range entries {
+		if e.size != sizes[i] {
+			t.Error("entry", i, e.size, sizes[i])
+		}
+	}
+	if _, err := parseManifest(m[:len(m)-1]); err == nil {
+		t.Error("expected error for truncated manifest")
+	}
+}
+
+// TestChunkTransfer runs a chunk transfer against a local differ and upstream.
+func TestChunkTransfer(t *testing.T) {
+	if _, err := exec.LookPath(xzBin); err != nil {
+		t.Skip("no xz")
+	}
+	r := rand.New(rand.NewSource(1))
+	big := make([]byte, 3000000)
+	r.Read(big)
+	small := make([]byte, 200000)
+	r.Read(small)
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	os.MkdirAll(filepath.Join(base, "lib"), 0755)
+	os.WriteFile(filepath.Join(base, "lib/libbig.so"), big, 0755)
+	os.WriteFile(filepath.Join(base, "lib/libsmall.so"), small, 0755)
+	req := filepath.Join(dir, "req")
+	os.MkdirAll(filepath.Join(req, "lib"), 0755)
+	os.WriteFile(filepath.Join(req, "lib/libbig.so"), big, 0755)
+	r.Read(small)
+	os.WriteFile(filepath.Join(req, "lib/libsmall.so"), small, 0755)
+
+	var reqNar bytes.Buffer
+	if err := nar.DumpPath(&reqNar, req); err != nil {
+		t.Fatal(err)
+	}
+	xz := exec.Command(xzBin, "-c", "-1")
+	xz.Stdin = bytes.NewReader(reqNar.Bytes())
+	compressed, err := xz.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nar/req.nar.xz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(compressed)
+	}))
+	defer upstream.Close()
+	uu, _ := url.Parse(upstream.URL)
+
+	cfg := &config{Upstream: uu.Host, ChunkIndexBytes: 1 << 30}
+	differ := httptest.NewServer(newDifferServer(cfg).getHander())
+	defer differ.Close()
+	cfg.Differ = differ.URL
+
+	narHash := sha256.Sum256(reqNar.Bytes())
+	s := newLocalSubstituter(cfg, newCatalog(cfg))
+	rec := &recent{
+		id:      "test",
+		narHash: "sha256:" + nixbase32.EncodeToString(narHash[:]),
+		request: differRequest{
+			ReqNarPath: "nar/req.nar.xz",
+			Upstream:   uu.Host,
+			ReqNarSize: int64(reqNar.Len()),
+			ReqName:    "req",
+		},
+		chunkBases: []string{base},
+	}
+	var out bytes.Buffer
+	status, msg, err := s.chunkTransfer(context.Background(), rec, &out)
+	if err != nil || status != 0 {
+		t.Fatal(status, msg, err)
+	} else if !bytes.Equal(out.Bytes(), reqNar.Bytes()) {
+		t.Fatal("output mismatch")
+	}
+	st := rec.stats
+	if st.NarSize != reqNar.Len() || st.BaseSize < len(big)/2 || st.DiffSize > len(small)*2 {
+		t.Errorf("unexpected stats %s", st)
+	}
+	t.Log(st)
+
+	// a nar that doesn't match the narinfo never gets written whole
+	out.Reset()
+	rec.narHash = "sha256:" + nixbase32.EncodeToString(make([]byte, 32))
+	if _, _, err = s.chunkTransfer(context.Background(), rec, &out); !errors.Is(err, errNarHashMismatch) {
+		t.Errorf("expected mismatch, got %v", err)
+	} else if out.Len() >= reqNar.Len() {
+		t.Error("whole nar written despite mismatch")
+	}
+}
+
+func TestChunkIndexRetry(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "path")
+	ci := newChunkIndex(1 << 30)
+
+	// not there yet, so it shouldn't stay in the index
+	ci.indexPaths(context.Background(), []string{p})
+	if _, ok := ci.paths[p]; ok || len(ci.order) != 0 {
+		t.Fatalf("failed path kept: %v", ci.order)
+	}
+	os.MkdirAll(p, 0755)
+	os.WriteFile(filepath.Join(p, "file"), xzTestData(300000), 0644)
+	ci.indexPaths(context.Background(), []string{p})
+	if cp, ok := ci.paths[p]; !ok || len(cp.hashes) == 0 || len(ci.order) != 1 {
+		t.Error("path not indexed on retry")
+	}
+}
@@ -15,6 +15,8 @@ type (
 		SubstituterBind   string        `env:"nix_sandwich_substituter_bind=127.0.0.1:7419"`
 		CatalogUpdateFreq time.Duration `env:"nix_sandwich_catalog_update_freq=1h"`
 		DiffAlgo          string        `env:"nix_sandwich_diff_algo=zstd-3,xdelta-1"`
+		RaceAlgos         string        `env:"nix_sandwich_race_algos"` // e.g. "zstd-19,xdelta-9", empty to disable
+		RaceMinFileSize   int           `env:"nix_sandwich_race_min_file_size=33554432"`
 		MinFileSize       int           `env:"nix_sandwich_min_file_size=16384"`
 		MaxFileSize       int           `env:"nix_sandwich_max_file_size=681574400"` // 650MiB
 		MaxNarSize        int           `env:"nix_sandwich_max_nar_size=1073741824"` // 1GiB
@@ -24,6 +26,14 @@ type (
 		NarExpBufferEnt   int           `env:"nix_sandwich_nar_expander_buffer_entries"`
 		NarExpBufferBytes int64         `env:"nix_sandwich_nar_expander_buffer_bytes"`
 		SubstIdleTime     time.Duration `env:"nix_sandwich_subst_idle_time"`
+		PrefetchMemBytes  int64         `env:"nix_sandwich_prefetch_mem_bytes=67108864"`   // 64MiB, 0 to disable
+		PrefetchDiskBytes int64         `env:"nix_sandwich_prefetch_disk_bytes=536870912"` // 512MiB, 0 to disable
+		DifferStreamSize  int64         `env:"nix_sandwich_differ_stream_size=134217728"`  // 128MiB, 0 to disable
+		DifferAbortRatio  float64       `env:"nix_sandwich_differ_abort_ratio=1.0"`        // of compressed nar size, 0 to disable
+		ChunkMinNarSize   int64         `env:"nix_sandwich_chunk_min_nar_size=4194304"`    // 4MiB, 0 to disable chunk transfers
+		ChunkIndexBytes   int64         `env:"nix_sandwich_chunk_index_bytes=4294967296"`  // 4GiB of local nars
+		RewriteRefs       bool          `env:"nix_sandwich_rewrite_refs=true"`             // rewrite dependency hashes in base
+		ExpandMinFraction float64       `env:"nix_sandwich_expand_min_fraction=0.25"`      // of bytes in compressed files to expand, 0 to disable
 	}
 )
 
@@ -1,13 +1,32 @@
 package main
 
+import "net/http"
+
 const (
-	differPath = "/nix-sandwich-differ"
+	differPath       = "/nix-sandwich-differ"
+	differBatchPath  = differPath + "/batch"
+	differChunksPath = differPath + "/chunks"
+	differInfoPath   = differPath + "/info"
+
+	maxBatchSize = 64
+
+	// differ responses list the nar filters it supports in this header
+	differNarFiltersHeader = "X-Nix-Sandwich-Nar-Filters"
+
+	// differ gave up since the delta would be larger than the compressed nar
+	differStatusNotWorthIt = http.StatusUnprocessableEntity
 
 	differHeaderName  = "header"
 	differBodyName    = "body"
 	differTrailerName = "trailer"
 
 	narFilterExpandV2 = "expv2"
+	narFilterExpandV3 = "expv3" // also zst and bz2
+	narFilterExpandV4 = "expv4" // also zip members
+	narFilterExpandV5 = "expv5" // detect by content, verify everything
+	narFilterExpandV6 = "expv6" // also multi-block and multi-stream xz
+	narFilterExpandV7 = "expv7" // also tarball members
+	narFilterRefs     = "refsv1"
 
 	// analytics fields
 	failedNotFound  = "notfound"  // not found in upstream
@@ -15,10 +34,17 @@ const (
 	failedTooBig    = "toobig"    // too big for server to handle
 	failedNoBase    = "nobase"    // no local base
 	failedIdentical = "identical" // idential (in simulation)
+
+	failedCorrupt = "corrupt" // delta didn't match the differ's hash (transport problem)
+	failedAlgo    = "algo"    // delta arrived intact but didn't expand to the right nar
+
+	fallbackNotWorthIt = "notworth" // differ gave up, downloaded directly
+	fallbackNoChunks   = "nochunks" // too few chunks found locally, downloaded directly
 )
 
 var (
 	// binary paths (can be overridden by ldflags)
+	bzip2Bin   = "bzip2"
 	catBin     = "cat"
 	gzipBin    = "gzip"
 	nixBin     = "nix"
@@ -3,8 +3,8 @@ rec {
   src = {
     pname = "nix-sandwich";
     version = "0.0.4";
-    vendorHash = "sha256-XSnuy6VkWh6ygxBXx8WPopaCyD1H3/cv7Fm7RMVmArA=";
-    src = pkgs.lib.sourceByRegex ./. [ ".*.go" "go.(mod|sum)" ];
+    vendorHash = "sha256-zUESQyGs6Fy+PJ+7oJuGwFi+Qnmaldc+06vvgtctccM=";
+    src = pkgs.lib.sourceByRegex ./. [ ".*.go" "go.(mod|sum)" "testdata" "testdata/.*" ];
   };
 
   nix-sandwich-local = pkgs.buildGoModule (src // {
@@ -12,6 +12,7 @@ rec {
       brotli.dev
     ];
     ldflags = with pkgs; [
+      "-X main.bzip2Bin=${bzip2}/bin/bzip2"
       "-X main.catBin=${coreutils}/bin/cat"
       "-X main.gzipBin=${gzip}/bin/gzip"
       "-X main.nixBin=${nix}/bin/nix"
@@ -27,6 +28,7 @@ rec {
     CGO_ENABLED = "0";
     ldflags = [
       # "-s" "-w"  # only saves 3.6% of image size
+      "-X main.bzip2Bin=${bzip2StaticBin}/bin/bzip2"
       "-X main.gzipBin=${gzStaticBin}/bin/gzip"
       "-X main.xzBin=${xzStaticBin}/bin/xz"
       "-X main.zstdBin=${zstdStaticBin}/bin/zstd"
@@ -45,6 +47,11 @@ rec {
     src = pkgs.pkgsStatic.xz;
     installPhase = "mkdir -p $out/bin && cp $src/bin/xz $out/bin/";
   };
+  bzip2StaticBin = pkgs.stdenv.mkDerivation {
+    name = "bzip2-binonly";
+    src = pkgs.pkgsStatic.bzip2.bin;
+    installPhase = "mkdir -p $out/bin && cp $src/bin/bzip2 $out/bin/";
+  };
   gzStaticBin = pkgs.stdenv.mkDerivation {
     name = "gzip-binonly";
     src = pkgs.pkgsStatic.gzip;
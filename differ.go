@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"mime/multipart"
@@ -14,6 +18,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,17 +29,22 @@ import (
 
 type (
 	differRequest struct {
+		Protocol int `json:"protocol,omitempty"` // newest protocol version the client speaks
+
 		// required for request:
-		ReqNarPath    string   `json:"reqNarPath"`            // full nar path of requested
-		BaseStorePath string   `json:"baseStorePath"`         // full store path of base
-		AcceptAlgos   []string `json:"acceptAlgos,omitempty"` // accepted diff algos
-		NarFilter     string   `json:"narFilter,omitempty"`   // pipe nars through a filter
-		Upstream      string   `json:"upstream,omitempty"`
+		ReqNarPath    string            `json:"reqNarPath"`            // full nar path of requested
+		BaseStorePath string            `json:"baseStorePath"`         // full store path of base
+		AcceptAlgos   []string          `json:"acceptAlgos,omitempty"` // accepted diff algos
+		NarFilter     string            `json:"narFilter,omitempty"`   // pipe nars through filters (comma-separated)
+		RefRewrites   map[string]string `json:"refRewrites,omitempty"` // base hash -> req hash for refs filter
+		RaceAlgos     []string          `json:"raceAlgos,omitempty"`   // try all of these and use the smallest
+		Upstream      string            `json:"upstream,omitempty"`
 
 		// informational only:
-		BaseNarSize int64  `json:"baseNarSize"` // size of base nar
-		ReqNarSize  int64  `json:"reqNarSize"`  // size of requested nar (used for resource control)
-		ReqName     string `json:"reqName"`     // requested (name only, no hash) (used for log)
+		BaseNarSize int64  `json:"baseNarSize"`           // size of base nar
+		ReqNarSize  int64  `json:"reqNarSize"`            // size of requested nar (used for resource control)
+		ReqFileSize int64  `json:"reqFileSize,omitempty"` // compressed size of requested nar (used for early abort)
+		ReqName     string `json:"reqName"`               // requested (name only, no hash) (used for log)
 	}
 
 	differServer struct {
@@ -42,22 +52,75 @@ type (
 		diskSem  *semaphore.Weighted
 		dlSem    *semaphore.Weighted
 		deltaSem *semaphore.Weighted
+		policy   *algoPolicy
+	}
+
+	differJob struct {
+		algo      DiffAlgo
+		level     int
+		reason    string // why we picked this algo and level
+		reqName   string
+		baseNar   string     // path to downloaded base nar
+		reqNar    string     // path to downloaded requested nar
+		reqStream *narStream // used instead of reqNar when streaming
+		reqSize   int64      // size of reqStream, -1 if unknown
+		maxDelta  int64      // give up if delta is larger than this (if > 0)
+		race      []algoSpec // run all of these and pick the smallest (if > 1)
+		baseSize  int
+		expStats  map[string]int // outcomes of expanding the requested nar
+		protocol  int            // to answer with
+		narHash   string         // of the requested nar, once it's been read
+		cleanup   func()
+	}
+
+	// decompressed (and filtered) nar from upstream
+	narStream struct {
+		r          io.Reader
+		hash       hash.Hash // of the nar before filtering
+		decompress *exec.Cmd
+		body       io.Closer
+		eof        bool
 	}
 
 	differHeader struct {
-		Algo string
+		Protocol int `json:",omitempty"` // protocol version of the response
+		Algo     string
+		Level    int    `json:",omitempty"`
+		Reason   string `json:",omitempty"` // why the differ picked this algo and level
+		Index    int    `json:",omitempty"` // index of request (batch only)
 	}
 
 	differTrailer struct {
-		Ok    bool
-		Stats *DiffStats
-		Error string
+		Ok         bool
+		Stats      *DiffStats
+		Error      string
+		Status     int          `json:",omitempty"` // http status for failed items (batch only)
+		Candidates []*DiffStats `json:",omitempty"` // all results when racing
+		DeltaHash  string       `json:",omitempty"` // of the body, to tell corruption from algo failure
+		NarHash    string       `json:",omitempty"` // of the requested nar, which the client should get
 	}
 
 	readerFilter func(io.Reader) io.Reader
+
+	// narFilters are the functions for one nar filter
+	narFilters struct {
+		exp  readerFilter // applied to both nars before diffing
+		col  readerFilter // undoes exp after expanding
+		base readerFilter // applied to the base only, after exp
+		// used instead of exp for the base, if set
+		expBase readerFilter
+		// like exp, but also counts expansion outcomes into the map
+		expCount func(map[string]int) readerFilter
+	}
 )
 
-var errNotFound = errors.New("not found")
+var (
+	errNotFound   = errors.New("not found")
+	errNotWorthIt = errors.New("delta larger than compressed nar")
+
+	errDeltaCorrupt    = errors.New("delta doesn't match hash")
+	errNarHashMismatch = errors.New("expanded nar doesn't match hash")
+)
 
 func newDifferServer(cfg *config) *differServer {
 	// roughly, each download will use some network plus an xz process,
@@ -69,13 +132,21 @@ func newDifferServer(cfg *config) *differServer {
 		diskSem:  semaphore.NewWeighted(getTempDirFreeBytes()),
 		dlSem:    semaphore.NewWeighted(concurrency),
 		deltaSem: semaphore.NewWeighted(concurrency),
+		policy:   newAlgoPolicy(),
 	}
 }
 
 func (d *differServer) getHander() http.Handler {
 	h := http.NewServeMux()
 	h.HandleFunc(differPath, fw(d.differ, nil))
-	return h
+	h.HandleFunc(differBatchPath, fw(d.differBatch, nil))
+	h.HandleFunc(differChunksPath, fw(d.differChunks, nil))
+	h.HandleFunc(differInfoPath, fw(d.info, nil))
+	filters := strings.Join(supportedNarFilters(), ",")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(differNarFiltersHeader, filters)
+		h.ServeHTTP(w, r)
+	})
 }
 
 func (d *differServer) serve() error {
@@ -95,6 +166,199 @@ func (d *differServer) differ(w http.ResponseWriter, r *http.Request) (retStatus
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		return http.StatusBadRequest, "json decode error", err
 	}
+
+	// Times two because we need base + requested and we expect them to be about the same
+	// size. When racing without a limit, once more for the spooled delta.
+	held := d.abortSize(&req) > 0
+	diskMult := int64(2)
+	if len(req.RaceAlgos) > 1 && !held {
+		diskMult++
+	}
+	job, status, msg, err := d.prepare(r.Context(), &req, diskMult)
+	if err != nil || status != 0 {
+		return status, msg, err
+	}
+	defer job.cleanup()
+
+	if d.deltaSem.Acquire(r.Context(), 1) != nil {
+		return http.StatusInternalServerError, "canceled", nil
+	}
+	defer d.deltaSem.Release(1)
+
+	// If we know the compressed size of the requested nar, hold the delta back in memory
+	// (it's at most that big) and give up if it gets too big, so the client can fall back
+	// to downloading it directly. This costs some latency since we can't stream the delta.
+	// We also have to hold it back when racing since we don't know the algo until it's
+	// done, in a temp file if there's no limit.
+	var t differTrailer
+	var algoErr error
+	var spool io.Reader
+	if held {
+		var buf bytes.Buffer
+		t, algoErr = d.create(r.Context(), job, &buf)
+		spool = &buf
+	} else if len(job.race) > 1 {
+		f, err := os.CreateTemp("", "delta")
+		if err != nil {
+			return http.StatusInternalServerError, "delta temp file", err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		t, algoErr = d.create(r.Context(), job, f)
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return http.StatusInternalServerError, "delta temp file", err
+		}
+		spool = f
+	}
+	if algoErr == errNotWorthIt {
+		return differStatusNotWorthIt, "not worth it", nil
+	}
+
+	mpw := multipart.NewWriter(w)
+	defer func() {
+		if closeErr := mpw.Close(); closeErr != nil && retErr == nil {
+			retErr = closeErr
+		}
+	}()
+
+	w.Header().Set("Content-Type", mpw.FormDataContentType())
+
+	// write our header
+	h := job.header()
+	if err := writeJsonField(mpw, differHeaderName, h); err != nil {
+		return http.StatusInternalServerError, "multipart write header", err
+	}
+
+	// write body
+	bw, err := mpw.CreateFormFile(differBodyName, "delta")
+	if err != nil {
+		return http.StatusInternalServerError, "multipart write body", err
+	}
+
+	if spool == nil {
+		t, algoErr = d.create(r.Context(), job, bw)
+	} else if t.Ok {
+		if err = ioCopy(bw, spool, nil, -1); err != nil {
+			return http.StatusInternalServerError, "multipart write body", err
+		}
+	}
+
+	// write trailer
+	err = writeJsonField(mpw, differTrailerName, t)
+	if err != nil {
+		return http.StatusInternalServerError, "multipart write trailer", err
+	}
+
+	return 0, t.Stats.String(), algoErr
+}
+
+// differBatch handles a list of requests and returns a header/body/trailer triple for each
+// one, in the order they finish. Each header contains the index of its request.
+func (d *differServer) differBatch(w http.ResponseWriter, r *http.Request) (retStatus int, retMsg string, retErr error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, "", nil
+	}
+
+	var reqs []differRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		return http.StatusBadRequest, "json decode error", err
+	} else if len(reqs) == 0 || len(reqs) > maxBatchSize {
+		return http.StatusBadRequest, "bad batch size", nil
+	}
+
+	mpw := multipart.NewWriter(w)
+	defer func() {
+		if closeErr := mpw.Close(); closeErr != nil && retErr == nil {
+			retErr = closeErr
+		}
+	}()
+
+	w.Header().Set("Content-Type", mpw.FormDataContentType())
+
+	var writeLock sync.Mutex
+	var g errgroup.Group
+	for i := range reqs {
+		i := i
+		g.Go(func() error { return d.differBatchItem(r.Context(), i, &reqs[i], mpw, &writeLock) })
+	}
+	if err := g.Wait(); err != nil {
+		return 0, "multipart write", err
+	}
+	return 0, fmt.Sprintf("batch of %d", len(reqs)), nil
+}
+
+func (d *differServer) differBatchItem(
+	ctx context.Context,
+	idx int,
+	req *differRequest,
+	mpw *multipart.Writer,
+	writeLock *sync.Mutex,
+) error {
+	h := differHeader{Protocol: differResponseProtocol(req.Protocol), Index: idx}
+	var t differTrailer
+	var delta *os.File
+
+	// times three since we buffer the delta also (though it should be much smaller)
+	job, status, msg, err := d.prepare(ctx, req, 3)
+	if err != nil || status != 0 {
+		t.Status = status
+		t.Error = msg
+		if err != nil {
+			t.Error += ": " + err.Error()
+		}
+	} else {
+		defer job.cleanup()
+
+		if err = d.deltaSem.Acquire(ctx, 1); err != nil {
+			return err
+		}
+		delta, err = os.CreateTemp("", "delta")
+		if err != nil {
+			d.deltaSem.Release(1)
+			return err
+		}
+		defer os.Remove(delta.Name())
+		defer delta.Close()
+
+		var algoErr error
+		t, algoErr = d.create(ctx, job, delta)
+		d.deltaSem.Release(1)
+		// after create, since racing picks the algo
+		h = job.header()
+		h.Index = idx
+		if algoErr == errNotWorthIt {
+			log.Print("batch item ", req.ReqName, " not worth it")
+		} else if algoErr != nil {
+			log.Print("batch item ", req.ReqName, " error: ", algoErr)
+		} else {
+			log.Print("batch item ", req.ReqName, " -> ", t.Stats.String())
+		}
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	if err := writeJsonField(mpw, differHeaderName, h); err != nil {
+		return err
+	}
+	bw, err := mpw.CreateFormFile(differBodyName, "delta")
+	if err != nil {
+		return err
+	}
+	if delta != nil && t.Ok {
+		if _, err := delta.Seek(0, io.SeekStart); err != nil {
+			return err
+		} else if err := ioCopy(bw, delta, nil, -1); err != nil {
+			return err
+		}
+	}
+	return writeJsonField(mpw, differTrailerName, t)
+}
+
+// prepare picks an algorithm and downloads the base and requested nars. diskMult is the
+// multiple of the requested nar size to reserve for temporary files. On success, the caller
+// must call cleanup on the returned job.
+func (d *differServer) prepare(ctx context.Context, req *differRequest, diskMult int64) (*differJob, int, string, error) {
 	if req.Upstream == "" {
 		req.Upstream = d.cfg.Upstream
 	}
@@ -105,95 +369,188 @@ func (d *differServer) differ(w http.ResponseWriter, r *http.Request) (retStatus
 	// 	req.Upstream = "nix-cache.s3.amazonaws.com"
 	// }
 
-	// TODO: pick algo based on size or other properties?
-	algo := pickAlgo(req.AcceptAlgos)
-	if algo == nil {
-		return http.StatusBadRequest, "unknown algo", nil
+	if max := int64(d.cfg.MaxNarSize); max > 0 && (req.ReqNarSize > max || req.BaseNarSize > max) {
+		return nil, http.StatusRequestEntityTooLarge, "nar too big", nil
+	}
+
+	choice := d.policy.pick(ctx, req)
+	if choice == nil {
+		return nil, http.StatusBadRequest, "unknown algo", nil
 	}
 
-	// times two because we need base + requested and we expect them to be about the same size
-	size := req.ReqNarSize * 2
-	if err := d.diskSem.Acquire(r.Context(), size); err != nil {
-		return http.StatusInsufficientStorage, "disk semaphore", err
+	var race []algoSpec
+	for _, a := range req.RaceAlgos {
+		if spec, ok := parseAlgoSpec(a); ok {
+			race = append(race, spec)
+		}
+	}
+
+	// for large nars, stream the requested nar directly into the algorithm instead of
+	// writing it to disk first. (not when racing since we need to read it more than once)
+	stream := d.cfg.DifferStreamSize > 0 && req.ReqNarSize >= d.cfg.DifferStreamSize && len(race) < 2
+
+	filters, err := getNarFilter(d.cfg, req)
+	if err != nil {
+		return nil, http.StatusBadRequest, "bad nar filter", err
+	}
+	// a filtered nar has unknown size, so some algos write it to disk anyway
+	if stream && (filters.req == nil || !spoolsUnsizedRequest(choice.algo)) {
+		diskMult--
+	}
+
+	size := req.ReqNarSize * diskMult
+	if err := d.diskSem.Acquire(ctx, size); err != nil {
+		return nil, http.StatusInsufficientStorage, "disk semaphore", err
 	}
-	defer d.diskSem.Release(size)
 
 	// download base + req nar
-	var baseNar, reqNar string
+	job := &differJob{
+		algo:     choice.algo,
+		level:    choice.level,
+		reason:   choice.reason,
+		reqName:  req.ReqName,
+		reqSize:  -1,
+		race:     race,
+		protocol: differResponseProtocol(req.Protocol),
+	}
+	job.maxDelta = d.abortSize(req)
+	expFilter := filters.req
+	if filters.reqCount != nil {
+		job.expStats = make(map[string]int)
+		expFilter = filters.reqCount(job.expStats)
+	}
+	baseFilter := filters.base
+
 	var g errgroup.Group
-	var baseSize int
-	expFilter, _ := getNarFilter(d.cfg, &req)
 
 	g.Go(func() error {
-		if err := d.dlSem.Acquire(r.Context(), 1); err != nil {
+		if stream {
+			// start this now, the algorithm will read it when it's ready
+			var err error
+			u := url.URL{Scheme: "http", Host: req.Upstream, Path: "/" + req.ReqNarPath}
+			job.reqStream, err = streamNar(u.String(), expFilter)
+			if expFilter == nil {
+				job.reqSize = req.ReqNarSize
+			}
+			return err
+		}
+
+		if err := d.dlSem.Acquire(ctx, 1); err != nil {
 			return err
 		}
 		defer d.dlSem.Release(1)
 
 		var err error
-		reqNar, err = d.downloadNar(req.Upstream, req.ReqName, req.ReqNarPath, expFilter)
+		job.reqNar, job.narHash, err = d.downloadNar(req.Upstream, req.ReqName, req.ReqNarPath, expFilter)
 		return err
 	})
 	g.Go(func() error {
-		if err := d.dlSem.Acquire(r.Context(), 1); err != nil {
+		if err := d.dlSem.Acquire(ctx, 1); err != nil {
 			return err
 		}
 		defer d.dlSem.Release(1)
 
 		var err error
 		hash, _, _ := strings.Cut(path.Base(req.BaseStorePath), "-")
-		baseNar, err = d.downloadNarFromInfo(req.Upstream, hash, expFilter)
+		job.baseNar, err = d.downloadNarFromInfo(req.Upstream, hash, baseFilter)
 		if err == nil {
-			if st, e := os.Stat(baseNar); e == nil {
-				baseSize = int(st.Size())
+			if st, e := os.Stat(job.baseNar); e == nil {
+				job.baseSize = int(st.Size())
 			}
 		}
 		return err
 	})
 
-	err := g.Wait()
-	defer os.Remove(baseNar)
-	defer os.Remove(reqNar)
+	err = g.Wait()
+	job.cleanup = func() {
+		if job.reqStream != nil {
+			job.reqStream.Close()
+		}
+		os.Remove(job.baseNar)
+		os.Remove(job.reqNar)
+		d.diskSem.Release(size)
+	}
 
 	if err != nil {
+		job.cleanup()
 		if err == errNotFound {
-			return http.StatusNotFound, "nar download error", err
+			return nil, http.StatusNotFound, "nar download error", err
 		}
-		return http.StatusInternalServerError, "nar download error", err
+		return nil, http.StatusInternalServerError, "nar download error", err
 	}
+	return job, 0, "", nil
+}
 
-	if d.deltaSem.Acquire(r.Context(), 1) != nil {
-		return http.StatusInternalServerError, "canceled", nil
+// abortSize returns the delta size past which we give up on a request, or 0.
+func (d *differServer) abortSize(req *differRequest) int64 {
+	if req.ReqFileSize > 0 && d.cfg.DifferAbortRatio > 0 {
+		return int64(float64(req.ReqFileSize) * d.cfg.DifferAbortRatio)
 	}
-	defer d.deltaSem.Release(1)
-
-	// TODO: consider a quick check on delta-bility before we do it for real,
-	// to save computation/bandwidth
+	return 0
+}
 
-	mpw := multipart.NewWriter(w)
-	defer func() {
-		if closeErr := mpw.Close(); closeErr != nil && retErr == nil {
-			retErr = closeErr
-		}
-	}()
+func (job *differJob) header() differHeader {
+	return differHeader{
+		Protocol: job.protocol,
+		Algo:     job.algo.Name(),
+		Level:    job.level,
+		Reason:   job.reason,
+	}
+}
 
-	w.Header().Set("Content-Type", mpw.FormDataContentType())
+// create runs the diff algorithm for a prepared job, writing the delta to w. If the job has
+// a maximum delta size and the delta exceeds it, this returns errNotWorthIt.
+func (d *differServer) create(ctx context.Context, job *differJob, w io.Writer) (differTrailer, error) {
+	h := sha256.New()
+	t, err := d.createDelta(ctx, job, io.MultiWriter(w, h))
+	if t.Ok {
+		t.DeltaHash = nixHashString(h)
+		t.NarHash = job.narHash
+	}
+	return t, err
+}
 
-	// write our header
-	var h differHeader
-	h.Algo = algo.Name()
-	if err := writeJsonField(mpw, differHeaderName, h); err != nil {
-		return http.StatusInternalServerError, "multipart write header", err
+func (d *differServer) createDelta(ctx context.Context, job *differJob, w io.Writer) (differTrailer, error) {
+	if len(job.race) > 1 {
+		t, err := d.race(ctx, job, w)
+		if t.Stats != nil {
+			t.Stats.Expand = job.expStats
+		}
+		return t, err
 	}
 
-	// write body
-	bw, err := mpw.CreateFormFile(differBodyName, "delta")
+	var lw *limitWriter
+	if job.maxDelta > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		lw = &limitWriter{w: w, n: job.maxDelta, cancel: cancel}
+		w = lw
+	}
 
-	stats, algoErr := algo.Create(r.Context(), CreateArgs{
-		Base:    baseNar,
-		Request: reqNar,
-		Output:  bw,
-	})
+	args := CreateArgs{
+		Base:        job.baseNar,
+		Request:     job.reqNar,
+		RequestSize: job.reqSize,
+		Output:      w,
+	}
+	if job.reqStream != nil {
+		args.RequestReader = job.reqStream
+	}
+	stats, algoErr := job.algo.Create(ctx, args)
+	if job.reqStream != nil {
+		// make sure the whole nar was downloaded and decompressed successfully
+		if err := job.reqStream.Close(); err != nil && algoErr == nil {
+			algoErr = fmt.Errorf("requested nar stream: %w", err)
+		} else if err == nil {
+			job.narHash = job.reqStream.narHash()
+		}
+		job.reqStream = nil
+	}
+	if lw != nil && lw.exceeded {
+		t := differTrailer{Status: differStatusNotWorthIt, Error: errNotWorthIt.Error()}
+		return t, errNotWorthIt
+	}
 
 	var t differTrailer
 
@@ -203,37 +560,28 @@ func (d *differServer) differ(w http.ResponseWriter, r *http.Request) (retStatus
 	} else {
 		t.Ok = true
 		t.Stats = stats
-		t.Stats.BaseSize = baseSize
+		t.Stats.BaseSize = job.baseSize
+		t.Stats.Expand = job.expStats
+		d.policy.record(job.reqName, stats)
 	}
-
-	// write trailer
-	err = writeJsonField(mpw, differTrailerName, t)
-	if err != nil {
-		return http.StatusInternalServerError, "multipart write trailer", err
-	}
-
-	return 0, t.Stats.String(), algoErr
+	return t, algoErr
 }
 
-func (d *differServer) downloadNar(upstream, reqName, narPath string, narFilter readerFilter) (retPath string, retErr error) {
-	fileHash := path.Base(narPath)
-	compression := path.Ext(fileHash)
-	fileHash = strings.TrimSuffix(fileHash, compression)
-
+// downloadNar downloads a nar to a temp file, returning its name and the hash of the nar
+// (before filtering).
+func (d *differServer) downloadNar(upstream, reqName, narPath string, narFilter readerFilter) (retPath, retHash string, retErr error) {
 	start := time.Now()
 	u := url.URL{Scheme: "http", Host: upstream, Path: "/" + narPath}
-	res, err := http.Get(u.String())
+	ns, err := streamNar(u.String(), narFilter)
 	if err != nil {
-		log.Print("download http error: ", err, " for ", u.String())
-		return "", err
-	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		log.Print("download http status: ", res.Status, " for ", u.String())
-		return "", fmt.Errorf("http error %s", res.Status)
+		return "", "", err
 	}
 
 	f, err := os.CreateTemp("", "nar")
+	if err != nil {
+		ns.Close()
+		return "", "", err
+	}
 	name := f.Name()
 	defer func() {
 		if retErr != nil {
@@ -242,6 +590,43 @@ func (d *differServer) downloadNar(upstream, reqName, narPath string, narFilter
 	}()
 	defer f.Close()
 
+	copyErr := ioCopy(f, ns, nil, -1)
+	if err = ns.Close(); err != nil {
+		return "", "", err
+	} else if copyErr != nil {
+		log.Print("download write error: ", copyErr)
+		return "", "", copyErr
+	}
+	var size int64
+	if st, err := f.Stat(); err == nil {
+		size = st.Size()
+	}
+
+	elapsed := time.Since(start)
+	ps := ns.decompress.ProcessState
+	log.Printf("downloaded %s [%d bytes] in %s [decmp %s user, %s sys]: %.3f MB/s",
+		reqName, size, elapsed, ps.UserTime(), ps.SystemTime(),
+		float64(size)/elapsed.Seconds()/1e6,
+	)
+	return name, ns.narHash(), nil
+}
+
+// streamNar starts downloading a nar from upstream and returns a reader for the decompressed
+// (and filtered) contents.
+func streamNar(narUrl string, narFilter readerFilter) (*narStream, error) {
+	compression := path.Ext(narUrl)
+
+	res, err := http.Get(narUrl)
+	if err != nil {
+		log.Print("download http error: ", err, " for ", narUrl)
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		log.Print("download http status: ", res.Status, " for ", narUrl)
+		return nil, fmt.Errorf("http error %s", res.Status)
+	}
+
 	var decompress *exec.Cmd
 	switch compression {
 	case "", "none":
@@ -251,47 +636,62 @@ func (d *differServer) downloadNar(upstream, reqName, narPath string, narFilter
 	case ".zst":
 		decompress = exec.Command(zstdBin, "-d")
 	default:
-		return "", fmt.Errorf("unknown compression %q", compression)
+		res.Body.Close()
+		return nil, fmt.Errorf("unknown compression %q", compression)
 	}
 	decompress.Stdin = res.Body
-	filterErrCh := make(chan error, 1)
-	if narFilter == nil {
-		decompress.Stdout = f
-		filterErrCh <- nil
-	} else {
-		pr, err := decompress.StdoutPipe()
-		if err != nil {
-			return "", err
-		}
-		expanded := narFilter(pr)
-		go func() { filterErrCh <- ioCopy(f, expanded, nil, -1) }()
-	}
 	decompress.Stderr = os.Stderr
+	pr, err := decompress.StdoutPipe()
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
 	if err = decompress.Start(); err != nil {
+		res.Body.Close()
 		log.Print("download decompress start error: ", err)
-		return "", err
-	}
-	filterErr := <-filterErrCh
-	if err = decompress.Wait(); err != nil {
-		log.Print("download decompress error: ", err)
-		return "", err
+		return nil, err
 	}
-	if filterErr != nil {
-		log.Print("download filter error: ", err)
-		return "", err
+	ns := &narStream{decompress: decompress, body: res.Body, hash: sha256.New()}
+	ns.r = io.TeeReader(pr, ns.hash)
+	if narFilter != nil {
+		ns.r = narFilter(ns.r)
 	}
-	var size int64
-	if st, err := f.Stat(); err == nil {
-		size = st.Size()
+	return ns, nil
+}
+
+// narHash returns the hash of the nar in narinfo format, once the stream has been read to
+// the end.
+func (ns *narStream) narHash() string {
+	return nixHashString(ns.hash)
+}
+
+func (ns *narStream) Read(p []byte) (int, error) {
+	n, err := ns.r.Read(p)
+	if err == io.EOF {
+		ns.eof = true
 	}
+	return n, err
+}
 
-	elapsed := time.Since(start)
-	ps := decompress.ProcessState
-	log.Printf("downloaded %s [%d bytes] in %s [decmp %s user, %s sys]: %.3f MB/s",
-		reqName, size, elapsed, ps.UserTime(), ps.SystemTime(),
-		float64(size)/elapsed.Seconds()/1e6,
-	)
-	return name, nil
+// Close cleans up and returns any error from decompression or filtering. If the stream
+// wasn't read to the end, it's aborted.
+func (ns *narStream) Close() error {
+	if !ns.eof {
+		// stop filter goroutines and decompression process
+		if c, ok := ns.r.(io.Closer); ok {
+			c.Close()
+		}
+		ns.decompress.Process.Kill()
+	}
+	err := ns.decompress.Wait()
+	ns.body.Close()
+	if err != nil {
+		log.Print("download decompress error: ", err)
+		return err
+	} else if !ns.eof {
+		return errors.New("nar stream closed early")
+	}
+	return nil
 }
 
 func (d *differServer) downloadNarFromInfo(upstream, storePathHash string, narFilter readerFilter) (string, error) {
@@ -317,7 +717,111 @@ func (d *differServer) downloadNarFromInfo(upstream, storePathHash string, narFi
 	if err != nil {
 		return "", err
 	}
-	return d.downloadNar(upstream, ni.StorePath[44:], ni.URL, narFilter)
+	name, _, err := d.downloadNar(upstream, ni.StorePath[44:], ni.URL, narFilter)
+	return name, err
+}
+
+// race runs all algos in job.race to temp files and writes the smallest result to w. The
+// caller holds one slot in deltaSem, other candidates run only if there are free slots. On
+// return, job has the winning algo.
+func (d *differServer) race(ctx context.Context, job *differJob, w io.Writer) (differTrailer, error) {
+	type result struct {
+		spec  algoSpec
+		f     *os.File
+		t     differTrailer
+		err   error
+		start bool
+	}
+	results := make([]result, len(job.race))
+	var wg sync.WaitGroup
+	for i, spec := range job.race {
+		if i > 0 && !d.deltaSem.TryAcquire(1) {
+			log.Printf("race %s: skipping %s-%d, too busy", job.reqName, spec.name, spec.level)
+			continue
+		}
+		res := &results[i]
+		res.spec, res.start = spec, true
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i > 0 {
+				defer d.deltaSem.Release(1)
+			}
+			if res.f, res.err = os.CreateTemp("", "race"); res.err != nil {
+				return
+			}
+			sub := *job
+			sub.algo = getAlgo(res.spec.name)
+			sub.algo.SetLevel(res.spec.level)
+			sub.race = nil
+			res.t, res.err = d.create(ctx, &sub, res.f)
+		}(i)
+	}
+	wg.Wait()
+
+	var best *result
+	var candidates []*DiffStats
+	var firstErr error
+	for i := range results {
+		res := &results[i]
+		if res.f != nil {
+			defer os.Remove(res.f.Name())
+			defer res.f.Close()
+		}
+		if !res.start {
+			continue
+		} else if res.err != nil {
+			log.Printf("race %s: %s-%d failed: %v", job.reqName, res.spec.name, res.spec.level, res.err)
+			if firstErr == nil || firstErr == errNotWorthIt {
+				firstErr = res.err
+			}
+			continue
+		}
+		candidates = append(candidates, res.t.Stats)
+		if best == nil || res.t.Stats.DiffSize < best.t.Stats.DiffSize {
+			best = res
+		}
+	}
+
+	if best == nil {
+		if firstErr == errNotWorthIt {
+			return differTrailer{Status: differStatusNotWorthIt, Error: firstErr.Error()}, firstErr
+		}
+		return differTrailer{Error: firstErr.Error()}, firstErr
+	}
+
+	job.algo = getAlgo(best.spec.name)
+	job.algo.SetLevel(best.spec.level)
+	job.level = best.spec.level
+	job.reason = "race"
+
+	if _, err := best.f.Seek(0, io.SeekStart); err != nil {
+		return differTrailer{Error: err.Error()}, err
+	} else if err := ioCopy(w, best.f, nil, -1); err != nil {
+		return differTrailer{Error: err.Error()}, err
+	}
+
+	t := best.t
+	t.Candidates = candidates
+	return t, nil
+}
+
+// limitWriter fails writes past n bytes and calls cancel.
+type limitWriter struct {
+	w        io.Writer
+	n        int64
+	cancel   func()
+	exceeded bool
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		l.exceeded = true
+		l.cancel()
+		return 0, errNotWorthIt
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
 }
 
 func writeJsonField(mpw *multipart.Writer, name string, v any) error {
@@ -336,15 +840,3 @@ func getTempDirFreeBytes() int64 {
 	}
 	return int64(st.Bfree) * st.Bsize * 9 / 10
 }
-
-func getNarFilter(cfg *config, req *differRequest) (readerFilter, readerFilter) {
-	switch req.NarFilter {
-	case narFilterExpandV2:
-		opts := cfgToNarExpanderOptions(cfg)
-		ex := func(r io.Reader) io.Reader { return ExpandNar(r, opts) }
-		cl := func(r io.Reader) io.Reader { return CollapseNar(r, opts) }
-		return ex, cl
-	default:
-		return nil, nil
-	}
-}
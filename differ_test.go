@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// testUpstream serves a base nar with its narinfo and a requested nar, uncompressed.
+func testUpstream(t *testing.T, baseNar, reqNar []byte) (*httptest.Server, string) {
+	baseStorePath := "/nix/store/" + hashA + "-base"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + hashA + ".narinfo":
+			fmt.Fprintf(w, "StorePath: %s\nURL: nar/base\nCompression: none\nNarSize: %d\n", baseStorePath, len(baseNar))
+		case "/nar/base":
+			w.Write(baseNar)
+		case "/nar/req":
+			w.Write(reqNar)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, baseStorePath
+}
+
+func TestDifferBatchRace(t *testing.T) {
+	if _, err := exec.LookPath(zstdBin); err != nil {
+		t.Skip("no", zstdBin)
+	}
+	dir := t.TempDir()
+	data := xzTestData(300000)
+	os.MkdirAll(filepath.Join(dir, "base"), 0755)
+	os.WriteFile(filepath.Join(dir, "base", "file"), data, 0644)
+	baseNar := dumpNar(t, filepath.Join(dir, "base"))
+	copy(data[5000:], "changed")
+	os.MkdirAll(filepath.Join(dir, "req"), 0755)
+	os.WriteFile(filepath.Join(dir, "req", "file"), data, 0644)
+	reqNar := dumpNar(t, filepath.Join(dir, "req"))
+
+	upstream, baseStorePath := testUpstream(t, baseNar, reqNar)
+	uu, _ := url.Parse(upstream.URL)
+	differ := httptest.NewServer(newDifferServer(&config{Upstream: uu.Host}).getHander())
+	defer differ.Close()
+
+	// the policy would pick bsdiff, but only the race results can be used
+	reqs, _ := json.Marshal([]differRequest{{
+		ReqNarPath:    "nar/req",
+		BaseStorePath: baseStorePath,
+		AcceptAlgos:   []string{"bsdiff-1"},
+		RaceAlgos:     []string{"zstd-3", "zstdgo-3"},
+		BaseNarSize:   int64(len(baseNar)),
+		ReqNarSize:    int64(len(reqNar)),
+		ReqName:       "req",
+	}})
+	res, err := http.Post(differ.URL+differBatchPath, "application/json", bytes.NewReader(reqs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	boundary, err := getBoundary(res.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpr := multipart.NewReader(res.Body, boundary)
+
+	var h differHeader
+	var tr differTrailer
+	if err := readDifferJson(mpr, differHeaderName, &h); err != nil {
+		t.Fatal(err)
+	}
+	br, err := readDifferBody(mpr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, _ := io.ReadAll(br)
+	if err := readDifferJson(mpr, differTrailerName, &tr); err != nil {
+		t.Fatal(err)
+	} else if !tr.Ok {
+		t.Fatal("trailer", tr.Error)
+	}
+	if h.Algo != tr.Stats.Algo || h.Reason != "race" {
+		t.Errorf("header %+v, trailer stats %+v", h, tr.Stats)
+	}
+
+	var out bytes.Buffer
+	if _, err := getExpandAlgo(h.Algo).Expand(context.Background(), ExpandArgs{
+		Base:   bytes.NewReader(baseNar),
+		Delta:  bytes.NewReader(delta),
+		Output: &out,
+	}); err != nil {
+		t.Fatal(h.Algo, err)
+	} else if !bytes.Equal(out.Bytes(), reqNar) {
+		t.Error("expanded with", h.Algo, "doesn't match")
+	}
+}
+
+func TestDifferAbort(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "base"), 0755)
+	os.WriteFile(filepath.Join(dir, "base", "file"), xzTestData(100000), 0644)
+	baseNar := dumpNar(t, filepath.Join(dir, "base"))
+	os.MkdirAll(filepath.Join(dir, "req"), 0755)
+	os.WriteFile(filepath.Join(dir, "req", "file"), xzTestData(200000)[100000:], 0644)
+	reqNar := dumpNar(t, filepath.Join(dir, "req"))
+
+	upstream, baseStorePath := testUpstream(t, baseNar, reqNar)
+	uu, _ := url.Parse(upstream.URL)
+	differ := httptest.NewServer(newDifferServer(&config{Upstream: uu.Host, DifferAbortRatio: 1}).getHander())
+	defer differ.Close()
+
+	for _, c := range []struct {
+		fileSize int64
+		status   int
+	}{
+		{1000, differStatusNotWorthIt},
+		{int64(len(reqNar)), http.StatusOK},
+	} {
+		buf, _ := json.Marshal(differRequest{
+			ReqNarPath:    "nar/req",
+			BaseStorePath: baseStorePath,
+			AcceptAlgos:   []string{"zstdgo-3"},
+			BaseNarSize:   int64(len(baseNar)),
+			ReqNarSize:    int64(len(reqNar)),
+			ReqFileSize:   c.fileSize,
+			ReqName:       "req",
+		})
+		res, err := http.Post(differ.URL+differPath, "application/json", bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != c.status {
+			t.Errorf("file size %d: got status %d, expected %d", c.fileSize, res.StatusCode, c.status)
+		}
+	}
+}
+
+func TestDifferStreamDisk(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "root"), 0755)
+	os.WriteFile(filepath.Join(dir, "root", "file"), xzTestData(10000), 0644)
+	narData := dumpNar(t, filepath.Join(dir, "root"))
+	upstream, baseStorePath := testUpstream(t, narData, narData)
+	uu, _ := url.Parse(upstream.URL)
+
+	// room for exactly one nar, which is all streaming should need, unless the algo writes
+	// out the filtered nar anyway
+	for _, c := range []struct {
+		algo string
+		ok   bool
+	}{
+		{"zstdgo-3", true},
+		{"zstd-3", false},
+	} {
+		d := newDifferServer(&config{Upstream: uu.Host, DifferStreamSize: 1})
+		d.diskSem = semaphore.NewWeighted(int64(len(narData)))
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		job, status, _, err := d.prepare(ctx, &differRequest{
+			ReqNarPath:    "nar/req",
+			BaseStorePath: baseStorePath,
+			AcceptAlgos:   []string{c.algo},
+			NarFilter:     narFilterExpandV7,
+			BaseNarSize:   int64(len(narData)),
+			ReqNarSize:    int64(len(narData)),
+			ReqName:       "req",
+		}, 2)
+		cancel()
+		if ok := err == nil && status == 0; ok != c.ok {
+			t.Errorf("%s: got %d %v", c.algo, status, err)
+		}
+		if job != nil {
+			job.cleanup()
+		}
+	}
+}
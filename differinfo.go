@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The differ describes what it can do at differInfoPath, so the substituter can shape its
+// requests instead of asking for things an older differ doesn't understand.
+
+const (
+	// how long the substituter trusts a differ info response (or its absence)
+	differInfoTTL     = 10 * time.Minute
+	differInfoTimeout = 5 * time.Second
+)
+
+var errOlderDiffer = errors.New("older differ without info")
+
+type (
+	differInfo struct {
+		ProtocolVersion int              `json:"protocolVersion"`
+		Algos           []differAlgoInfo `json:"algos"`
+		NarFilters      []string         `json:"narFilters"`
+		MaxNarSize      int64            `json:"maxNarSize,omitempty"` // 0 for no limit
+		MaxBatchSize    int              `json:"maxBatchSize,omitempty"`
+		// versions of the compressors that expansion checks against, see codecVersions
+		Codecs map[string]string `json:"codecs,omitempty"`
+	}
+
+	differAlgoInfo struct {
+		Name         string `json:"name"`
+		DefaultLevel int    `json:"defaultLevel"`
+		MaxLevel     int    `json:"maxLevel"`
+	}
+)
+
+func (d *differServer) getInfo() *differInfo {
+	info := &differInfo{
+		ProtocolVersion: differProtocolVersion,
+		NarFilters:      supportedNarFilters(),
+		MaxNarSize:      int64(d.cfg.MaxNarSize),
+		MaxBatchSize:    maxBatchSize,
+		Codecs:          codecVersions(),
+	}
+	for _, name := range algoNames {
+		info.Algos = append(info.Algos, differAlgoInfo{
+			Name:         name,
+			DefaultLevel: defaultLevel(name),
+			MaxLevel:     maxLevel(name),
+		})
+	}
+	return info
+}
+
+func (d *differServer) info(w http.ResponseWriter, r *http.Request) (int, string, error) {
+	if r.Method != "GET" {
+		return http.StatusMethodNotAllowed, "", nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d.getInfo()); err != nil {
+		return http.StatusInternalServerError, "json encode error", err
+	}
+	return 0, "", nil
+}
+
+// getDifferInfo returns what the differ told us about itself. It returns nil if we don't
+// know, and true if the differ is too old to support info requests. Once we've heard from
+// the differ, this doesn't wait for it: old info is refreshed in the background.
+func (s *subst) getDifferInfo() (*differInfo, bool) {
+	s.infoLock.Lock()
+	if !s.infoTime.IsZero() && time.Since(s.infoTime) < differInfoTTL {
+		defer s.infoLock.Unlock()
+		return s.info, s.infoOld
+	}
+	done := s.infoFetch
+	if done == nil {
+		done = make(chan struct{})
+		s.infoFetch = done
+		go s.refreshDifferInfo(done)
+	}
+	if !s.infoTime.IsZero() {
+		defer s.infoLock.Unlock()
+		return s.info, s.infoOld
+	}
+	s.infoLock.Unlock()
+
+	<-done
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	return s.info, s.infoOld
+}
+
+func (s *subst) refreshDifferInfo(done chan struct{}) {
+	info, err := s.fetchDifferInfo()
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	defer close(done)
+	s.infoFetch = nil
+	if errors.Is(err, errOlderDiffer) {
+		s.info, s.infoOld, s.infoTime = nil, true, time.Now()
+	} else if err != nil {
+		// keep what we had, if anything, and try again next time
+		log.Print("can't get differ info: ", err)
+	} else {
+		if len(info.NarFilters) > 0 {
+			s.differFilters.Store(&info.NarFilters)
+		}
+		s.info, s.infoOld, s.infoTime = info, false, time.Now()
+	}
+}
+
+func (s *subst) fetchDifferInfo() (*differInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), differInfoTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", makeDifferUrl(s.cfg.Differ, differInfoPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed {
+		return nil, errOlderDiffer
+	} else if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+	var info differInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, err
+	} else if info.ProtocolVersion < 1 {
+		return nil, fmt.Errorf("bad protocol version %d", info.ProtocolVersion)
+	}
+	return &info, nil
+}
+
+// limitAlgos returns the algos (name-level) from the list that the differ supports, with
+// levels lowered to its max. If it supports none of them, it returns the list unchanged so
+// the differ can report the error.
+func limitAlgos(algos []string, info *differInfo) []string {
+	if info == nil {
+		return algos
+	}
+	var out []string
+	for _, a := range algos {
+		name, _, _ := strings.Cut(a, "-")
+		for _, ai := range info.Algos {
+			if ai.Name != name {
+				continue
+			}
+			if spec, ok := parseAlgoSpec(a); ok && ai.MaxLevel > 0 && spec.level > ai.MaxLevel {
+				a = fmt.Sprintf("%s-%d", name, ai.MaxLevel)
+			}
+			out = append(out, a)
+			break
+		}
+	}
+	if len(out) == 0 {
+		return algos
+	}
+	return out
+}
+
+// limitExpandToCodecs rewrites the expand filter in a chain to the newest version whose
+// collapse only runs compressors that have the same version here and on the differ, or drops
+// it if there isn't one. A differ that doesn't report its compressors gets the baseline
+// version, which always ran without checking.
+func limitExpandToCodecs(filter string, info *differInfo) string {
+	ours := codecVersions()
+	usable := func(name string, version int) bool {
+		if info.Codecs == nil {
+			return hasNarFilter(&differRequest{NarFilter: strings.Join(baselineNarFilters, ",")}, name)
+		}
+		_, ok := narFilterRegistry[name]
+		return ok && codecsMatch(ours, info.Codecs, version)
+	}
+	var out []string
+	for _, name := range strings.Split(filter, ",") {
+		family, version, ok := parseNarFilterName(name)
+		if !ok || family != narFilterFamilyExpand {
+			out = append(out, name)
+			continue
+		}
+		for ; version > 0; version-- {
+			if cand := fmt.Sprintf("%sv%d", family, version); usable(cand, version) {
+				out = append(out, cand)
+				break
+			}
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// codecsMatch returns true if every compressor that collapsing expand filter version can run
+// is installed on both sides with the same version.
+func codecsMatch(ours, theirs map[string]string, version int) bool {
+	for _, c := range collapseCodecs(version) {
+		if ours[c] == "" || ours[c] != theirs[c] {
+			return false
+		}
+	}
+	return true
+}
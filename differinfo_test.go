@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDifferInfo(t *testing.T) {
+	cfg := &config{MaxNarSize: 1 << 20}
+	differ := httptest.NewServer(newDifferServer(cfg).getHander())
+	defer differ.Close()
+	cfg.Differ = differ.URL
+
+	s := newLocalSubstituter(cfg, newCatalog(cfg))
+	info, old := s.getDifferInfo()
+	if info == nil || old {
+		t.Fatal("no info")
+	} else if info.ProtocolVersion != differProtocolVersion || info.MaxNarSize != 1<<20 {
+		t.Errorf("bad info %+v", info)
+	} else if len(info.Algos) != len(algoNames) {
+		t.Errorf("algos %+v", info.Algos)
+	} else if !reflect.DeepEqual(info.Codecs, codecVersions()) {
+		t.Errorf("codecs %v, expected %v", info.Codecs, codecVersions())
+	}
+	if got := s.differFilters.Load(); got == nil || !reflect.DeepEqual(*got, supportedNarFilters()) {
+		t.Errorf("filters %v", got)
+	}
+
+	// older differ
+	oldDiffer := httptest.NewServer(http.NotFoundHandler())
+	defer oldDiffer.Close()
+	cfg.Differ = oldDiffer.URL
+	s = newLocalSubstituter(cfg, newCatalog(cfg))
+	if info, old := s.getDifferInfo(); info != nil || !old {
+		t.Errorf("expected older differ, got %+v", info)
+	} else if s.infoTime.IsZero() {
+		t.Error("missing info should be cached")
+	}
+
+	// errors aren't cached, and old info is served while refreshing
+	var fail atomic.Bool
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		differ.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+	cfg.Differ = flaky.URL
+	s = newLocalSubstituter(cfg, newCatalog(cfg))
+	fail.Store(true)
+	if info, old := s.getDifferInfo(); info != nil || old || !s.infoTime.IsZero() {
+		t.Errorf("error shouldn't be cached: %+v %v %v", info, old, s.infoTime)
+	}
+	fail.Store(false)
+	if info, _ := s.getDifferInfo(); info == nil {
+		t.Fatal("no info after error")
+	}
+	fail.Store(true)
+	s.infoTime = time.Now().Add(-2 * differInfoTTL)
+	if info, _ := s.getDifferInfo(); info == nil {
+		t.Error("stale info should be served while refreshing")
+	}
+}
+
+func TestLimitRequestFilters(t *testing.T) {
+	cfg := &config{}
+	rewrites := map[string]string{hashA: hashB}
+	info := &differInfo{NarFilters: supportedNarFilters(), Codecs: codecVersions()}
+	withCodecs := func(change map[string]string) *differInfo {
+		codecs := make(map[string]string)
+		for c, v := range codecVersions() {
+			codecs[c] = v
+		}
+		for c, v := range change {
+			if v == "" {
+				delete(codecs, c)
+			} else {
+				codecs[c] = v
+			}
+		}
+		return &differInfo{NarFilters: supportedNarFilters(), Codecs: codecs}
+	}
+	for _, c := range []struct {
+		name      string
+		supported []string
+		info      *differInfo
+		old       bool
+		exp       string
+	}{
+		{"unknown", nil, nil, false, "expv7,refsv1"},
+		{"current", supportedNarFilters(), info, false, "expv7,refsv1"},
+		{"older differ", nil, nil, true, "expv2"},
+		{"older differ with filters header", []string{"expv3", "refsv1"}, nil, true, "expv3,refsv1"},
+		{"other xz", supportedNarFilters(), withCodecs(map[string]string{"xz": "0.1"}), false, "refsv1"},
+		{"other bzip2", supportedNarFilters(), withCodecs(map[string]string{"bzip2": "0.1"}), false, "expv2,refsv1"},
+		{"no bzip2", supportedNarFilters(), withCodecs(map[string]string{"bzip2": ""}), false, "expv2,refsv1"},
+		{"no codecs reported", supportedNarFilters(), &differInfo{NarFilters: supportedNarFilters()}, false, "expv2,refsv1"},
+	} {
+		s := newLocalSubstituter(cfg, newCatalog(cfg))
+		if c.supported != nil {
+			s.differFilters.Store(&c.supported)
+		}
+		got, gotRewrites := s.limitRequestFilters("expv7,refsv1", rewrites, c.info, c.old)
+		if got != c.exp {
+			t.Errorf("%s: got %q, expected %q", c.name, got, c.exp)
+		} else if hasRefs := strings.Contains(got, narFilterRefs); hasRefs != (gotRewrites != nil) {
+			t.Errorf("%s: rewrites %v with filter %q", c.name, gotRewrites, got)
+		}
+	}
+}
+
+func TestLimitAlgos(t *testing.T) {
+	info := &differInfo{Algos: []differAlgoInfo{
+		{Name: zstdName, DefaultLevel: 9, MaxLevel: 19},
+		{Name: xdeltaName, DefaultLevel: 6, MaxLevel: 7},
+	}}
+	for _, c := range []struct {
+		algos string
+		info  *differInfo
+		exp   string
+	}{
+		{"zstd-3,xdelta-1", nil, "zstd-3,xdelta-1"},
+		{"zstd-3,xdelta-1", info, "zstd-3,xdelta-1"},
+		{"nardiff-9,zstd-22,xdelta-9", info, "zstd-19,xdelta-7"},
+		{"zstd,bsdiff", info, "zstd"},
+		{"bsdiff-3", info, "bsdiff-3"},
+	} {
+		got := strings.Join(limitAlgos(strings.Split(c.algos, ","), c.info), ",")
+		if got != c.exp {
+			t.Errorf("%s: got %s, expected %s", c.algos, got, c.exp)
+		}
+	}
+}
+
+func TestCodecVersionsByName(t *testing.T) {
+	bins := map[string]string{"xz": xzBin, "gzip": gzipBin}
+	for _, bin := range bins {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skip("no", bin)
+		}
+	}
+	// the same compressors installed at different paths, like a nix store path on each side
+	other := make(map[string]string)
+	for codec, bin := range bins {
+		p, _ := exec.LookPath(bin)
+		link := filepath.Join(t.TempDir(), codec+"-binonly", "bin", filepath.Base(p))
+		os.MkdirAll(filepath.Dir(link), 0755)
+		if err := os.Symlink(p, link); err != nil {
+			t.Fatal(err)
+		}
+		other[codec] = link
+	}
+	ours, theirs := readCodecVersions(bins), readCodecVersions(other)
+	if !reflect.DeepEqual(ours, theirs) {
+		t.Errorf("got %v and %v", ours, theirs)
+	} else if !codecsMatch(ours, theirs, 2) {
+		t.Error("expected match for expv2")
+	} else if codecsMatch(ours, theirs, 3) {
+		t.Error("expected no match for expv3 without zstd and bzip2")
+	}
+	for _, v := range ours {
+		if !reCodecVersion.MatchString(v) || strings.Contains(v, " ") {
+			t.Errorf("expected a version number, got %q", v)
+		}
+	}
+}
@@ -10,9 +10,12 @@ require (
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da
 	github.com/google/brotli/go/cbrotli v0.0.0-20230825080712-c1bd196833e4
 	github.com/google/btree v1.1.2
+	github.com/klauspost/compress v1.17.4
 	github.com/nix-community/go-nix v0.0.0-20230226174119-1f9567c0a1e5
+	github.com/ulikunitz/xz v0.5.17
 	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63
 	golang.org/x/sync v0.3.0
+	golang.org/x/sys v0.11.0
 )
 
 require (
@@ -23,6 +26,5 @@ require (
 	github.com/multiformats/go-varint v0.0.6 // indirect
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
 	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e // indirect
-	golang.org/x/sys v0.11.0 // indirect
 	lukechampine.com/blake3 v1.1.6 // indirect
 )
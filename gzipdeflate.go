@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// gzipCompress writes data to w exactly as GNU gzip -n would compress it at the given level
+// (1–9). GNU gzip's deflate is the ancestor of zlib's and shares the match finding and
+// huffman code, but differs in how it fills the window and where it ends blocks, so this
+// reuses zlibDeflater with those parts swapped out.
+func gzipCompress(w io.Writer, data []byte, level int) error {
+	var xfl byte
+	switch level {
+	case 1:
+		xfl = 4
+	case 9:
+		xfl = 2
+	}
+	if _, err := w.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, xfl, 3}); err != nil {
+		return err
+	}
+
+	d := &zlibDeflater{
+		w:      w,
+		in:     data,
+		cfg:    zdConfigTable[level],
+		gnu:    true,
+		level:  level,
+		window: make([]byte, 2*zdWSize),
+		head:   make([]uint16, zdHashSize),
+		prev:   make([]uint16, zdWSize),
+		syms:   make([]zdSym, 0, gnuLitBufsize),
+
+		matchLength: zdMinMatch - 1,
+		prevLength:  zdMinMatch - 1,
+	}
+	d.initBlock()
+	d.gnuInit()
+	if level <= 3 {
+		d.gnuDeflateFast()
+	} else {
+		d.gnuDeflateSlow()
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint32(trailer[4:], uint32(len(data)))
+	_, err := w.Write(trailer[:])
+	return err
+}
+
+const gnuLitBufsize = 0x8000
+
+// gnuInit is gzip's lm_init.
+func (d *zlibDeflater) gnuInit() {
+	d.lookahead = d.gnuRead(0, len(d.window))
+	if d.lookahead == 0 {
+		d.eof = true
+		return
+	}
+	for d.lookahead < zdMinLookahead && !d.eof {
+		d.gnuFillWindow()
+	}
+	d.insH = 0
+	for j := 0; j < zdMinMatch-1; j++ {
+		d.updateHash(d.window[j])
+	}
+}
+
+func (d *zlibDeflater) gnuRead(pos, size int) int {
+	n := copy(d.window[pos:pos+size], d.in)
+	d.in = d.in[n:]
+	return n
+}
+
+func (d *zlibDeflater) gnuFillWindow() {
+	more := len(d.window) - d.lookahead - d.strstart
+	if d.strstart >= zdWSize+zdMaxDist {
+		copy(d.window, d.window[zdWSize:])
+		d.matchStart -= zdWSize
+		d.strstart -= zdWSize
+		d.blockStart -= zdWSize
+		d.slideHash()
+		more += zdWSize
+	}
+	if !d.eof {
+		pos := d.strstart + d.lookahead
+		if n := d.gnuRead(pos, more); n == 0 {
+			d.eof = true
+			for i := pos; i < pos+zdMinMatch-1 && i < len(d.window); i++ {
+				d.window[i] = 0
+			}
+		} else {
+			d.lookahead += n
+		}
+	}
+}
+
+// gnuBlockFull is the end of gzip's ct_tally. Besides a full buffer, it ends a block early
+// when it looks like it's compressing well.
+func (d *zlibDeflater) gnuBlockFull() bool {
+	n := len(d.syms)
+	if d.level > 2 && n&0xfff == 0 {
+		out := n * 8
+		in := d.strstart - d.blockStart
+		for dcode := 0; dcode < zdDCodes; dcode++ {
+			out += d.dynD[dcode].freq * (5 + zdExtraDBits[dcode])
+		}
+		out >>= 3
+		if d.numDist < n/2 && out < in/2 {
+			return true
+		}
+	}
+	return n == gnuLitBufsize-1 || d.numDist == gnuLitBufsize
+}
+
+func (d *zlibDeflater) gnuDeflateFast() {
+	d.matchLength = 0
+	for d.lookahead != 0 && d.err == nil {
+		hashHead := d.insertString(d.strstart)
+		if hashHead != 0 && d.strstart-hashHead <= zdMaxDist && d.strstart <= len(d.window)-zdMinLookahead {
+			d.matchLength = d.longestMatch(hashHead)
+			if d.matchLength > d.lookahead {
+				d.matchLength = d.lookahead
+			}
+		}
+		var flush bool
+		if d.matchLength >= zdMinMatch {
+			flush = d.tallyDist(d.strstart-d.matchStart, d.matchLength-zdMinMatch)
+			d.lookahead -= d.matchLength
+			if d.matchLength <= d.cfg.lazy {
+				d.matchLength--
+				for {
+					d.strstart++
+					d.insertString(d.strstart)
+					if d.matchLength--; d.matchLength == 0 {
+						break
+					}
+				}
+				d.strstart++
+			} else {
+				d.strstart += d.matchLength
+				d.matchLength = 0
+				d.insH = uint(d.window[d.strstart])
+				d.updateHash(d.window[d.strstart+1])
+			}
+		} else {
+			flush = d.tallyLit(d.window[d.strstart])
+			d.lookahead--
+			d.strstart++
+		}
+		if flush {
+			d.flushBlock(false)
+		}
+		for d.lookahead < zdMinLookahead && !d.eof {
+			d.gnuFillWindow()
+		}
+	}
+	if d.err == nil {
+		d.flushBlock(true)
+	}
+}
+
+func (d *zlibDeflater) gnuDeflateSlow() {
+	for d.lookahead != 0 && d.err == nil {
+		hashHead := d.insertString(d.strstart)
+		d.prevLength, d.prevMatch = d.matchLength, d.matchStart
+		d.matchLength = zdMinMatch - 1
+		if hashHead != 0 && d.prevLength < d.cfg.lazy && d.strstart-hashHead <= zdMaxDist &&
+			d.strstart <= len(d.window)-zdMinLookahead {
+			d.matchLength = d.longestMatch(hashHead)
+			if d.matchLength > d.lookahead {
+				d.matchLength = d.lookahead
+			}
+			if d.matchLength == zdMinMatch && d.strstart-d.matchStart > zdTooFar {
+				d.matchLength--
+			}
+		}
+		if d.prevLength >= zdMinMatch && d.matchLength <= d.prevLength {
+			flush := d.tallyDist(d.strstart-1-d.prevMatch, d.prevLength-zdMinMatch)
+			d.lookahead -= d.prevLength - 1
+			d.prevLength -= 2
+			for {
+				d.strstart++
+				d.insertString(d.strstart)
+				if d.prevLength--; d.prevLength == 0 {
+					break
+				}
+			}
+			d.matchAvailable = false
+			d.matchLength = zdMinMatch - 1
+			d.strstart++
+			if flush {
+				d.flushBlock(false)
+			}
+		} else if d.matchAvailable {
+			if d.tallyLit(d.window[d.strstart-1]) {
+				d.flushBlock(false)
+			}
+			d.strstart++
+			d.lookahead--
+		} else {
+			d.matchAvailable = true
+			d.strstart++
+			d.lookahead--
+		}
+		for d.lookahead < zdMinLookahead && !d.eof {
+			d.gnuFillWindow()
+		}
+	}
+	if d.err == nil {
+		if d.matchAvailable {
+			d.tallyLit(d.window[d.strstart-1])
+		}
+		d.flushBlock(true)
+	}
+}
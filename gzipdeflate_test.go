@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGzipCompress(t *testing.T) {
+	if _, err := exec.LookPath(gzipBin); err != nil {
+		t.Skip("no", gzipBin)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	words := []string{".TH ", ".SH NAME\n", "the ", "quick ", "brown ", "fox ", "jumps\n", "over ", "lazy "}
+	var text []byte
+	for len(text) < 1000000 {
+		text = append(text, words[r.Intn(len(words))]...)
+		if r.Intn(50) == 0 {
+			junk := make([]byte, r.Intn(300))
+			r.Read(junk)
+			text = append(text, junk...)
+		}
+	}
+	random := make([]byte, 100000)
+	r.Read(random)
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"empty":  nil,
+		"short":  []byte("a"),
+		"text":   text,
+		"small":  text[:5000],
+		"random": random,
+		"zeros":  make([]byte, 300000),
+	} {
+		// gzip reads files in bigger chunks than pipes, which can change block boundaries
+		fn := filepath.Join(dir, name)
+		os.WriteFile(fn, data, 0644)
+		for level := 1; level <= 9; level++ {
+			exp, err := exec.Command(gzipBin, "-nc", fmt.Sprintf("-%d", level), fn).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := gzipCompress(&got, data, level); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(got.Bytes(), exp) {
+				t.Errorf("%s level %d: got %d bytes, expected %d", name, level, got.Len(), len(exp))
+			}
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// nardiff diffs nars entry by entry instead of as one byte stream. Entries of the request are
+// matched to entries of the base by path, so it doesn't matter how far apart they are in the
+// two nars. Identical files are copied by reference, changed files get a zstd delta against
+// the base file of the same path, and everything else (including files too big to hold in
+// memory) is sent literally.
+//
+// The delta is a header followed by a zstd-compressed stream of records, one per entry of the
+// request in nar order, ending with nardiffEnd. Expanding writes a new nar from the records,
+// which reproduces the request exactly since nars are canonical.
+
+type nardiffAlgo struct{ level int }
+
+const (
+	nardiffMagic = "NSNARDF1"
+
+	// record types
+	nardiffEnd     = 0
+	nardiffDir     = 1
+	nardiffSymlink = 2
+	nardiffNew     = 3 // contents follow
+	nardiffCopy    = 4 // same contents as base file
+	nardiffDelta   = 5 // zstd frame using base file as raw dictionary follows
+
+	nardiffExecutable = 1 // flag on file records
+
+	// files smaller than this are sent literally, it's not worth setting up an encoder
+	nardiffMinDelta = 512
+)
+
+// files bigger than this aren't read into memory to diff, they're sent literally straight
+// from the request
+var nardiffMaxFile int64 = 64 << 20
+
+var errBadNardiff = errors.New("bad nardiff data")
+
+type nardiffFile struct{ off, size int64 }
+
+func (a *nardiffAlgo) Name() string       { return nardiffName }
+func (a *nardiffAlgo) SetLevel(level int) { a.level = level }
+
+func (a *nardiffAlgo) Create(ctx context.Context, args CreateArgs) (*DiffStats, error) {
+	start := time.Now()
+
+	baseFile, err := os.Open(args.Base)
+	if err != nil {
+		return nil, err
+	}
+	defer baseFile.Close()
+	base, unmap, err := mapBase(baseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer unmap()
+	files, err := nardiffIndex(base)
+	if err != nil {
+		return nil, fmt.Errorf("base: %w", err)
+	}
+
+	req := args.RequestReader
+	if req == nil {
+		reqFile, err := os.Open(args.Request)
+		if err != nil {
+			return nil, err
+		}
+		defer reqFile.Close()
+		req = reqFile
+	}
+	cr := countReader{r: req}
+	nr, err := nar.NewReader(&ctxReader{ctx: ctx, r: &cr})
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	defer nr.Close()
+
+	cw := countWriter{w: args.Output}
+	if _, err = cw.Write([]byte(nardiffMagic)); err != nil {
+		return nil, err
+	}
+	zw, err := zstd.NewWriter(
+		&cw,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(a.level)),
+		zstd.WithEncoderConcurrency(1),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer zw.Close()
+
+	var rec []byte
+	for {
+		h, err := nr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("request: %w", err)
+		}
+
+		rec = rec[:0]
+		var data []byte
+		stream := false
+		switch h.Type {
+		case nar.TypeDirectory:
+			rec = nardiffAppendStr(append(rec, nardiffDir), h.Path)
+		case nar.TypeSymlink:
+			rec = nardiffAppendStr(append(rec, nardiffSymlink), h.Path)
+			rec = nardiffAppendStr(rec, h.LinkTarget)
+		case nar.TypeRegular:
+			op := byte(nardiffNew)
+			if h.Size > nardiffMaxFile {
+				stream = true
+			} else if data, err = readFullFromNar(nr, h); err != nil {
+				return nil, fmt.Errorf("request: %w", err)
+			} else if bf, ok := files[h.Path]; ok {
+				old := base[bf.off : bf.off+bf.size]
+				if bytes.Equal(old, data) {
+					op, data = nardiffCopy, nil
+				} else if len(data) >= nardiffMinDelta && len(old) >= nardiffMinDelta {
+					delta, err := nardiffEncode(old, data)
+					if err != nil {
+						return nil, err
+					} else if len(delta) < len(data) {
+						op, data = nardiffDelta, delta
+					}
+				}
+			}
+			var flags uint64
+			if h.Executable {
+				flags |= nardiffExecutable
+			}
+			rec = nardiffAppendStr(append(rec, op), h.Path)
+			rec = binary.AppendUvarint(rec, flags)
+			rec = binary.AppendUvarint(rec, uint64(h.Size))
+			if op == nardiffDelta {
+				rec = binary.AppendUvarint(rec, uint64(len(data)))
+			}
+		default:
+			return nil, fmt.Errorf("unknown nar entry type %v", h.Type)
+		}
+		if _, err = zw.Write(rec); err != nil {
+			return nil, err
+		} else if _, err = zw.Write(data); err != nil {
+			return nil, err
+		} else if stream {
+			if _, err = io.CopyN(zw, nr, h.Size); err != nil {
+				return nil, fmt.Errorf("request: %w", err)
+			}
+		}
+	}
+	if _, err = zw.Write([]byte{nardiffEnd}); err != nil {
+		return nil, err
+	} else if err = zw.Close(); err != nil {
+		return nil, err
+	}
+
+	stats := &DiffStats{
+		DiffSize:   cw.c,
+		NarSize:    cr.c,
+		Algo:       a.Name(),
+		Level:      a.level,
+		CmpTotalMs: time.Now().Sub(start).Milliseconds(),
+	}
+	return stats, nil
+}
+
+func (_ *nardiffAlgo) Expand(ctx context.Context, args ExpandArgs) (*DiffStats, error) {
+	start := time.Now()
+
+	base, unmap, err := args.memBase()
+	if err != nil {
+		return nil, err
+	}
+	defer unmap()
+	files, err := nardiffIndex(base)
+	if err != nil {
+		return nil, fmt.Errorf("base: %w", err)
+	}
+
+	magic := make([]byte, len(nardiffMagic))
+	if _, err := io.ReadFull(args.Delta, magic); err != nil {
+		return nil, err
+	} else if string(magic) != nardiffMagic {
+		return nil, fmt.Errorf("%w: bad magic", errBadNardiff)
+	}
+	zr, err := zstd.NewReader(&ctxReader{ctx: ctx, r: args.Delta}, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	br := &nardiffReader{r: zr}
+
+	nw, err := nar.NewWriter(args.Output)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := br.byte()
+		if op == nardiffEnd {
+			break
+		}
+		h := nar.Header{Path: br.str()}
+		var contents io.Reader
+		switch op {
+		case nardiffDir:
+			h.Type = nar.TypeDirectory
+		case nardiffSymlink:
+			h.Type = nar.TypeSymlink
+			h.LinkTarget = br.str()
+		case nardiffNew, nardiffCopy, nardiffDelta:
+			h.Type = nar.TypeRegular
+			h.Executable = br.uvarint()&nardiffExecutable != 0
+			h.Size = int64(br.uvarint())
+			if br.err != nil {
+				break
+			}
+			if op == nardiffNew {
+				contents = io.LimitReader(br.r, h.Size)
+				break
+			}
+			bf, ok := files[h.Path]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s missing from base", errBadNardiff, h.Path)
+			} else if op == nardiffCopy && bf.size != h.Size {
+				return nil, fmt.Errorf("%w: %s has wrong size in base", errBadNardiff, h.Path)
+			}
+			old := base[bf.off : bf.off+bf.size]
+			if op == nardiffCopy {
+				contents = bytes.NewReader(old)
+				break
+			}
+			deltaSize := br.uvarint()
+			if deltaSize > uint64(h.Size) {
+				return nil, fmt.Errorf("%w: %s delta too big", errBadNardiff, h.Path)
+			}
+			delta := make([]byte, deltaSize)
+			br.read(delta)
+			data, err := nardiffDecode(old, delta, h.Size)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", h.Path, err)
+			}
+			contents = bytes.NewReader(data)
+		default:
+			return nil, fmt.Errorf("%w: unknown record type %d", errBadNardiff, op)
+		}
+		if br.err != nil {
+			return nil, br.err
+		}
+		if err = nw.WriteHeader(&h); err != nil {
+			return nil, err
+		}
+		if contents != nil {
+			if err = ioCopy(nw, contents, nil, h.Size); err != nil {
+				return nil, fmt.Errorf("%s: %w", h.Path, err)
+			}
+		}
+	}
+	if br.err != nil {
+		return nil, br.err
+	} else if err = nw.Close(); err != nil {
+		return nil, err
+	}
+
+	stats := &DiffStats{
+		ExpTotalMs: time.Now().Sub(start).Milliseconds(),
+	}
+	return stats, nil
+}
+
+// nardiffIndex returns the location of each regular file's contents in a nar.
+func nardiffIndex(b []byte) (map[string]nardiffFile, error) {
+	// nar.Reader reads the header of an entry right up to the contents and no further, so
+	// the count is the offset of the contents when Next returns.
+	cr := &countReader{r: bytes.NewReader(b)}
+	nr, err := nar.NewReader(cr)
+	if err != nil {
+		return nil, err
+	}
+	defer nr.Close()
+	files := make(map[string]nardiffFile)
+	for {
+		h, err := nr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Type == nar.TypeRegular {
+			files[h.Path] = nardiffFile{off: int64(cr.c), size: h.Size}
+		}
+	}
+}
+
+func nardiffEncode(old, data []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(
+		nil,
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderDictRaw(0, old),
+		zstd.WithWindowSize(zstgoWindowSize(int64(len(old)), int64(len(data)))),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(data, nil), nil
+}
+
+func nardiffDecode(old, delta []byte, size int64) ([]byte, error) {
+	dec, err := zstd.NewReader(
+		nil,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderDictRaw(0, old),
+		zstd.WithDecoderMaxWindow(zstgoMaxWindow),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	data, err := dec.DecodeAll(delta, make([]byte, 0, size))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) != size {
+		return nil, fmt.Errorf("%w: wrong size %d != %d", errBadNardiff, len(data), size)
+	}
+	return data, nil
+}
+
+func nardiffAppendStr(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// nardiffReader reads record fields, remembering the first error.
+type nardiffReader struct {
+	r   io.Reader
+	err error
+	buf [1]byte
+}
+
+func (r *nardiffReader) read(p []byte) {
+	if r.err == nil {
+		if _, err := io.ReadFull(r.r, p); err != nil {
+			r.err = fmt.Errorf("%w: %v", errBadNardiff, err)
+		}
+	}
+}
+
+func (r *nardiffReader) ReadByte() (byte, error) {
+	r.read(r.buf[:])
+	return r.buf[0], r.err
+}
+
+func (r *nardiffReader) byte() byte {
+	if b, err := r.ReadByte(); err == nil {
+		return b
+	}
+	return nardiffEnd
+}
+
+func (r *nardiffReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(r)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("%w: %v", errBadNardiff, err)
+	}
+	return v
+}
+
+func (r *nardiffReader) str() string {
+	l := r.uvarint()
+	if l > 4096 {
+		r.err = fmt.Errorf("%w: string too long", errBadNardiff)
+	}
+	if r.err != nil {
+		return ""
+	}
+	b := make([]byte, l)
+	r.read(b)
+	return string(b)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+func dumpNar(t testing.TB, path string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := nar.DumpPath(&b, path); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestNardiff(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	rnd := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	lib := rnd(300000)
+	data := rnd(100000)
+	script := []byte("#!/bin/sh\nexec /nix/store/aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-foo/bin/foo \"$@\"\n")
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	os.MkdirAll(filepath.Join(base, "bin"), 0755)
+	os.MkdirAll(filepath.Join(base, "lib"), 0755)
+	os.MkdirAll(filepath.Join(base, "share"), 0755)
+	os.WriteFile(filepath.Join(base, "bin/foo"), script, 0755)
+	os.WriteFile(filepath.Join(base, "lib/libfoo.so"), lib, 0755)
+	os.WriteFile(filepath.Join(base, "share/data"), data, 0644)
+	os.WriteFile(filepath.Join(base, "share/gone"), rnd(1000), 0644)
+	os.Symlink("libfoo.so", filepath.Join(base, "lib/libfoo.so.1"))
+
+	req := filepath.Join(dir, "req")
+	os.MkdirAll(filepath.Join(req, "bin"), 0755)
+	os.MkdirAll(filepath.Join(req, "lib"), 0755)
+	os.MkdirAll(filepath.Join(req, "share/empty"), 0755)
+	os.WriteFile(filepath.Join(req, "bin/foo"), bytes.ReplaceAll(script, []byte("aaaa"), []byte("bbbb")), 0755)
+	// big insertion at the start of a file that's also grown a lot
+	grown := append(rnd(200000), lib...)
+	grown = append(grown, rnd(50000)...)
+	os.WriteFile(filepath.Join(req, "lib/libfoo.so"), grown, 0755)
+	os.WriteFile(filepath.Join(req, "share/data"), data, 0755) // now executable
+	os.WriteFile(filepath.Join(req, "share/new"), rnd(1000), 0644)
+	os.WriteFile(filepath.Join(req, "share/zero"), nil, 0644)
+	os.Symlink("libfoo.so", filepath.Join(req, "lib/libfoo.so.2"))
+
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, lib, 0644)
+
+	baseNar, reqNar := dumpNar(t, base), dumpNar(t, req)
+	algo := getAlgo(nardiffName)
+	size := algoRoundTrip(t, algo, baseNar, reqNar)
+	// should be about the new random data, not the whole request
+	if size > 260000 {
+		t.Errorf("delta too big: %d", size)
+	}
+	t.Logf("%d -> %d", len(reqNar), size)
+
+	for _, pair := range []struct{ old, new []byte }{
+		{baseNar, baseNar},
+		{reqNar, baseNar},
+		{dumpNar(t, file), reqNar},
+		{baseNar, dumpNar(t, file)},
+	} {
+		algoRoundTrip(t, algo, pair.old, pair.new)
+	}
+
+	// big files are sent as they are instead of being read to diff
+	defer func(m int64) { nardiffMaxFile = m }(nardiffMaxFile)
+	nardiffMaxFile = 200000
+	if size := algoRoundTrip(t, algo, baseNar, reqNar); size < len(grown) {
+		t.Errorf("big file diffed: %d", size)
+	}
+}
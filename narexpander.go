@@ -1,7 +1,11 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
 	"context"
 	"encoding/binary"
 	"encoding/json"
@@ -10,24 +14,48 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/acomagu/bufpipe"
+	"github.com/klauspost/compress/zstd"
 	"github.com/nix-community/go-nix/pkg/nar"
+	"github.com/ulikunitz/xz"
 	"golang.org/x/sync/semaphore"
 )
 
 type (
 	narExpanderOptions struct {
 		BufferEntries int
-		BufferBytes   int64
+		// Memory for buffered entries. Entries bigger than this are spilled to temp files.
+		BufferBytes int64
+		// Version of the expansion format: 2 for xz and gz only, 3 also expands zst and
+		// bz2, 4 also expands deflated members of zip files, 5 detects compressed files by
+		// content instead of name and verifies that everything it expands can be
+		// reproduced, 6 handles xz files with multiple blocks or streams, 7 splits
+		// compressed tarballs into their members. Zero means the latest. Both sides of a
+		// diff must use the same version.
+		Version int
+		// Expand everything that decodes, without checking that recompressing reproduces
+		// it. The output can't be collapsed, but doesn't depend on the local compressors.
+		Decode bool
+		// If not nil, counts what happened to compressed files, by "algo:outcome".
+		Stats map[string]int
+		// Use external binaries even where there's an in-process codec.
+		NoInternal bool
 	}
 
 	narExpander struct {
 		opts narExpanderOptions
 		ents chan *narEntry
 		sem  *semaphore.Weighted
+
+		lastZstLevel []string // try this first, files in one nar are usually compressed the same way
+		lastZipLevel int
 	}
 
 	narEntry struct {
@@ -37,10 +65,50 @@ type (
 		release func() error
 	}
 
+	// narBuf holds the contents of a file entry and the semaphore weight held for it.
+	narBuf struct {
+		b     []byte
+		sem   int64
+		unmap func() error // for entries spilled to disk
+	}
+
 	narExpanderMeta struct {
 		Algo           string   `json:"a"`
 		Options        []string `json:"o,omitempty"`
 		CompressedSize int64    `json:"c"`
+		// recompress in-process instead of with the external binary
+		Internal bool `json:"i,omitempty"`
+		// for zip: the members whose compressed data was replaced by uncompressed data
+		Zip []narExpZipMember `json:"z,omitempty"`
+		// for xz with more than one stream (or padding): each stream, in order
+		Xz []narExpXzStream `json:"x,omitempty"`
+		// for tarballs: members with contents, which are in a directory instead of the data
+		// entry, and whatever comes after the last one
+		Tar    []narExpTarMember `json:"t,omitempty"`
+		TarEnd []byte            `json:"te,omitempty"`
+	}
+
+	// narExpTryFunc returns meta (without CompressedSize) and data for an expanded file, or
+	// nil if it shouldn't be expanded, and the outcome either way. Data longer than limit is
+	// narExpTooBig: that's all the caller holds semaphore weight for.
+	narExpTryFunc func(buf []byte, limit int64) (*narExpanderMeta, []byte, string)
+
+	narExpZipMember struct {
+		Offset         int64 `json:"o"` // of compressed data in the original file
+		CompressedSize int64 `json:"c"`
+		Size           int64 `json:"s"`
+		Level          int   `json:"l"`
+	}
+
+	narExpZipData struct {
+		narExpZipMember
+		data []byte
+	}
+
+	narExpXzStream struct {
+		Size    int64    `json:"s"` // uncompressed
+		Options []string `json:"o"`
+		Padding int64    `json:"p,omitempty"`
 	}
 
 	xzInfo struct {
@@ -53,11 +121,26 @@ const (
 	// needs to be lexicographically ordered so use minimal suffix
 	narExpMetaSuffix = "\x01_exp1meta_"
 	narExpDataSuffix = "\x01_exp2data_"
+
+	narExpLatestVersion = 7
+
+	// outcomes for narExpanderOptions.Stats
+	narExpExpanded = "expanded"
+	narExpMismatch = "mismatch" // recompressing didn't reproduce the original
+	narExpInvalid  = "invalid"  // couldn't parse or decompress
+	narExpTooBig   = "toobig"
+	narExpStored   = "stored" // zip without compressed members
 )
 
 var (
 	errBadXzData = errors.New("bad xz data")
 	errBadGzData = errors.New("bad gz data")
+
+	// zstd levels to try when looking for the parameters a file was compressed with, most
+	// likely first
+	zstTryLevels = []int{19, 3, 9, 22, 12, 15, 6, 1}
+	// zlib levels to try for zip members, most likely first
+	zipTryLevels = []int{6, 9, 1, 5, 8, 2, 3, 4, 7}
 )
 
 func ExpandNar(r io.Reader, opts narExpanderOptions) io.Reader {
@@ -93,6 +176,9 @@ func (o *narExpanderOptions) defaults() {
 	if o.BufferBytes == 0 {
 		o.BufferBytes = 128 * 1024 * 1024
 	}
+	if o.Version == 0 {
+		o.Version = narExpLatestVersion
+	}
 }
 
 func (n *narExpander) readAndExpand(r io.Reader) (retErr error) {
@@ -119,6 +205,10 @@ func (n *narExpander) readAndExpand(r io.Reader) (retErr error) {
 		switch {
 		case h.Type == nar.TypeDirectory || h.Type == nar.TypeSymlink:
 			n.ents <- &narEntry{nil, *h, nil, nil}
+		case n.opts.Version >= 5:
+			if err := n.expandDetected(nr, h); err != nil {
+				return err
+			}
 		case strings.HasSuffix(h.Path, ".xz"):
 			if err := n.expandXz(nr, h); err != nil {
 				return err
@@ -127,6 +217,21 @@ func (n *narExpander) readAndExpand(r io.Reader) (retErr error) {
 			if err := n.expandGz(nr, h); err != nil {
 				return err
 			}
+		case strings.HasSuffix(h.Path, ".zst") && n.opts.Version >= 3:
+			if err := n.expandWith(nr, h, "zst", n.tryZst); err != nil {
+				return err
+			}
+		case strings.HasSuffix(h.Path, ".bz2") && n.opts.Version >= 3:
+			if err := n.expandWith(nr, h, "bz2", n.tryBz2); err != nil {
+				return err
+			}
+		case isZipName(h.Path) && n.opts.Version >= 4:
+			nb, err := n.readBuf(nr, h, 0)
+			if err != nil {
+				return err
+			} else if err := n.expandZip(h, nb); err != nil {
+				return err
+			}
 		default:
 			if err := n.passThrough(nr, h); err != nil {
 				return err
@@ -136,27 +241,34 @@ func (n *narExpander) readAndExpand(r io.Reader) (retErr error) {
 }
 
 func (n *narExpander) expandXz(nr *nar.Reader, h *nar.Header) error {
-	semSize := min(n.opts.BufferBytes, h.Size)
-	n.sem.Acquire(context.Background(), semSize)
-
-	buf, err := readFullFromNar(nr, h)
+	nb, err := n.readBuf(nr, h, 0)
 	if err != nil {
 		return err
 	}
+	buf := nb.b
 
 	xzInfo, err := parseXz(buf)
 	if err != nil {
+		n.count("xz", narExpInvalid)
 		// pass through instead
-		release := func() error { n.sem.Release(semSize); return nil }
+		release := func() error { return n.free(nb) }
 		n.ents <- &narEntry{nil, *h, bytes.NewReader(buf), release}
 		return nil
 	}
 
+	n.count("xz", narExpExpanded)
 	meta := narExpanderMeta{
 		Algo:           "xz",
 		Options:        xzInfo.options,
 		CompressedSize: h.Size,
 	}
+	if size := xzInfo.uncompressedSize; size <= n.opts.BufferBytes-nb.sem {
+		n.sem.Acquire(context.Background(), size)
+		if data, err := n.xzDecodeAll(buf, size); err == nil {
+			return n.sendExpanded(h, &meta, data, nb, size)
+		}
+		n.sem.Release(size)
+	}
 	metaData, err := json.Marshal(meta)
 	if err != nil {
 		return err
@@ -182,7 +294,7 @@ func (n *narExpander) expandXz(nr *nar.Reader, h *nar.Header) error {
 		return err
 	}
 	release := func() error {
-		defer n.sem.Release(semSize)
+		defer n.free(nb)
 		return xz.Wait()
 	}
 	n.ents <- &narEntry{nil, dataHeader, uncompressedReader, release}
@@ -192,18 +304,17 @@ func (n *narExpander) expandXz(nr *nar.Reader, h *nar.Header) error {
 
 func (n *narExpander) expandGz(nr *nar.Reader, h *nar.Header) error {
 	// TODO: factor out common parts between this and expandXz
-	semSize := min(n.opts.BufferBytes, h.Size)
-	n.sem.Acquire(context.Background(), semSize)
-
-	buf, err := readFullFromNar(nr, h)
+	nb, err := n.readBuf(nr, h, 0)
 	if err != nil {
 		return err
 	}
+	buf := nb.b
 
 	// gzip, deflate, no flags, 0 mtime, unix
 	if len(buf) < 18 || !bytes.Equal(buf[:10], []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 3}) {
+		n.count("gz", narExpInvalid)
 		// pass through instead
-		release := func() error { n.sem.Release(semSize); return nil }
+		release := func() error { return n.free(nb) }
 		n.ents <- &narEntry{nil, *h, bytes.NewReader(buf), release}
 		return nil
 	}
@@ -211,10 +322,20 @@ func (n *narExpander) expandGz(nr *nar.Reader, h *nar.Header) error {
 	end := len(buf)
 	uncmpSize := binary.LittleEndian.Uint32(buf[end-4:])
 
+	n.count("gz", narExpExpanded)
 	meta := narExpanderMeta{
 		Algo:           "gz",
 		CompressedSize: h.Size,
 	}
+	if size := int64(uncmpSize); !n.opts.NoInternal && size <= n.opts.BufferBytes-nb.sem {
+		n.sem.Acquire(context.Background(), size)
+		if gr, err := gzip.NewReader(bytes.NewReader(buf)); err == nil {
+			if data, err := io.ReadAll(io.LimitReader(gr, size+1)); err == nil && int64(len(data)) == size {
+				return n.sendExpanded(h, &meta, data, nb, size)
+			}
+		}
+		n.sem.Release(size)
+	}
 	metaData, err := json.Marshal(meta)
 	if err != nil {
 		return err
@@ -240,7 +361,7 @@ func (n *narExpander) expandGz(nr *nar.Reader, h *nar.Header) error {
 		return err
 	}
 	release := func() error {
-		defer n.sem.Release(semSize)
+		defer n.free(nb)
 		return gz.Wait()
 	}
 	n.ents <- &narEntry{nil, dataHeader, uncompressedReader, release}
@@ -278,6 +399,11 @@ func (n *narExpander) readAndCollapse(r io.Reader) (retErr error) {
 			if err != nil {
 				return err
 			}
+			// the original file has the same header as the meta entry except for the size
+			newH := *h
+			newH.Path = strings.TrimSuffix(h.Path, narExpMetaSuffix)
+			newH.Size = meta.CompressedSize
+
 			h, err = nr.Next()
 			if err == io.EOF {
 				return io.ErrUnexpectedEOF
@@ -286,20 +412,36 @@ func (n *narExpander) readAndCollapse(r io.Reader) (retErr error) {
 			} else if !strings.HasSuffix(h.Path, narExpDataSuffix) {
 				return errors.New("bad expanded nar")
 			}
+			var nb *narBuf
+			if h.Type == nar.TypeDirectory {
+				nb, err = n.readTar(nr, h, meta)
+			} else {
+				nb, err = n.readBuf(nr, h, meta.CompressedSize)
+			}
+			if err != nil {
+				return err
+			}
 			switch meta.Algo {
 			case "xz":
-				err = n.recompressXz(nr, h, meta)
-				if err != nil {
-					return err
+				if len(meta.Xz) > 0 {
+					err = n.recompressXzStreams(newH, meta, nb)
+				} else {
+					err = n.recompress(newH, meta, nb, xzBin, "-c")
 				}
 			case "gz":
-				err = n.recompressGz(nr, h, meta)
-				if err != nil {
-					return err
-				}
+				err = n.recompressGz(newH, meta, nb)
+			case "zst":
+				err = n.recompress(newH, meta, nb, zstdBin, "-qc")
+			case "bz2":
+				err = n.recompress(newH, meta, nb, bzip2Bin, "-c")
+			case "zip":
+				err = n.recompressZip(newH, meta, nb)
 			default:
 				return fmt.Errorf("unexpected algo %q", meta.Algo)
 			}
+			if err != nil {
+				return err
+			}
 
 		default:
 			if err := n.passThrough(nr, h); err != nil {
@@ -315,77 +457,578 @@ func (n *narExpander) readMeta(nr *nar.Reader, h *nar.Header) (*narExpanderMeta,
 	return &meta, err
 }
 
-func (n *narExpander) recompressXz(nr *nar.Reader, h *nar.Header, meta *narExpanderMeta) error {
-	semSize := min(n.opts.BufferBytes, h.Size+meta.CompressedSize)
-	n.sem.Acquire(context.Background(), semSize)
+func (n *narExpander) recompressXzStreams(h nar.Header, meta *narExpanderMeta, nb *narBuf) error {
+	buf := nb.b
+	var pos int64
+	for _, st := range meta.Xz {
+		if st.Size < 0 || st.Padding < 0 || pos+st.Size > int64(len(buf)) {
+			return errors.New("bad xz meta")
+		}
+		pos += st.Size
+	}
+	if pos != int64(len(buf)) {
+		return errors.New("bad xz meta")
+	}
+	n.sendWriter(h, nb, "xz", func(w io.Writer) error {
+		var pos int64
+		for _, st := range meta.Xz {
+			cmd := exec.Command(xzBin, append([]string{"-c"}, st.Options...)...)
+			cmd.Stdin = bytes.NewReader(buf[pos : pos+st.Size])
+			cmd.Stdout = w
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return err
+			} else if _, err := w.Write(make([]byte, st.Padding)); err != nil {
+				return err
+			}
+			pos += st.Size
+		}
+		return nil
+	})
+	return nil
+}
+
+func (n *narExpander) recompressGz(h nar.Header, meta *narExpanderMeta, nb *narBuf) error {
+	if meta.Internal {
+		n.sendWriter(h, nb, "gz", func(w io.Writer) error { return gzipCompress(w, nb.b, 6) })
+		return nil
+	}
 
-	buf, err := readFullFromNar(nr, h)
+	return n.sendCommand(h, exec.Command(gzipBin, "-nc"), nb)
+}
+
+// expandWith reads a file and expands it with try, or passes it through if try doesn't
+// return anything.
+func (n *narExpander) expandWith(nr *nar.Reader, h *nar.Header, algo string, try narExpTryFunc) error {
+	nb, err := n.readBuf(nr, h, 0)
 	if err != nil {
 		return err
 	}
+	return n.expandBuf(h, nb, algo, try)
+}
 
-	newH := *h
-	newH.Path = strings.TrimSuffix(h.Path, narExpDataSuffix)
-	newH.Size = meta.CompressedSize
+func (n *narExpander) expandBuf(h *nar.Header, nb *narBuf, algo string, try narExpTryFunc) error {
+	// hold the rest of the buffer while decoding, so the decoded data is counted before it
+	// exists, then give back what it didn't use
+	limit := n.opts.BufferBytes - nb.sem
+	n.sem.Acquire(context.Background(), limit)
+	meta, data, outcome := try(nb.b, limit)
+	n.count(algo, outcome)
+	if meta == nil {
+		n.sem.Release(limit)
+		// pass through instead
+		release := func() error { return n.free(nb) }
+		n.ents <- &narEntry{nil, *h, bytes.NewReader(nb.b), release}
+		return nil
+	}
+	dataSem := int64(len(data))
+	n.sem.Release(limit - dataSem)
+	meta.CompressedSize = h.Size
+	if n.opts.Version >= 7 {
+		if meta.Tar, meta.TarEnd = tarMembers(data); meta.Tar != nil {
+			n.count("tar", narExpExpanded)
+			return n.sendExpandedTar(h, meta, data, nb, dataSem)
+		}
+	}
+	return n.sendExpanded(h, meta, data, nb, dataSem)
+}
 
-	xz := exec.Command(xzBin, append([]string{"-c"}, meta.Options...)...)
-	xz.Stderr = os.Stderr
-	xz.Stdin = bytes.NewReader(buf)
-	// note that the buffer in bufpipe will grow without bound, but we know it'll be smaller
-	// than buf so it's okay.
-	pr, pw := bufpipe.New(make([]byte, 0, 4096))
-	xz.Stdout = pw
-	if err := xz.Start(); err != nil {
+// expandDetected decides how to expand a file by looking at its contents instead of its
+// name, and only expands it if recompressing reproduces the original exactly.
+func (n *narExpander) expandDetected(nr *nar.Reader, h *nar.Header) error {
+	nb, err := n.readBuf(nr, h, 0)
+	if err != nil {
 		return err
 	}
-	go func() { pw.CloseWithError(xz.Wait()) }()
-	release := func() error { n.sem.Release(semSize); return nil }
-	n.ents <- &narEntry{nil, newH, pr, release}
 
+	algo := detectCompression(nb.b)
+	var try narExpTryFunc
+	switch algo {
+	case "xz":
+		try = n.tryXz
+	case "gz":
+		try = n.tryGz
+	case "zst":
+		try = n.tryZst
+	case "bz2":
+		try = n.tryBz2
+	case "zip":
+		return n.expandZip(h, nb)
+	default:
+		release := func() error { return n.free(nb) }
+		n.ents <- &narEntry{nil, *h, bytes.NewReader(nb.b), release}
+		return nil
+	}
+	return n.expandBuf(h, nb, algo, try)
+}
+
+func (n *narExpander) count(algo, outcome string) {
+	if n.opts.Stats != nil {
+		n.opts.Stats[algo+":"+outcome]++
+	}
+}
+
+// tryXz expands an xz file if recompressing it with the options from its headers reproduces
+// it exactly.
+func (n *narExpander) tryXz(buf []byte, limit int64) (*narExpanderMeta, []byte, string) {
+	if n.opts.Version >= 6 {
+		return n.tryXzStreams(buf, limit)
+	}
+	info, err := parseXz(buf)
+	if err != nil {
+		return nil, nil, narExpInvalid
+	} else if info.uncompressedSize > limit {
+		return nil, nil, narExpTooBig
+	}
+	data, err := n.xzDecodeAll(buf, info.uncompressedSize)
+	if err != nil {
+		return nil, nil, narExpInvalid
+	}
+	if !n.reproduces(xzBin, append([]string{"-c"}, info.options...), data, buf) {
+		return nil, nil, narExpMismatch
+	}
+	return &narExpanderMeta{Algo: "xz", Options: info.options}, data, narExpExpanded
+}
+
+// tryXzStreams is like tryXz but handles any number of streams and blocks, and checks each
+// stream separately.
+func (n *narExpander) tryXzStreams(buf []byte, limit int64) (*narExpanderMeta, []byte, string) {
+	streams, err := parseXzStreams(buf)
+	if err != nil {
+		return nil, nil, narExpInvalid
+	}
+	var size int64
+	for _, st := range streams {
+		size += st.size
+	}
+	if size > limit {
+		return nil, nil, narExpTooBig
+	}
+	data, err := n.xzDecodeAll(buf, size)
+	if err != nil {
+		return nil, nil, narExpInvalid
+	}
+	meta := &narExpanderMeta{Algo: "xz"}
+	var pos int64
+	for _, st := range streams {
+		want := buf[st.offset : st.offset+st.compressedSize]
+		if !n.reproduces(xzBin, append([]string{"-c"}, st.options...), data[pos:pos+st.size], want) {
+			return nil, nil, narExpMismatch
+		}
+		pos += st.size
+		meta.Xz = append(meta.Xz, narExpXzStream{Size: st.size, Options: st.options, Padding: st.padding})
+	}
+	if len(streams) == 1 && streams[0].padding == 0 {
+		meta.Options, meta.Xz = streams[0].options, nil
+	}
+	return meta, data, narExpExpanded
+}
+
+// tryGz expands a gzip file if gzip -n reproduces it exactly.
+func (n *narExpander) tryGz(buf []byte, limit int64) (*narExpanderMeta, []byte, string) {
+	// gzip, deflate, no flags, 0 mtime, unix: anything else can't come from gzip -n
+	if len(buf) < 18 || !bytes.Equal(buf[:10], []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 3}) {
+		return nil, nil, narExpInvalid
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, nil, narExpInvalid
+	}
+	data, err := io.ReadAll(io.LimitReader(gr, limit+1))
+	if err != nil {
+		return nil, nil, narExpInvalid
+	} else if int64(len(data)) > limit {
+		return nil, nil, narExpTooBig
+	}
+	if !n.opts.NoInternal && !n.opts.Decode {
+		if cw := (&cmpWriter{want: buf}); gzipCompress(cw, data, 6) == nil && cw.off == len(buf) {
+			return &narExpanderMeta{Algo: "gz", Internal: true}, data, narExpExpanded
+		}
+	}
+	if !n.reproduces(gzipBin, []string{"-nc"}, data, buf) {
+		return nil, nil, narExpMismatch
+	}
+	return &narExpanderMeta{Algo: "gz"}, data, narExpExpanded
+}
+
+// xzDecodeAll decompresses an xz file that should decompress to size bytes. It decodes
+// in-process when it can and uses xz for anything else (e.g. BCJ filters). There's no
+// in-process path for compressing: that would have to match liblzma exactly.
+// The output is never bigger than size, since that's what callers hold weight for.
+func (n *narExpander) xzDecodeAll(buf []byte, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	if !n.opts.NoInternal {
+		if xr, err := xz.NewReader(bytes.NewReader(buf)); err == nil && readExactly(xr, data) == nil {
+			return data, nil
+		}
+	}
+	xz := exec.Command(xzBin, "-dc")
+	xz.Stdin = bytes.NewReader(buf)
+	out, err := xz.StdoutPipe()
+	if err != nil {
+		return nil, err
+	} else if err := xz.Start(); err != nil {
+		return nil, err
+	}
+	err = readExactly(out, data)
+	if err != nil {
+		xz.Process.Kill()
+	}
+	if werr := xz.Wait(); err == nil {
+		err = werr
+	}
+	return data, err
+}
+
+// readExactly fills data from r and fails if r has more or less than that.
+func readExactly(r io.Reader, data []byte) error {
+	if _, err := io.ReadFull(r, data); err != nil {
+		return errBadXzData
+	} else if _, err := io.ReadFull(r, make([]byte, 1)); err != io.EOF {
+		return errBadXzData
+	}
 	return nil
 }
 
-func (n *narExpander) recompressGz(nr *nar.Reader, h *nar.Header, meta *narExpanderMeta) error {
-	// TODO: factor out common parts between this and expandXz
-	semSize := min(n.opts.BufferBytes, h.Size+meta.CompressedSize)
-	n.sem.Acquire(context.Background(), semSize)
+// tryZst expands a zstd file if we can find options that reproduce it exactly.
+func (n *narExpander) tryZst(buf []byte, limit int64) (*narExpanderMeta, []byte, string) {
+	base, err := zstOptions(buf)
+	if err != nil {
+		return nil, nil, narExpInvalid
+	}
+	data, err := zstDecodeAll(buf, limit)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return nil, nil, narExpTooBig
+	} else if err != nil {
+		return nil, nil, narExpInvalid
+	}
+	base = append(base, fmt.Sprintf("--stream-size=%d", len(data)))
+	if n.opts.Decode {
+		return &narExpanderMeta{Algo: "zst", Options: base}, data, narExpExpanded
+	}
+	levels := [][]string{n.lastZstLevel}
+	for _, l := range zstTryLevels {
+		if l > 19 {
+			levels = append(levels, []string{fmt.Sprintf("-%d", l), "--ultra"})
+		} else {
+			levels = append(levels, []string{fmt.Sprintf("-%d", l)})
+		}
+	}
+	for _, level := range levels {
+		t := append(append([]string{}, level...), base...)
+		if level != nil && recompressMatches(zstdBin, append([]string{"-qc"}, t...), data, buf) {
+			n.lastZstLevel = level
+			return &narExpanderMeta{Algo: "zst", Options: t}, data, narExpExpanded
+		}
+	}
+	return nil, nil, narExpMismatch
+}
+
+// tryBz2 expands a bzip2 file if recompressing it with the same block size reproduces it
+// exactly.
+func (n *narExpander) tryBz2(buf []byte, limit int64) (*narExpanderMeta, []byte, string) {
+	if len(buf) < 4 || !bytes.Equal(buf[:3], []byte("BZh")) || buf[3] < '1' || buf[3] > '9' {
+		return nil, nil, narExpInvalid
+	}
+	data, err := io.ReadAll(io.LimitReader(bzip2.NewReader(bytes.NewReader(buf)), limit+1))
+	if err != nil {
+		return nil, nil, narExpInvalid
+	} else if int64(len(data)) > limit {
+		return nil, nil, narExpTooBig
+	}
+	t := []string{"-" + string(buf[3])}
+	if !n.reproduces(bzip2Bin, append([]string{"-c"}, t...), data, buf) {
+		return nil, nil, narExpMismatch
+	}
+	return &narExpanderMeta{Algo: "bz2", Options: t}, data, narExpExpanded
+}
+
+// expandZip replaces the compressed data of deflated zip members with uncompressed data, for
+// the members that zlibDeflate can reproduce exactly. Everything else in the file (headers,
+// stored members, members compressed some other way) is left as is. Only the uncompressed
+// members are held in memory, up to what's left of BufferBytes after nb, the rest is written
+// from nb.
+func (n *narExpander) expandZip(h *nar.Header, nb *narBuf) error {
+	limit := n.opts.BufferBytes - nb.sem
+	n.sem.Acquire(context.Background(), limit)
+	members, outcome := n.zipExpandMembers(nb.b, limit)
+	n.count("zip", outcome)
+	if members == nil {
+		n.sem.Release(limit)
+		// pass through instead
+		release := func() error { return n.free(nb) }
+		n.ents <- &narEntry{nil, *h, bytes.NewReader(nb.b), release}
+		return nil
+	}
+
+	meta := &narExpanderMeta{Algo: "zip", CompressedSize: h.Size}
+	var parts []io.Reader
+	var held int64
+	pos, size := int64(0), h.Size
+	for _, m := range members {
+		parts = append(parts, bytes.NewReader(nb.b[pos:m.Offset]), bytes.NewReader(m.data))
+		held += m.Size
+		size += m.Size - m.CompressedSize
+		pos = m.Offset + m.CompressedSize
+		meta.Zip = append(meta.Zip, m.narExpZipMember)
+	}
+	parts = append(parts, bytes.NewReader(nb.b[pos:]))
+
+	dataSem := held
+	n.sem.Release(limit - dataSem)
+	if err := n.sendMeta(h, meta); err != nil {
+		return err
+	}
+	dataHeader := *h
+	dataHeader.Path += narExpDataSuffix
+	dataHeader.Size = size
+	release := func() error {
+		n.sem.Release(dataSem)
+		return n.free(nb)
+	}
+	n.ents <- &narEntry{nil, dataHeader, io.MultiReader(parts...), release}
+	return nil
+}
 
-	buf, err := readFullFromNar(nr, h)
+// zipExpandMembers returns the members of a zip file that can be expanded, with their
+// uncompressed data, in order and not overlapping, with at most limit bytes of uncompressed
+// data in total.
+func (n *narExpander) zipExpandMembers(buf []byte, limit int64) ([]narExpZipData, string) {
+	zr, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
 	if err != nil {
+		return nil, narExpInvalid
+	}
+	outcome := narExpStored
+	var members []narExpZipData
+	var held uint64
+	for _, f := range zr.File {
+		if f.Method != zip.Deflate {
+			continue
+		} else if held+f.UncompressedSize64 > uint64(limit) {
+			outcome = narExpTooBig
+			continue
+		}
+		off, err := f.DataOffset()
+		if err != nil || f.CompressedSize64 > uint64(len(buf)) || off+int64(f.CompressedSize64) > int64(len(buf)) {
+			continue
+		}
+		comp := buf[off : off+int64(f.CompressedSize64)]
+		data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(comp)), int64(f.UncompressedSize64)+1))
+		if err != nil || uint64(len(data)) != f.UncompressedSize64 {
+			outcome = narExpInvalid
+			continue
+		}
+		if level := n.zipLevel(data, comp); level != 0 {
+			members = append(members, narExpZipData{narExpZipMember{off, int64(len(comp)), int64(len(data)), level}, data})
+			held += f.UncompressedSize64
+		} else {
+			outcome = narExpMismatch
+		}
+	}
+	if len(members) == 0 {
+		return nil, outcome
+	}
+
+	// the central directory could list members in any order, or even overlapping
+	sort.Slice(members, func(i, j int) bool { return members[i].Offset < members[j].Offset })
+	out := members[:0]
+	pos := int64(0)
+	for _, m := range members {
+		if m.Offset < pos {
+			continue
+		}
+		out = append(out, m)
+		pos = m.Offset + m.CompressedSize
+	}
+	return out, narExpExpanded
+}
+
+// zipLevel returns the zlib level that reproduces comp from data, or 0.
+func (n *narExpander) zipLevel(data, comp []byte) int {
+	if n.opts.Decode {
+		return zipTryLevels[0]
+	}
+	for _, level := range append([]int{n.lastZipLevel}, zipTryLevels...) {
+		if level == 0 {
+			continue
+		}
+		cw := &cmpWriter{want: comp}
+		if zlibDeflate(cw, data, level) == nil && cw.off == len(comp) {
+			n.lastZipLevel = level
+			return level
+		}
+	}
+	return 0
+}
+
+// sendExpanded sends meta and data entries for an expanded file. nb holds the compressed
+// data, dataSem is the weight already held for the uncompressed data.
+func (n *narExpander) sendExpanded(h *nar.Header, meta *narExpanderMeta, data []byte, nb *narBuf, dataSem int64) error {
+	// we don't need the compressed data anymore
+	if err := n.free(nb); err != nil {
 		return err
 	}
 
-	newH := *h
-	newH.Path = strings.TrimSuffix(h.Path, narExpDataSuffix)
-	newH.Size = meta.CompressedSize
+	if err := n.sendMeta(h, meta); err != nil {
+		return err
+	}
 
-	gz := exec.Command(gzipBin, "-nc")
-	gz.Stderr = os.Stderr
-	gz.Stdin = bytes.NewReader(buf)
+	dataHeader := *h
+	dataHeader.Path += narExpDataSuffix
+	dataHeader.Size = int64(len(data))
+	release := func() error { n.sem.Release(dataSem); return nil }
+	n.ents <- &narEntry{nil, dataHeader, bytes.NewReader(data), release}
+	return nil
+}
+
+func (n *narExpander) sendMeta(h *nar.Header, meta *narExpanderMeta) error {
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	metaHeader := *h
+	metaHeader.Path += narExpMetaSuffix
+	metaHeader.Size = int64(len(metaData))
+	n.ents <- &narEntry{nil, metaHeader, bytes.NewReader(metaData), nil}
+	return nil
+}
+
+// recompress compresses an expanded entry with bin, passing args and then meta.Options.
+func (n *narExpander) recompress(h nar.Header, meta *narExpanderMeta, nb *narBuf, bin string, args ...string) error {
+	return n.sendCommand(h, exec.Command(bin, append(args, meta.Options...)...), nb)
+}
+
+// sendCommand sends an entry with the output of running cmd on nb.
+func (n *narExpander) sendCommand(h nar.Header, cmd *exec.Cmd, nb *narBuf) error {
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = bytes.NewReader(nb.b)
+	if nb.unmap != nil {
+		// too big to buffer the output, so cmd has to wait for the writer
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		} else if err := cmd.Start(); err != nil {
+			return err
+		}
+		release := func() error {
+			defer n.free(nb)
+			return cmd.Wait()
+		}
+		n.ents <- &narEntry{nil, h, out, release}
+		return nil
+	}
 	// note that the buffer in bufpipe will grow without bound, but we know it'll be smaller
 	// than buf so it's okay.
 	pr, pw := bufpipe.New(make([]byte, 0, 4096))
-	gz.Stdout = pw
-	if err := gz.Start(); err != nil {
+	cmd.Stdout = pw
+	if err := cmd.Start(); err != nil {
 		return err
 	}
-	go func() { pw.CloseWithError(gz.Wait()) }()
-	release := func() error { n.sem.Release(semSize); return nil }
-	n.ents <- &narEntry{nil, newH, pr, release}
+	go func() { pw.CloseWithError(cmd.Wait()) }()
+	release := func() error { return n.free(nb) }
+	n.ents <- &narEntry{nil, h, pr, release}
+	return nil
+}
+
+func (n *narExpander) recompressZip(h nar.Header, meta *narExpanderMeta, nb *narBuf) error {
+	buf := nb.b
+	pos, origPos := int64(0), int64(0)
+	for _, m := range meta.Zip {
+		gap := m.Offset - origPos
+		if gap < 0 || m.Size < 0 || pos+gap+m.Size > int64(len(buf)) || m.Level < 1 || m.Level > 9 {
+			return errors.New("bad zip meta")
+		}
+		pos += gap + m.Size
+		origPos = m.Offset + m.CompressedSize
+	}
 
+	n.sendWriter(h, nb, "zip", func(w io.Writer) error {
+		pos, origPos := int64(0), int64(0)
+		for _, m := range meta.Zip {
+			gap := m.Offset - origPos
+			if _, err := w.Write(buf[pos : pos+gap]); err != nil {
+				return err
+			}
+			pos += gap
+			cw := &sizeWriter{w: w, size: m.CompressedSize}
+			if err := zlibDeflate(cw, buf[pos:pos+m.Size], m.Level); err != nil {
+				return err
+			} else if cw.n != m.CompressedSize {
+				return errors.New("zip member recompressed to wrong size")
+			}
+			pos += m.Size
+			origPos = m.Offset + m.CompressedSize
+		}
+		_, err := w.Write(buf[pos:])
+		return err
+	})
 	return nil
 }
 
-func (n *narExpander) passThrough(nr *nar.Reader, h *nar.Header) error {
-	semSize := min(n.opts.BufferBytes, h.Size)
-	n.sem.Acquire(context.Background(), semSize)
-	release := func() error { n.sem.Release(semSize); return nil }
+// sendWriter sends an entry with what write writes, as it's read, so the output doesn't
+// have to fit in memory. It's an error if write doesn't write exactly h.Size bytes.
+func (n *narExpander) sendWriter(h nar.Header, nb *narBuf, algo string, write func(io.Writer) error) {
+	pr, pw := io.Pipe()
+	go func() {
+		sw := &sizeWriter{w: pw, size: h.Size}
+		err := write(sw)
+		if err == nil && sw.n != h.Size {
+			err = fmt.Errorf("%s recompressed to wrong size", algo)
+		}
+		pw.CloseWithError(err)
+	}()
+	release := func() error { return n.free(nb) }
+	n.ents <- &narEntry{nil, h, pr, release}
+}
 
-	buf, err := readFullFromNar(nr, h)
+func (n *narExpander) passThrough(nr *nar.Reader, h *nar.Header) error {
+	nb, err := n.readBuf(nr, h, 0)
 	if err != nil {
 		return err
 	}
-	n.ents <- &narEntry{nil, *h, bytes.NewReader(buf), release}
+	release := func() error { return n.free(nb) }
+	n.ents <- &narEntry{nil, *h, bytes.NewReader(nb.b), release}
+	return nil
+}
+
+// readBuf reads the contents of a file entry, holding semaphore weight for it and for extra
+// bytes of output. Entries too big for BufferBytes are spilled to an unlinked temp file and
+// mapped instead, so only extra counts against the semaphore and the kernel can page them
+// out. Call free when done with the contents.
+func (n *narExpander) readBuf(nr *nar.Reader, h *nar.Header, extra int64) (*narBuf, error) {
+	if h.Size <= n.opts.BufferBytes {
+		nb := &narBuf{sem: min(n.opts.BufferBytes, h.Size+extra)}
+		n.sem.Acquire(context.Background(), nb.sem)
+		var err error
+		nb.b, err = readFullFromNar(nr, h)
+		return nb, err
+	}
+
+	nb := &narBuf{sem: min(n.opts.BufferBytes, extra)}
+	n.sem.Acquire(context.Background(), nb.sem)
+	f, err := os.CreateTemp("", "narexp")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.CopyN(f, nr, h.Size); err != nil {
+		return nil, err
+	}
+	nb.b, err = syscall.Mmap(int(f.Fd()), 0, int(h.Size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	nb.unmap = func() error { return syscall.Munmap(nb.b) }
+	return nb, nil
+}
+
+func (n *narExpander) free(nb *narBuf) error {
+	n.sem.Release(nb.sem)
+	if nb.unmap != nil {
+		return nb.unmap()
+	}
 	return nil
 }
 
@@ -468,7 +1111,9 @@ func parseXz(buf []byte) (xzInfo, error) {
 		i += l
 		propSize, l := readVarint(buf[i:])
 		i += l
-
+		if l == 0 || propSize > uint64(len(buf)-i) {
+			return xzInfo{}, fmt.Errorf("%w: bad filter flags", errBadXzData)
+		}
 		switch filterId {
 		case 0x21: // lzma2
 			if propSize != 1 {
@@ -483,13 +1128,14 @@ func parseXz(buf []byte) (xzInfo, error) {
 			}
 			opts = append(opts, fmt.Sprintf("--lzma2=dict=%d", dictSize))
 
-		case 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a: // bcj
-			// TODO: support start= option for bcj
-			tab := map[uint64]string{
-				0x04: "--x86", 0x05: "--powerpc", 0x06: "--ia64", 0x07: "--arm",
-				0x08: "--armthumb", 0x09: "--sparc", 0x0a: "--arm64",
+		case 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b: // bcj
+			if propSize == 4 && binary.LittleEndian.Uint32(buf[i:]) != 0 {
+				opts = append(opts, fmt.Sprintf("--%s=start=%d", xzBcjFilters[filterId], binary.LittleEndian.Uint32(buf[i:])))
+			} else if propSize == 0 || propSize == 4 {
+				opts = append(opts, "--"+xzBcjFilters[filterId])
+			} else {
+				return xzInfo{}, fmt.Errorf("%w: bcj filter has wrong propSize %v", errBadXzData, propSize)
 			}
-			opts = append(opts, tab[filterId])
 
 		case 0x03: // delta
 			if propSize != 1 {
@@ -511,8 +1157,8 @@ func parseXz(buf []byte) (xzInfo, error) {
 		!bytes.Equal(buf[end-4:end-2], buf[6:8]) {
 		return xzInfo{}, fmt.Errorf("%w: bad footer magic or mismatch stream flags", errBadXzData)
 	}
-	bwSize := int((binary.LittleEndian.Uint32(buf[end-8:end-4]) + 1) * 4)
-	if end-12-bwSize < 12 {
+	bwSize := (int(binary.LittleEndian.Uint32(buf[end-8:end-4])) + 1) * 4
+	if end-12-bwSize < 12 || bwSize < 8 {
 		return xzInfo{}, fmt.Errorf("%w: too big index size %v", errBadXzData, bwSize)
 	}
 	index := buf[end-12-bwSize : end-12]
@@ -528,6 +1174,9 @@ func parseXz(buf []byte) (xzInfo, error) {
 		i += l
 		uncompressedSize, l := readVarint(index[i:])
 		i += l
+		if l == 0 || uncompressedSize > 1<<62 {
+			return xzInfo{}, fmt.Errorf("%w: index corrupted", errBadXzData)
+		}
 		totalUncompressed += int64(uncompressedSize)
 	}
 
@@ -537,6 +1186,154 @@ func parseXz(buf []byte) (xzInfo, error) {
 	}, nil
 }
 
+// zstOptions returns zstd options implied by the frame header of a zstd file.
+func zstOptions(buf []byte) ([]string, error) {
+	// https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#frame_header
+	if len(buf) < 6 || !bytes.Equal(buf[:4], []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		return nil, errors.New("bad zstd magic")
+	}
+	fhd := buf[4]
+	if fhd&0x03 != 0 {
+		return nil, errors.New("zstd dictionary not supported")
+	}
+	var opts []string
+	if fhd&0x04 == 0 {
+		opts = append(opts, "--no-check")
+	}
+	if fhd&0xc0 == 0 && fhd&0x20 == 0 {
+		// no content size means it was streamed, which we don't try to reproduce
+		return nil, errors.New("zstd frame without content size")
+	}
+	return opts, nil
+}
+
+func zstDecodeAll(buf []byte, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		// WithDecoderMaxMemory doesn't take 0
+		return nil, zstd.ErrDecoderSizeExceeded
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return dec.DecodeAll(buf, nil)
+}
+
+// reproduces is recompressMatches, except that everything matches when only decoding.
+func (n *narExpander) reproduces(bin string, args []string, data, want []byte) bool {
+	return n.opts.Decode || recompressMatches(bin, args, data, want)
+}
+
+// recompressMatches returns true if running bin with args on data produces exactly want.
+func recompressMatches(bin string, args []string, data, want []byte) bool {
+	cmd := exec.Command(bin, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cw := &cmpWriter{want: want}
+	cmd.Stdout = cw
+	return cmd.Run() == nil && cw.off == len(want)
+}
+
+// sizeWriter fails writes past size bytes.
+type sizeWriter struct {
+	w       io.Writer
+	n, size int64
+}
+
+func (s *sizeWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > s.size-s.n {
+		return 0, errors.New("recompressed to wrong size")
+	}
+	n, err := s.w.Write(p)
+	s.n += int64(n)
+	return n, err
+}
+
+// cmpWriter fails as soon as what's written differs from want.
+type cmpWriter struct {
+	want []byte
+	off  int
+}
+
+var errCmpMismatch = errors.New("mismatch")
+
+func (c *cmpWriter) Write(p []byte) (int, error) {
+	if len(p) > len(c.want)-c.off || !bytes.Equal(p, c.want[c.off:c.off+len(p)]) {
+		return 0, errCmpMismatch
+	}
+	c.off += len(p)
+	return len(p), nil
+}
+
+var (
+	codecVersionsOnce sync.Once
+	codecVersionsMap  map[string]string
+)
+
+// codecVersions returns the version of each compressor that collapsing can run, by codec
+// name. Compressors that aren't installed are left out. Collapsing only reproduces the
+// original nar if these are the same as on the side that expanded it.
+func codecVersions() map[string]string {
+	codecVersionsOnce.Do(func() {
+		codecVersionsMap = readCodecVersions(map[string]string{
+			"xz": xzBin, "zstd": zstdBin, "bzip2": bzip2Bin, "gzip": gzipBin,
+		})
+	})
+	return codecVersionsMap
+}
+
+var reCodecVersion = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// readCodecVersions runs each binary with --version and returns its version number.
+func readCodecVersions(bins map[string]string) map[string]string {
+	out := make(map[string]string)
+	for codec, bin := range bins {
+		// bzip2 prints its version on stderr, and everything here puts it first
+		if res, err := exec.Command(bin, "--version").CombinedOutput(); err == nil {
+			line, _, _ := strings.Cut(string(res), "\n")
+			if v := reCodecVersion.FindString(line); v != "" {
+				out[codec] = v
+			} else {
+				out[codec] = strings.TrimSpace(line)
+			}
+		}
+	}
+	return out
+}
+
+// collapseCodecs returns the compressors that collapsing a nar expanded with the given
+// version can run.
+func collapseCodecs(version int) []string {
+	if version < 3 {
+		return []string{"xz", "gzip"}
+	}
+	return []string{"xz", "gzip", "zstd", "bzip2"}
+}
+
+// isZipName returns true for files that are usually zip archives. Electron's .asar files
+// aren't included: they're an uncompressed archive format so they diff fine as they are.
+func isZipName(p string) bool {
+	return strings.HasSuffix(p, ".zip") || strings.HasSuffix(p, ".jar") || strings.HasSuffix(p, ".whl")
+}
+
+// detectCompression returns the algo of a compressed file by its magic bytes, or "".
+func detectCompression(buf []byte) string {
+	switch {
+	case bytes.HasPrefix(buf, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return "xz"
+	case bytes.HasPrefix(buf, []byte{0x1f, 0x8b, 8}):
+		return "gz"
+	case bytes.HasPrefix(buf, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zst"
+	case len(buf) >= 10 && bytes.HasPrefix(buf, []byte("BZh")) && buf[3] >= '1' && buf[3] <= '9' &&
+		(bytes.Equal(buf[4:10], []byte("1AY&SY")) || bytes.Equal(buf[4:10], []byte("\x17rE8P\x90"))):
+		return "bz2"
+	case bytes.HasPrefix(buf, []byte("PK\x03\x04")):
+		return "zip"
+	}
+	return ""
+}
+
 func readFullFromNar(nr *nar.Reader, h *nar.Header) ([]byte, error) {
 	buf := make([]byte, h.Size)
 	num, err := io.ReadFull(nr, buf)
@@ -548,12 +1345,17 @@ func readFullFromNar(nr *nar.Reader, h *nar.Header) ([]byte, error) {
 	return buf, nil
 }
 
+// readVarint reads an xz multibyte integer, returning l == 0 if b doesn't start with one.
 func readVarint(b []byte) (n uint64, l int) {
-	for {
+	for l < len(b) && l < 9 {
 		n |= uint64(b[l]&0x7f) << (l * 7)
 		if b[l]&0x80 == 0 {
+			if l > 0 && b[l] == 0 {
+				return 0, 0 // not minimal
+			}
 			return n, l + 1
 		}
 		l++
 	}
+	return 0, 0
 }
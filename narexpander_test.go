@@ -0,0 +1,454 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nix-community/go-nix/pkg/nar"
+	"golang.org/x/sync/semaphore"
+)
+
+// expandedPaths returns the paths of expanded files in an expanded nar.
+func expandedPaths(t *testing.T, b []byte) (out []string) {
+	t.Helper()
+	nr, err := nar.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		h, err := nr.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(h.Path, narExpDataSuffix) {
+			out = append(out, strings.TrimSuffix(h.Path, narExpDataSuffix))
+		}
+	}
+}
+
+func TestExpandZstBz2(t *testing.T) {
+	for _, bin := range []string{zstdBin, bzip2Bin} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skip("no", bin)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	// compressible but not trivially
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = "abcdefgh"[r.Intn(8)]
+	}
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "plain"), data, 0644)
+	compress := func(name string, bin string, args ...string) {
+		cmd := exec.Command(bin, args...)
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		os.WriteFile(filepath.Join(root, name), out, 0644)
+	}
+	compress("a19.zst", zstdBin, "-19", "-c", "--stream-size=300000")
+	compress("b3.zst", zstdBin, "-3", "--no-check", "-c", "--stream-size=300000")
+	compress("c9.bz2", bzip2Bin, "-9", "-c")
+	compress("d1.bz2", bzip2Bin, "-1", "-c")
+	// no content size, can't reproduce
+	compress("e.zst", zstdBin, "-c")
+	// different encoder, can't reproduce
+	enc, _ := zstd.NewWriter(nil)
+	os.WriteFile(filepath.Join(root, "f.zst"), enc.EncodeAll(data, nil), 0644)
+	// not actually compressed
+	os.WriteFile(filepath.Join(root, "g.bz2"), data, 0644)
+
+	orig := dumpNar(t, root)
+
+	for _, c := range []struct {
+		version int
+		exp     []string
+	}{
+		{2, nil},
+		{3, []string{"/a19.zst", "/b3.zst", "/c9.bz2", "/d1.bz2"}},
+	} {
+		opts := narExpanderOptions{Version: c.version}
+		expanded, err := io.ReadAll(ExpandNar(bytes.NewReader(orig), opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expandedPaths(t, expanded); strings.Join(got, ",") != strings.Join(c.exp, ",") {
+			t.Errorf("v%d: expanded %v, expected %v", c.version, got, c.exp)
+		}
+		collapsed, err := io.ReadAll(CollapseNar(bytes.NewReader(expanded), opts))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(collapsed, orig) {
+			t.Errorf("v%d: round trip mismatch", c.version)
+		}
+	}
+}
+
+func TestExpandZip(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("no python3 to write zips with zlib")
+	}
+
+	r := rand.New(rand.NewSource(1))
+	text := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = "abcdefgh\n"[r.Intn(9)]
+		}
+		return b
+	}
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0755)
+	for i, name := range []string{"one", "two", "three"} {
+		os.WriteFile(filepath.Join(dir, name), text(50000*i+10), 0644)
+	}
+	pyZip := func(name, compression string, level int) {
+		py := fmt.Sprintf("import sys, zipfile\n"+
+			"with zipfile.ZipFile(sys.argv[1], 'w', zipfile.%s, compresslevel=%d) as z:\n"+
+			"  for f in sys.argv[2:]: z.write(f, f)\n"+
+			"  z.writestr('stored', b'stored' * 100, compress_type=zipfile.ZIP_STORED)\n", compression, level)
+		cmd := exec.Command("python3", "-c", py, filepath.Join(root, name), "one", "two", "three")
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(err, string(out))
+		}
+	}
+	pyZip("a6.jar", "ZIP_DEFLATED", 6)
+	pyZip("b9.whl", "ZIP_DEFLATED", 9)
+	pyZip("c1.zip", "ZIP_DEFLATED", 1)
+	// only stored members
+	pyZip("d.zip", "ZIP_STORED", 0)
+	// different deflate implementation, can't reproduce
+	var goZip bytes.Buffer
+	zw := zip.NewWriter(&goZip)
+	w, _ := zw.Create("one")
+	w.Write(text(100000))
+	zw.Close()
+	os.WriteFile(filepath.Join(root, "e.zip"), goZip.Bytes(), 0644)
+	// not actually a zip
+	os.WriteFile(filepath.Join(root, "f.jar"), text(1000), 0644)
+
+	orig := dumpNar(t, root)
+
+	for _, c := range []struct {
+		version     int
+		bufferBytes int64
+		exp         []string
+		tooBig      int
+	}{
+		{3, 0, nil, 0},
+		{4, 0, []string{"/a6.jar", "/b9.whl", "/c1.zip"}, 0},
+		// "three" doesn't fit with the others (that doesn't change the outcome since the
+		// others are expanded), e.zip's member doesn't fit at all, and the zips are spilled
+		{4, 60000, []string{"/a6.jar", "/b9.whl", "/c1.zip"}, 1},
+	} {
+		stats := make(map[string]int)
+		opts := narExpanderOptions{Version: c.version, BufferBytes: c.bufferBytes, Stats: stats}
+		expanded, err := io.ReadAll(ExpandNar(bytes.NewReader(orig), opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expandedPaths(t, expanded); strings.Join(got, ",") != strings.Join(c.exp, ",") {
+			t.Errorf("v%d: expanded %v, expected %v", c.version, got, c.exp)
+		} else if stats["zip:toobig"] != c.tooBig {
+			t.Errorf("v%d: stats %v", c.version, stats)
+		}
+		collapsed, err := io.ReadAll(CollapseNar(bytes.NewReader(expanded), opts))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(collapsed, orig) {
+			t.Errorf("v%d: round trip mismatch", c.version)
+		}
+	}
+}
+
+func TestExpandDetected(t *testing.T) {
+	for _, bin := range []string{xzBin, gzipBin} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skip("no", bin)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = "abcdefgh"[r.Intn(8)]
+	}
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0755)
+	compress := func(name string, bin string, args ...string) []byte {
+		cmd := exec.Command(bin, args...)
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		os.WriteFile(filepath.Join(root, name), out, 0644)
+		return out
+	}
+	// names don't matter
+	xzData := compress("module", xzBin, "-c", "--check=crc32")
+	compress("page.gz.bak", gzipBin, "-nc")
+	// extreme isn't recorded in the headers
+	compress("extreme", xzBin, "-c", "-6e")
+	os.WriteFile(filepath.Join(root, "truncated"), xzData[:100], 0644)
+	// not compressed
+	os.WriteFile(filepath.Join(root, "plain.xz"), data, 0644)
+
+	orig := dumpNar(t, root)
+
+	stats := make(map[string]int)
+	opts := narExpanderOptions{Version: 5, Stats: stats}
+	expanded, err := io.ReadAll(ExpandNar(bytes.NewReader(orig), opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := strings.Join(expandedPaths(t, expanded), ","), "/module,/page.gz.bak"; got != exp {
+		t.Errorf("expanded %v, expected %v", got, exp)
+	}
+	expStats := map[string]int{"xz:expanded": 1, "gz:expanded": 1, "xz:mismatch": 1, "xz:invalid": 1}
+	if !reflect.DeepEqual(stats, expStats) {
+		t.Errorf("stats %v, expected %v", stats, expStats)
+	}
+	collapsed, err := io.ReadAll(CollapseNar(bytes.NewReader(expanded), opts))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(collapsed, orig) {
+		t.Error("round trip mismatch")
+	}
+
+	// decoding alone doesn't care whether it can be reproduced
+	decoded, err := io.ReadAll(ExpandNar(bytes.NewReader(orig), narExpanderOptions{Version: 5, Decode: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := strings.Join(expandedPaths(t, decoded), ","), "/extreme,/module,/page.gz.bak"; got != exp {
+		t.Errorf("decoded %v, expected %v", got, exp)
+	}
+}
+
+func TestExpandLargeEntries(t *testing.T) {
+	if _, err := exec.LookPath(xzBin); err != nil {
+		t.Skip("no", xzBin)
+	}
+	r := rand.New(rand.NewSource(1))
+	big := make([]byte, 1<<20)
+	r.Read(big)
+
+	root := filepath.Join(t.TempDir(), "root")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "big"), big, 0644)
+	os.WriteFile(filepath.Join(root, "big.xz"), xzCompress(t, big), 0644)
+	os.WriteFile(filepath.Join(root, "small.xz"), xzCompress(t, xzTestData(20000)), 0644)
+	orig := dumpNar(t, root)
+
+	for _, tc := range []struct {
+		version  int
+		expanded string
+	}{
+		// v2 streams big.xz through xz -dc
+		{2, "/big.xz,/small.xz"},
+		{6, "/small.xz"},
+	} {
+		opts := narExpanderOptions{Version: tc.version, BufferBytes: 64 * 1024}
+		expanded, err := io.ReadAll(ExpandNar(bytes.NewReader(orig), opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(expandedPaths(t, expanded), ","); got != tc.expanded {
+			t.Errorf("v%d expanded %v, expected %v", tc.version, got, tc.expanded)
+		}
+		collapsed, err := io.ReadAll(CollapseNar(bytes.NewReader(expanded), opts))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(collapsed, orig) {
+			t.Errorf("v%d round trip mismatch", tc.version)
+		}
+	}
+
+	// big entries are mapped from disk and only hold what they asked for
+	n := &narExpander{opts: narExpanderOptions{BufferBytes: 64 * 1024}}
+	n.opts.defaults()
+	n.sem = semaphore.NewWeighted(n.opts.BufferBytes)
+	nr, err := nar.NewReader(bytes.NewReader(orig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		h, err := nr.Next()
+		if err != nil {
+			t.Fatal(err)
+		} else if h.Path != "/big" {
+			continue
+		}
+		nb, err := n.readBuf(nr, h, 1000)
+		if err != nil {
+			t.Fatal(err)
+		} else if nb.unmap == nil || nb.sem != 1000 || !bytes.Equal(nb.b, big) {
+			t.Errorf("big entry not spilled: sem %d", nb.sem)
+		} else if err := n.free(nb); err != nil {
+			t.Error(err)
+		}
+		break
+	}
+}
+
+func TestExpandHoldsDecodedData(t *testing.T) {
+	const bufferBytes = 32 << 20
+	root := filepath.Join(t.TempDir(), "root")
+	os.MkdirAll(root, 0755)
+	for i := 0; i < 4; i++ {
+		// like gzip -n: no mtime, unix
+		var b bytes.Buffer
+		gw := gzip.NewWriter(&b)
+		gw.Write(xzTestData(10 << 20))
+		gw.Close()
+		b.Bytes()[9] = 3
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("%d.gz", i)), b.Bytes(), 0644)
+	}
+	orig := dumpNar(t, root)
+
+	live := func() int64 {
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return int64(ms.HeapAlloc)
+	}
+	opts := narExpanderOptions{Version: 6, BufferBytes: bufferBytes, Decode: true}
+	opts.defaults()
+	n := &narExpander{
+		opts: opts,
+		ents: make(chan *narEntry, opts.BufferEntries),
+		sem:  semaphore.NewWeighted(opts.BufferBytes),
+	}
+	base := live()
+	go n.readAndExpand(bytes.NewReader(orig))
+
+	// hold on to everything until the expander stops, then nothing it decoded and didn't
+	// send yet should take it over BufferBytes
+	var held []*narEntry
+	for stalled := false; !stalled; {
+		select {
+		case e, ok := <-n.ents:
+			if !ok {
+				t.Fatal("expander didn't wait for entries to be released")
+			}
+			held = append(held, e)
+		case <-time.After(time.Second):
+			stalled = true
+		}
+	}
+	if used := live() - base; used > bufferBytes {
+		t.Errorf("%d bytes in use with %d buffer bytes", used, bufferBytes)
+	}
+
+	var expanded int
+	release := func(e *narEntry) {
+		if e.err != nil {
+			t.Fatal(e.err)
+		} else if strings.HasSuffix(e.h.Path, narExpDataSuffix) {
+			expanded++
+		}
+		if e.release != nil {
+			if err := e.release(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, e := range held {
+		release(e)
+	}
+	for e := range n.ents {
+		release(e)
+	}
+	if expanded != 4 {
+		t.Errorf("expanded %d files, expected 4", expanded)
+	}
+}
+
+// benchNar writes a nar that looks like a man page package or a kernel module tree: lots of
+// small compressed files.
+func benchNar(b *testing.B, bin string, args ...string) []byte {
+	if _, err := exec.LookPath(bin); err != nil {
+		b.Skip("no", bin)
+	}
+	r := rand.New(rand.NewSource(1))
+	words := []string{".TH ", ".SH NAME\n", ".B ", "option ", "file ", "the ", "to ", "\\fI", "\\fR"}
+	root := filepath.Join(b.TempDir(), "root")
+	os.MkdirAll(root, 0755)
+	for i := 0; i < 300; i++ {
+		var data []byte
+		for n := 2000 + r.Intn(20000); len(data) < n; {
+			data = append(data, words[r.Intn(len(words))]...)
+		}
+		cmd := exec.Command(bin, args...)
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.Output()
+		if err != nil {
+			b.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(root, fmt.Sprintf("f%d", i)), out, 0644)
+	}
+	return dumpNar(b, root)
+}
+
+func BenchmarkExpandNar(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		bin  string
+		args []string
+	}{
+		{"man", gzipBin, []string{"-nc"}},
+		{"kmod", xzBin, []string{"-c", "--check=crc32", "--lzma2=dict=1MiB"}},
+	} {
+		orig := benchNar(b, c.bin, c.args...)
+		for _, noInternal := range []bool{false, true} {
+			name := c.name + "/internal"
+			if noInternal {
+				name = c.name + "/exec"
+			}
+			b.Run(name, func(b *testing.B) {
+				opts := narExpanderOptions{NoInternal: noInternal}
+				b.SetBytes(int64(len(orig)))
+				for i := 0; i < b.N; i++ {
+					expanded, err := io.ReadAll(ExpandNar(bytes.NewReader(orig), opts))
+					if err != nil {
+						b.Fatal(err)
+					}
+					collapsed, err := io.ReadAll(CollapseNar(bytes.NewReader(expanded), opts))
+					if err != nil {
+						b.Fatal(err)
+					} else if !bytes.Equal(collapsed, orig) {
+						b.Fatal("round trip mismatch")
+					}
+				}
+			})
+		}
+	}
+}
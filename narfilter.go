@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Nar filters transform nars before diffing. A request names a comma-separated chain of
+// them, applied in order. Each filter has a family and a version, and its name is the
+// family plus "v" plus the version. Newer versions of a family must be able to handle
+// everything older ones could, so a substituter can fall back to an older version when
+// talking to an older differ.
+
+type (
+	narFilterSpec struct {
+		family  string
+		version int
+		make    func(cfg *config, req *differRequest) (narFilters, error)
+	}
+
+	// narFilterChain is a list of filters put together into pipelines.
+	narFilterChain struct {
+		req  readerFilter // applied to the requested nar before diffing
+		base readerFilter // applied to the base nar before diffing
+		col  readerFilter // undoes req after expanding
+		// like req, but also counts expansion outcomes into the map
+		reqCount func(map[string]int) readerFilter
+	}
+)
+
+const (
+	narFilterFamilyExpand = "exp"
+	narFilterFamilyRefs   = "refs"
+)
+
+var narFilterRegistry = map[string]narFilterSpec{
+	narFilterExpandV2: expandNarFilter(2),
+	narFilterExpandV3: expandNarFilter(3),
+	narFilterExpandV4: expandNarFilter(4),
+	narFilterExpandV5: expandNarFilter(5),
+	narFilterExpandV6: expandNarFilter(6),
+	narFilterExpandV7: expandNarFilter(7),
+	narFilterRefs:     {family: narFilterFamilyRefs, version: 1, make: makeRefsNarFilter},
+}
+
+// baselineNarFilters is what a differ from before filter versioning can handle.
+var baselineNarFilters = []string{narFilterExpandV2}
+
+func expandNarFilter(version int) narFilterSpec {
+	return narFilterSpec{
+		family:  narFilterFamilyExpand,
+		version: version,
+		make: func(cfg *config, req *differRequest) (narFilters, error) {
+			opts := cfgToNarExpanderOptions(cfg)
+			opts.Version = version
+			// the base is never collapsed, so it doesn't need to be reproducible, and
+			// expanding it by decoding alone means both sides get the same base even if
+			// their compressors differ
+			baseOpts := opts
+			baseOpts.Decode = true
+			return narFilters{
+				exp:     func(r io.Reader) io.Reader { return ExpandNar(r, opts) },
+				expBase: func(r io.Reader) io.Reader { return ExpandNar(r, baseOpts) },
+				col:     func(r io.Reader) io.Reader { return CollapseNar(r, opts) },
+				expCount: func(stats map[string]int) readerFilter {
+					opts := opts
+					opts.Stats = stats
+					return func(r io.Reader) io.Reader { return ExpandNar(r, opts) }
+				},
+			}, nil
+		},
+	}
+}
+
+func makeRefsNarFilter(cfg *config, req *differRequest) (narFilters, error) {
+	if err := checkRefRewrites(req.RefRewrites); err != nil {
+		return narFilters{}, err
+	}
+	m := req.RefRewrites
+	return narFilters{base: func(r io.Reader) io.Reader { return newRefRewriter(r, m) }}, nil
+}
+
+// getNarFilter chains the filters named in the request.
+func getNarFilter(cfg *config, req *differRequest) (narFilterChain, error) {
+	var c narFilterChain
+	if req.NarFilter == "" {
+		return c, nil
+	}
+	var counts []func(map[string]int) readerFilter
+	counting := false
+	for _, name := range strings.Split(req.NarFilter, ",") {
+		spec, ok := narFilterRegistry[name]
+		if !ok {
+			return c, fmt.Errorf("unknown nar filter %q (supported: %s)", name, strings.Join(supportedNarFilters(), ","))
+		}
+		f, err := spec.make(cfg, req)
+		if err != nil {
+			return c, err
+		}
+		c.req = composeFilters(c.req, f.exp)
+		expBase := f.expBase
+		if expBase == nil {
+			expBase = f.exp
+		}
+		c.base = composeFilters(composeFilters(c.base, expBase), f.base)
+		// collapse in the opposite order
+		c.col = composeFilters(f.col, c.col)
+		if f.expCount != nil {
+			counts = append(counts, f.expCount)
+			counting = true
+		} else if f.exp != nil {
+			exp := f.exp
+			counts = append(counts, func(map[string]int) readerFilter { return exp })
+		}
+	}
+	if counting {
+		c.reqCount = func(stats map[string]int) readerFilter {
+			var r readerFilter
+			for _, count := range counts {
+				r = composeFilters(r, count(stats))
+			}
+			return r
+		}
+	}
+	return c, nil
+}
+
+// supportedNarFilters returns the names of all filters we can handle, sorted.
+func supportedNarFilters() []string {
+	names := make([]string, 0, len(narFilterRegistry))
+	for name := range narFilterRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseNarFilterName splits a filter name into family and version.
+func parseNarFilterName(name string) (string, int, bool) {
+	i := strings.LastIndex(name, "v")
+	if i <= 0 {
+		return "", 0, false
+	}
+	v, err := strconv.Atoi(name[i+1:])
+	if err != nil || v <= 0 || name[i+1:] != strconv.Itoa(v) {
+		return "", 0, false
+	}
+	return name[:i], v, true
+}
+
+// limitNarFilter rewrites a comma-separated filter chain to only use filters in supported.
+// An unsupported filter is replaced by the newest supported version of its family that
+// isn't newer than it, or dropped if there isn't one.
+func limitNarFilter(filter string, supported []string) string {
+	if filter == "" {
+		return ""
+	}
+	var out []string
+	for _, name := range strings.Split(filter, ",") {
+		family, version, ok := parseNarFilterName(name)
+		if !ok {
+			continue
+		}
+		best, bestVersion := "", 0
+		for _, s := range supported {
+			if f, v, ok := parseNarFilterName(s); ok && f == family && v <= version && v > bestVersion {
+				best, bestVersion = s, v
+			}
+		}
+		if best != "" {
+			out = append(out, best)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+func hasExpandFilter(req *differRequest) bool {
+	for _, name := range strings.Split(req.NarFilter, ",") {
+		if spec, ok := narFilterRegistry[name]; ok && spec.family == narFilterFamilyExpand {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNarFilter(req *differRequest, name string) bool {
+	for _, n := range strings.Split(req.NarFilter, ",") {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// composeFilters returns a filter that applies a and then b, either of which may be nil.
+func composeFilters(a, b readerFilter) readerFilter {
+	if a == nil {
+		return b
+	} else if b == nil {
+		return a
+	}
+	return func(r io.Reader) io.Reader { return b(a(r)) }
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestNarFilterRegistry(t *testing.T) {
+	for name, spec := range narFilterRegistry {
+		if exp := spec.family + "v" + strconv.Itoa(spec.version); name != exp {
+			t.Errorf("filter %q should be named %q", name, exp)
+		}
+	}
+}
+
+func TestLimitNarFilter(t *testing.T) {
+	all := supportedNarFilters()
+	for _, c := range []struct {
+		filter    string
+		supported []string
+		exp       string
+	}{
+		{"", all, ""},
+		{"expv7,refsv1", all, "expv7,refsv1"},
+		{"expv7,refsv1", []string{"expv2", "expv5", "refsv1"}, "expv5,refsv1"},
+		{"expv7,refsv1", []string{"expv2", "expv3"}, "expv3"},
+		{"expv4", []string{"expv5", "expv6"}, ""},
+		{"refsv2", []string{"refsv1"}, "refsv1"},
+		{"bogus", all, ""},
+	} {
+		if got := limitNarFilter(c.filter, c.supported); got != c.exp {
+			t.Errorf("%q with %v: got %q, expected %q", c.filter, c.supported, got, c.exp)
+		}
+	}
+}
+
+func TestGetNarFilter(t *testing.T) {
+	cfg := &config{}
+	if _, err := getNarFilter(cfg, &differRequest{NarFilter: "expv99"}); err == nil {
+		t.Error("expected error for unknown filter")
+	}
+
+	f, err := getNarFilter(cfg, &differRequest{NarFilter: narFilterRefs, RefRewrites: map[string]string{hashA: hashB}})
+	if err != nil {
+		t.Fatal(err)
+	} else if f.req != nil || f.col != nil || f.reqCount != nil || f.base == nil {
+		t.Errorf("refs only should just filter the base: %+v", f)
+	}
+
+	// expand and then rewrite the base, and collapse the result
+	root := filepath.Join(t.TempDir(), "root")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "file"), []byte("/nix/store/"+hashA+"-foo\n"), 0644)
+	orig := dumpNar(t, root)
+
+	f, err = getNarFilter(cfg, &differRequest{
+		NarFilter:   narFilterExpandV7 + "," + narFilterRefs,
+		RefRewrites: map[string]string{hashA: hashB},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if f.req == nil || f.col == nil || f.reqCount == nil {
+		t.Fatalf("missing filters: %+v", f)
+	}
+	base, err := io.ReadAll(f.base(bytes.NewReader(orig)))
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(base, []byte(hashA)) || !bytes.Contains(base, []byte(hashB)) {
+		t.Error("base wasn't rewritten")
+	}
+	expanded, err := io.ReadAll(f.req(bytes.NewReader(orig)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	collapsed, err := io.ReadAll(f.col(bytes.NewReader(expanded)))
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(collapsed, orig) {
+		t.Error("round trip mismatch")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// Expanding a compressed tarball gives the diff algorithm the tar stream, but files inside
+// it still aren't aligned with anything. So (with version 7) an expanded tarball becomes a
+// directory with an entry for each member with contents, and everything else (headers,
+// padding, the end of the archive) goes in the meta entry so collapsing can put the exact
+// bytes back together.
+
+type narExpTarMember struct {
+	Gap  []byte `json:"g"` // bytes between the previous member's contents and this one's
+	Name string `json:"n"` // of the entry in the data directory
+	Size int64  `json:"s"`
+}
+
+var tarNameEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+
+// tarMembers splits a tar file into members with contents and the bytes around them. It
+// returns nil if buf isn't a tar file that we can split.
+func tarMembers(buf []byte) ([]narExpTarMember, []byte) {
+	if len(buf) < 1024 || !bytes.Equal(buf[257:262], []byte("ustar")) {
+		return nil, nil
+	}
+	br := bytes.NewReader(buf)
+	tr := tar.NewReader(br)
+	var members []narExpTarMember
+	var names []string
+	var pos int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil
+		} else if hdr.Typeflag == tar.TypeGNUSparse || hdr.PAXRecords["GNU.sparse.map"] != "" ||
+			hdr.PAXRecords["GNU.sparse.major"] != "" {
+			// stored contents don't match the size in the header
+			return nil, nil
+		} else if hdr.Size == 0 || !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		// tar.Reader reads whole blocks, so br is at the start of the contents
+		off := br.Size() - int64(br.Len())
+		if off < pos || off+hdr.Size > int64(len(buf)) {
+			return nil, nil
+		}
+		members = append(members, narExpTarMember{Gap: buf[pos:off], Size: hdr.Size})
+		names = append(names, hdr.Name)
+		pos = off + hdr.Size
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	// most tarballs have everything under one directory that includes the version, leave
+	// that out so names match across versions
+	prefix, _, _ := strings.Cut(names[0], "/")
+	prefix += "/"
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			prefix = ""
+			break
+		}
+	}
+	seen := make(map[string]bool)
+	for i, name := range names {
+		name = tarNameEscaper.Replace(strings.TrimPrefix(name, prefix))
+		if name == "" || name == "." || name == ".." {
+			name = "%" + name
+		}
+		if seen[name] {
+			return nil, nil
+		}
+		seen[name] = true
+		members[i].Name = name
+	}
+	return members, buf[pos:]
+}
+
+// tarOffsets returns the offset of each member's contents and the total size of the tar.
+func tarOffsets(members []narExpTarMember, end []byte) ([]int64, int64) {
+	offsets := make([]int64, len(members))
+	var pos int64
+	for i, m := range members {
+		pos += int64(len(m.Gap))
+		offsets[i] = pos
+		pos += m.Size
+	}
+	return offsets, pos + int64(len(end))
+}
+
+// sendExpandedTar sends meta and data entries for an expanded tarball, with the data as a
+// directory. It takes the place of sendExpanded.
+func (n *narExpander) sendExpandedTar(h *nar.Header, meta *narExpanderMeta, data []byte, nb *narBuf, dataSem int64) error {
+	// we don't need the compressed data anymore
+	if err := n.free(nb); err != nil {
+		return err
+	}
+
+	if err := n.sendMeta(h, meta); err != nil {
+		return err
+	}
+
+	dirPath := h.Path + narExpDataSuffix
+	n.ents <- &narEntry{nil, nar.Header{Path: dirPath, Type: nar.TypeDirectory}, nil, nil}
+
+	offsets, _ := tarOffsets(meta.Tar, meta.TarEnd)
+	order := make([]int, len(meta.Tar))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return meta.Tar[order[i]].Name < meta.Tar[order[j]].Name })
+	for k, i := range order {
+		m := meta.Tar[i]
+		var release func() error
+		if k == len(order)-1 {
+			release = func() error { n.sem.Release(dataSem); return nil }
+		}
+		eh := nar.Header{Path: dirPath + "/" + m.Name, Type: nar.TypeRegular, Size: m.Size}
+		n.ents <- &narEntry{nil, eh, bytes.NewReader(data[offsets[i] : offsets[i]+m.Size]), release}
+	}
+	return nil
+}
+
+// readTar reads the data directory of an expanded tarball and puts the tar back together.
+func (n *narExpander) readTar(nr *nar.Reader, h *nar.Header, meta *narExpanderMeta) (*narBuf, error) {
+	offsets, size := tarOffsets(meta.Tar, meta.TarEnd)
+	byName := make(map[string]int, len(meta.Tar))
+	for i, m := range meta.Tar {
+		if m.Size <= 0 {
+			return nil, errors.New("bad tar meta")
+		}
+		byName[m.Name] = i
+	}
+	if len(byName) != len(meta.Tar) {
+		return nil, errors.New("bad tar meta")
+	}
+
+	nb := &narBuf{sem: min(n.opts.BufferBytes, size+meta.CompressedSize)}
+	n.sem.Acquire(context.Background(), nb.sem)
+	nb.b = make([]byte, size)
+	for i, m := range meta.Tar {
+		copy(nb.b[offsets[i]-int64(len(m.Gap)):], m.Gap)
+	}
+	copy(nb.b[size-int64(len(meta.TarEnd)):], meta.TarEnd)
+
+	for range meta.Tar {
+		eh, err := nr.Next()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(eh.Path, h.Path+"/")
+		i, ok := byName[name]
+		if !ok || eh.Type != nar.TypeRegular || eh.Size != meta.Tar[i].Size {
+			return nil, errors.New("bad expanded tar")
+		}
+		delete(byName, name)
+		if _, err := io.ReadFull(nr, nb.b[offsets[i]:offsets[i]+eh.Size]); err != nil {
+			return nil, err
+		}
+	}
+	return nb, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+func TestExpandTar(t *testing.T) {
+	for _, bin := range []string{"tar", xzBin, gzipBin} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skip("no", bin)
+		}
+	}
+
+	// a source tree to make tarballs from
+	dir := t.TempDir()
+	src := filepath.Join(dir, "pkg-1.2")
+	os.MkdirAll(filepath.Join(src, "src", strings.Repeat("long", 30)), 0755)
+	os.WriteFile(filepath.Join(src, "README"), xzTestData(3000), 0644)
+	os.WriteFile(filepath.Join(src, "src", "main.c"), xzTestData(70000), 0755)
+	os.WriteFile(filepath.Join(src, "src", strings.Repeat("long", 30), "100%.txt"), []byte("long name\n"), 0644)
+	os.WriteFile(filepath.Join(src, "empty"), nil, 0644)
+	os.Symlink("README", filepath.Join(src, "link"))
+
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0755)
+	tarball := func(name string, args ...string) {
+		cmd := exec.Command("tar", append([]string{"-C", dir, "--sort=name", "--mtime=@1", "--owner=0", "--group=0", "--numeric-owner"}, args...)...)
+		cmd.Args = append(cmd.Args, "-cf", filepath.Join(root, name), "pkg-1.2")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(name, err, string(out))
+		}
+	}
+	tarball("gnu.tar.gz", "--format=gnu", "--use-compress-program=gzip -n")
+	tarball("pax.tar.xz", "--format=pax", "--pax-option=delete=atime,delete=ctime", "--use-compress-program=xz")
+	tarball("ustar.tar", "--format=ustar", "--exclude=long*")
+	// not a tarball
+	os.WriteFile(filepath.Join(root, "plain.xz"), xzCompress(t, xzTestData(20000)), 0644)
+	orig := dumpNar(t, root)
+
+	for _, c := range []struct {
+		version int
+		exp     string
+		stats   map[string]int
+	}{
+		{6, "/gnu.tar.gz,/pax.tar.xz,/plain.xz", map[string]int{"gz:expanded": 1, "xz:expanded": 2}},
+		{7, "/gnu.tar.gz,/pax.tar.xz,/plain.xz", map[string]int{"gz:expanded": 1, "xz:expanded": 2, "tar:expanded": 2}},
+	} {
+		stats := make(map[string]int)
+		opts := narExpanderOptions{Version: c.version, Stats: stats}
+		expanded, err := io.ReadAll(ExpandNar(bytes.NewReader(orig), opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(expandedPaths(t, expanded), ","); got != c.exp {
+			t.Errorf("v%d: expanded %v, expected %v", c.version, got, c.exp)
+		}
+		if !reflect.DeepEqual(stats, c.stats) {
+			t.Errorf("v%d: stats %v, expected %v", c.version, stats, c.stats)
+		}
+		collapsed, err := io.ReadAll(CollapseNar(bytes.NewReader(expanded), opts))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(collapsed, orig) {
+			t.Errorf("v%d: round trip mismatch", c.version)
+		}
+
+		if c.version < 7 {
+			continue
+		}
+		// members are in a directory without the top-level directory
+		var got []string
+		nr, err := nar.NewReader(bytes.NewReader(expanded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			h, err := nr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if _, name, ok := strings.Cut(h.Path, "/gnu.tar.gz"+narExpDataSuffix+"/"); ok {
+				got = append(got, name)
+			}
+		}
+		exp := []string{"README", "src%2F" + strings.Repeat("long", 30) + "%2F100%25.txt", "src%2Fmain.c"}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("members %q, expected %q", got, exp)
+		}
+	}
+}
+
+func TestTarMembers(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("no tar")
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a"), []byte("one"), 0644)
+	os.WriteFile(filepath.Join(dir, "b"), []byte("two"), 0644)
+	tarFile := filepath.Join(dir, "t.tar")
+	run := func(args ...string) {
+		if out, err := exec.Command("tar", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatal(err, string(out))
+		}
+	}
+
+	run("-cf", tarFile, "a", "b")
+	buf, _ := os.ReadFile(tarFile)
+	members, end := tarMembers(buf)
+	if len(members) != 2 || members[0].Name != "a" || members[1].Name != "b" {
+		t.Fatalf("members %+v", members)
+	}
+	offsets, size := tarOffsets(members, end)
+	if size != int64(len(buf)) || string(buf[offsets[1]:offsets[1]+members[1].Size]) != "two" {
+		t.Errorf("offsets %v size %d", offsets, size)
+	}
+
+	// same name twice can't be a directory
+	run("-rf", tarFile, "a")
+	buf, _ = os.ReadFile(tarFile)
+	if members, _ := tarMembers(buf); members != nil {
+		t.Errorf("expected nil for duplicate names, got %+v", members)
+	}
+
+	if members, _ := tarMembers(xzTestData(5000)); members != nil {
+		t.Errorf("expected nil for non-tar, got %+v", members)
+	}
+}
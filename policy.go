@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+type (
+	// algoPolicy picks a diff algorithm and level for a request, based on the client's
+	// preferences, the size of the nar, the time we have, and how previous versions of the
+	// same package did.
+	algoPolicy struct {
+		lock    sync.Mutex
+		history *lru.Cache // pname -> *algoHistory
+	}
+
+	algoChoice struct {
+		algo   DiffAlgo
+		level  int
+		reason string
+	}
+
+	// last outcome for each algo name for one package
+	algoHistory struct {
+		ratio map[string]float64 // diff size / nar size
+	}
+
+	algoSpec struct {
+		name     string
+		level    int
+		explicit bool // level came from the client
+	}
+)
+
+const (
+	// expanded nars are bigger than the nar size we get in the request
+	expandedSizeFactor = 3
+	// if a diff at the max level would take less than this, just do it
+	smallDiffTime = 250 * time.Millisecond
+	// fraction of remaining time that we can spend on the diff
+	deadlineFraction = 0.5
+	// switch algos if history says another one is this much better
+	historyMargin = 0.9
+	// xdelta only finds matches within its source window (-B, 64MiB by default), zstd
+	// --long=30 sees 1GiB
+	xdeltaWindow = 64 << 20
+)
+
+func newAlgoPolicy() *algoPolicy {
+	return &algoPolicy{history: lru.New(1000)}
+}
+
+func (p *algoPolicy) pick(ctx context.Context, req *differRequest) *algoChoice {
+	var specs []algoSpec
+	for _, a := range req.AcceptAlgos {
+		if spec, ok := parseAlgoSpec(a); ok {
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 {
+		return nil
+	}
+
+	size, expanded := req.ReqNarSize, hasExpandFilter(req)
+	if expanded {
+		size *= expandedSizeFactor
+	}
+
+	spec := specs[0]
+	reason := "first"
+
+	// xdelta makes smaller diffs when everything fits in its window, zstd is better for
+	// anything bigger, and for expanded nars, which have long runs of uncompressed data
+	if name := sizeAlgo(size, expanded); name != spec.name {
+		for _, s := range specs {
+			if s.name == name {
+				spec = s
+				reason = "size"
+				break
+			}
+		}
+	}
+
+	// prefer an algo that did much better on a previous version
+	if h := p.getHistory(pnameOf(req.ReqName)); h != nil {
+		if best, ok := h.best(specs); ok && best.name != spec.name {
+			curRatio, curOk := h.ratio[spec.name]
+			if !curOk || h.ratio[best.name] < curRatio*historyMargin {
+				spec = best
+				reason = "history"
+			}
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		// lower level until it fits in our time budget
+		budget := time.Duration(float64(time.Until(deadline)) * deadlineFraction)
+		for spec.level > 1 && estimateDiffTime(spec.name, spec.level, size) > budget {
+			spec.level--
+			reason = "deadline"
+		}
+	}
+	if reason != "deadline" && !spec.explicit {
+		// small diffs are cheap, use max level, unless the client asked for a level
+		top := maxLevel(spec.name)
+		if spec.level < top && estimateDiffTime(spec.name, top, size) < smallDiffTime {
+			spec.level = top
+			reason += ",small"
+		}
+	}
+
+	algo := getAlgo(spec.name)
+	algo.SetLevel(spec.level)
+	return &algoChoice{algo: algo, level: spec.level, reason: reason}
+}
+
+// record saves the outcome of a diff for future choices.
+func (p *algoPolicy) record(reqName string, stats *DiffStats) {
+	if stats == nil || stats.NarSize == 0 {
+		return
+	}
+	pname := pnameOf(reqName)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var h *algoHistory
+	if v, ok := p.history.Get(pname); ok {
+		h = v.(*algoHistory)
+	} else {
+		h = &algoHistory{ratio: make(map[string]float64)}
+		p.history.Add(pname, h)
+	}
+	h.ratio[stats.Algo] = float64(stats.DiffSize) / float64(stats.NarSize)
+}
+
+func (p *algoPolicy) getHistory(pname string) *algoHistory {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if v, ok := p.history.Get(pname); ok {
+		// copy so we don't race with record
+		h := v.(*algoHistory)
+		c := &algoHistory{ratio: make(map[string]float64, len(h.ratio))}
+		for k, v := range h.ratio {
+			c.ratio[k] = v
+		}
+		return c
+	}
+	return nil
+}
+
+// sizeAlgo returns the algo that usually does best for a nar of this (expected) size.
+func sizeAlgo(size int64, expanded bool) string {
+	if expanded || size > xdeltaWindow {
+		return zstdName
+	}
+	return xdeltaName
+}
+
+// best returns the spec with the lowest recorded ratio.
+func (h *algoHistory) best(specs []algoSpec) (algoSpec, bool) {
+	var best algoSpec
+	var bestRatio float64
+	found := false
+	for _, s := range specs {
+		if r, ok := h.ratio[s.name]; ok && (!found || r < bestRatio) {
+			best, bestRatio, found = s, r, true
+		}
+	}
+	return best, found
+}
+
+func parseAlgoSpec(a string) (algoSpec, bool) {
+	name, level, found := strings.Cut(a, "-")
+	if getAlgo(name) == nil {
+		return algoSpec{}, false
+	}
+	spec := algoSpec{name: name, level: defaultLevel(name)}
+	if found {
+		if levelInt, err := strconv.Atoi(level); err == nil {
+			spec.level = levelInt
+			spec.explicit = true
+		}
+	}
+	return spec, true
+}
+
+// estimateDiffTime returns a rough guess of how long it takes to compute a diff.
+func estimateDiffTime(name string, level int, size int64) time.Duration {
+	var mbps float64
+	switch name {
+	case zstdName:
+		switch {
+		case level <= 3:
+			mbps = 200
+		case level <= 9:
+			mbps = 60
+		case level <= 15:
+			mbps = 15
+		default:
+			mbps = 4
+		}
+	case xdeltaName:
+		switch {
+		case level <= 1:
+			mbps = 80
+		case level <= 3:
+			mbps = 40
+		case level <= 6:
+			mbps = 20
+		default:
+			mbps = 10
+		}
+	case zstdGoName:
+		mbps = 30
+	case nardiffName:
+		// unchanged files are nearly free, but changed ones use the slowest zstd encoder
+		mbps = 40
+	case bsdiffName:
+		// suffix sort dominates, level only affects xz
+		mbps = 2
+	default:
+		mbps = 10
+	}
+	return time.Duration(float64(size) / (mbps * 1e6) * float64(time.Second))
+}
+
+// pnameOf returns the name without version, e.g. "systemd" for "systemd-251.16".
+func pnameOf(name string) string {
+	for _, i := range findDashes(name) {
+		if i+1 < len(name) && name[i+1] >= '0' && name[i+1] <= '9' {
+			return name[:i]
+		}
+	}
+	return name
+}
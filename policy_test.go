@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPnameOf(t *testing.T) {
+	for _, pair := range []struct{ n, e string }{
+		{"systemd-251.16", "systemd"},
+		{"python3.10-websocket-client-1.4.1", "python3.10-websocket-client"},
+		{"lz4-1.9.4-dev", "lz4"},
+		{"rt5677-firmware-xz", "rt5677-firmware-xz"},
+		{"source", "source"},
+	} {
+		if a := pnameOf(pair.n); a != pair.e {
+			t.Error(pair, a)
+		}
+	}
+}
+
+func TestAlgoPolicy(t *testing.T) {
+	p := newAlgoPolicy()
+	req := &differRequest{
+		AcceptAlgos: []string{"zstd-3", "xdelta-1"},
+		ReqNarSize:  100e6,
+		ReqName:     "systemd-251.16",
+	}
+
+	c := p.pick(context.Background(), req)
+	if c.algo.Name() != zstdName || c.level != 3 || c.reason != "first" {
+		t.Error("first", c)
+	}
+
+	// deadline lowers level
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req.AcceptAlgos = []string{"zstd-19"}
+	c = p.pick(ctx, req)
+	if c.algo.Name() != zstdName || c.level > 3 || c.reason != "deadline" {
+		t.Error("deadline", c)
+	}
+
+	// small nars get max level, unless the client asked for a level
+	req.AcceptAlgos = []string{"xdelta"}
+	req.ReqNarSize = 100e3
+	c = p.pick(context.Background(), req)
+	if c.algo.Name() != xdeltaName || c.level != 9 || c.reason != "first,small" {
+		t.Error("small", c)
+	}
+	req.AcceptAlgos = []string{"xdelta-1"}
+	c = p.pick(context.Background(), req)
+	if c.algo.Name() != xdeltaName || c.level != 1 || c.reason != "first" {
+		t.Error("small explicit", c)
+	}
+
+	// xdelta for small nars, zstd for expanded ones
+	req.AcceptAlgos = []string{"zstd-3", "xdelta-1"}
+	c = p.pick(context.Background(), req)
+	if c.algo.Name() != xdeltaName || c.level != 1 || c.reason != "size" {
+		t.Error("size", c)
+	}
+	req.NarFilter = "expv2"
+	c = p.pick(context.Background(), req)
+	if c.algo.Name() != zstdName || c.level != 3 || c.reason != "first" {
+		t.Error("expanded", c)
+	}
+	req.NarFilter = ""
+
+	// history switches algo
+	p.record("systemd-251.15", &DiffStats{Algo: zstdName, DiffSize: 50, NarSize: 100})
+	p.record("systemd-251.15", &DiffStats{Algo: xdeltaName, DiffSize: 20, NarSize: 100})
+	req.AcceptAlgos = []string{"zstd-3", "xdelta-1"}
+	req.ReqNarSize = 100e6
+	c = p.pick(context.Background(), req)
+	if c.algo.Name() != xdeltaName || c.level != 1 || c.reason != "history" {
+		t.Error("history", c)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// prefetch holds a differ response that was requested speculatively when the narinfo
+	// was served, so that the nar request can find it already downloaded.
+	prefetch struct {
+		done        chan struct{} // closed when fetch is finished
+		limit       int64         // bytes reserved from the budget
+		contentType string
+		buf         []byte
+		file        *os.File // used instead of buf if set
+		size        int64
+		err         error
+
+		lock    sync.Mutex
+		claimed bool
+		release func()
+	}
+)
+
+const (
+	// extra room for multipart overhead + header + trailer
+	prefetchOverhead = 64 * 1024
+	// max time for the differ to compute the delta
+	prefetchTimeout = 5 * time.Minute
+	// how long to hold a finished prefetch if nix doesn't ask for it
+	prefetchExpiry = 5 * time.Minute
+	// how long to wait for more narinfo requests to fill a batch
+	prefetchBatchWait = 50 * time.Millisecond
+	// max prefetches to put in one batch request
+	prefetchBatchMax = 16
+)
+
+var (
+	errPrefetchTooBig  = errors.New("prefetch response exceeded reservation")
+	errPrefetchMissing = errors.New("missing from batch response")
+)
+
+// newPrefetch reserves space for a prefetch from the memory budget, or if that's full, the
+// disk budget. Returns nil if neither budget has room.
+func (s *subst) newPrefetch(recent *recent) *prefetch {
+	// we don't know how big the delta will be, but if it's larger than the compressed nar
+	// it's not very useful anyway.
+	limit := recent.fileSize + prefetchOverhead
+	pf := &prefetch{done: make(chan struct{}), limit: limit}
+	if s.pfMemSem.TryAcquire(limit) {
+		pf.release = func() { s.pfMemSem.Release(limit) }
+	} else if s.pfDiskSem.TryAcquire(limit) {
+		f, err := os.CreateTemp("", "prefetch")
+		if err != nil {
+			s.pfDiskSem.Release(limit)
+			return nil
+		}
+		// unlink now, we'll only access it through the fd
+		os.Remove(f.Name())
+		pf.file = f
+		pf.release = func() { f.Close(); s.pfDiskSem.Release(limit) }
+	} else {
+		return nil
+	}
+	return pf
+}
+
+func (s *subst) queuePrefetch(recent *recent) {
+	if !s.noBatch.Load() {
+		select {
+		case s.pfQueue <- recent:
+			return
+		default:
+		}
+	}
+	go s.runPrefetch(recent)
+}
+
+// prefetchBatcher collects queued prefetches into batches.
+func (s *subst) prefetchBatcher() {
+	for {
+		batch := []*recent{<-s.pfQueue}
+		timer := time.NewTimer(prefetchBatchWait)
+	collect:
+		for len(batch) < prefetchBatchMax {
+			select {
+			case r := <-s.pfQueue:
+				batch = append(batch, r)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		if len(batch) == 1 || s.noBatch.Load() {
+			for _, r := range batch {
+				go s.runPrefetch(r)
+			}
+		} else {
+			go s.runPrefetchBatch(batch)
+		}
+	}
+}
+
+func (s *subst) runPrefetch(recent *recent) {
+	pf := recent.pf
+
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+
+	if err := s.psem.Acquire(ctx, 1); err != nil {
+		pf.finish(err)
+		return
+	}
+	defer s.psem.Release(1)
+
+	res, status, msg, err := s.requestDiff(ctx, &recent.request)
+	if status == differStatusNotWorthIt {
+		pf.finish(errNotWorthIt)
+		return
+	} else if err != nil || status != 0 {
+		pf.finish(fmt.Errorf("%d %s: %w", status, msg, err))
+		return
+	}
+	defer res.Body.Close()
+	pf.contentType = res.Header.Get("Content-Type")
+
+	_, err = io.Copy(pf, res.Body)
+	pf.finish(err)
+	if err == nil {
+		log.Printf("prefetched %s [%d bytes]", recent.request.ReqName, pf.size)
+	}
+}
+
+func (s *subst) runPrefetchBatch(batch []*recent) {
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+
+	var err error
+	finished := make([]bool, len(batch))
+	defer func() {
+		// anything not finished yet gets an error
+		if err == nil {
+			err = errPrefetchMissing
+		}
+		for i, r := range batch {
+			if !finished[i] {
+				r.pf.finish(err)
+			}
+		}
+	}()
+
+	if err = s.psem.Acquire(ctx, int64(len(batch))); err != nil {
+		return
+	}
+	defer s.psem.Release(int64(len(batch)))
+
+	reqs := make([]*differRequest, len(batch))
+	for i, r := range batch {
+		reqs[i] = &r.request
+	}
+	buf, err := json.Marshal(reqs)
+	if err != nil {
+		return
+	}
+	u := makeDifferUrl(s.cfg.Differ, differBatchPath)
+	postReq, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(buf))
+	if err != nil {
+		return
+	}
+	postReq.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(postReq)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed {
+		// older differ, don't try again
+		log.Print("differ doesn't support batch requests")
+		s.noBatch.Store(true)
+		for i, r := range batch {
+			finished[i] = true
+			go s.runPrefetch(r)
+		}
+		return
+	} else if res.StatusCode != http.StatusOK {
+		err = errors.New(res.Status)
+		return
+	}
+
+	boundary, err := getBoundary(res.Header.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+	mpr := multipart.NewReader(res.Body, boundary)
+	for {
+		var idx int
+		idx, err = splitBatchItem(mpr, batch, finished)
+		if err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			return
+		} else if pf := batch[idx].pf; pf.err == nil {
+			log.Printf("prefetched %s [%d bytes] in batch", batch[idx].request.ReqName, pf.size)
+		}
+	}
+}
+
+// splitBatchItem reads one header/body/trailer triple from a batch response and writes it to
+// the corresponding prefetch as a single-item response. Returns the index of the finished
+// prefetch.
+func splitBatchItem(mpr *multipart.Reader, batch []*recent, finished []bool) (int, error) {
+	var h differHeader
+	if err := readDifferJson(mpr, differHeaderName, &h); err != nil {
+		return 0, err
+	} else if err = checkDifferProtocol(h.Protocol); err != nil {
+		return 0, err
+	}
+
+	idx := h.Index
+	if idx < 0 || idx >= len(batch) || finished[idx] {
+		return 0, fmt.Errorf("batch response has bad index %d", idx)
+	}
+	finished[idx] = true
+	pf := batch[idx].pf
+
+	// errors writing to pf only fail this item, errors reading mpr fail the whole batch
+	mpw := multipart.NewWriter(pf)
+	pf.contentType = mpw.FormDataContentType()
+	writeErr := writeJsonField(mpw, differHeaderName, h)
+
+	br, err := readDifferBody(mpr)
+	if err != nil {
+		pf.finish(err)
+		return idx, err
+	}
+	if writeErr == nil {
+		var bw io.Writer
+		if bw, writeErr = mpw.CreateFormFile(differBodyName, "delta"); writeErr == nil {
+			writeErr = ioCopy(bw, br, nil, -1)
+		}
+	}
+	// consume the rest of the part if writing failed
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		pf.finish(err)
+		return idx, err
+	}
+
+	var t differTrailer
+	if err = readDifferJson(mpr, differTrailerName, &t); err != nil {
+		pf.finish(err)
+		return idx, err
+	}
+
+	if writeErr == nil && t.Status == differStatusNotWorthIt {
+		writeErr = errNotWorthIt
+	} else if writeErr == nil && !t.Ok {
+		writeErr = fmt.Errorf("differ error: %d %s", t.Status, t.Error)
+	}
+	if writeErr == nil {
+		writeErr = writeJsonField(mpw, differTrailerName, t)
+	}
+	if writeErr == nil {
+		writeErr = mpw.Close()
+	}
+	pf.finish(writeErr)
+	return idx, nil
+}
+
+// Write appends to the buffer, up to the reserved limit.
+func (pf *prefetch) Write(p []byte) (int, error) {
+	if pf.size+int64(len(p)) > pf.limit {
+		return 0, errPrefetchTooBig
+	}
+	pf.size += int64(len(p))
+	if pf.file != nil {
+		return pf.file.Write(p)
+	}
+	pf.buf = append(pf.buf, p...)
+	return len(p), nil
+}
+
+// finish marks the prefetch as done and schedules the reservation to be released if nobody
+// claims it.
+func (pf *prefetch) finish(err error) {
+	pf.err = err
+	close(pf.done)
+	time.AfterFunc(prefetchExpiry, func() {
+		if pf.claim() {
+			pf.release()
+		}
+	})
+}
+
+// claim returns true if the caller is the first to claim this prefetch. The caller is then
+// responsible for calling free.
+func (pf *prefetch) claim() bool {
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+	if pf.claimed {
+		return false
+	}
+	pf.claimed = true
+	return true
+}
+
+// free releases the reservation after the fetch is done.
+func (pf *prefetch) free() {
+	go func() {
+		<-pf.done
+		pf.release()
+	}()
+}
+
+// reader returns the buffered response. Only valid after done is closed with no error.
+func (pf *prefetch) reader() io.ReadCloser {
+	if pf.file != nil {
+		return io.NopCloser(io.NewSectionReader(pf.file, 0, pf.size))
+	}
+	return io.NopCloser(bytes.NewReader(pf.buf))
+}
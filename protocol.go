@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+)
+
+// Differ responses are multipart: a json header, a raw body, and a json trailer, repeated for
+// each item in a batch. Requests and headers carry the protocol version: a client sends the
+// newest version it speaks and the differ answers with the older of that and its own, so
+// version 0 (no version field) is the original protocol. From version 1 on, clients skip
+// parts with names they don't know anywhere in a response, so a differ can add optional
+// parts for clients that asked for version 1 or later. Clients that sent version 0 expect
+// exactly header, body and trailer, and must never get anything else.
+
+// differProtocolVersion is the newest protocol version we speak.
+const differProtocolVersion = 1
+
+var errDifferProtocol = errors.New("differ protocol error")
+
+// differResponseProtocol returns the protocol version to answer a request with.
+func differResponseProtocol(reqProtocol int) int {
+	if reqProtocol < 0 {
+		return 0
+	}
+	return min(reqProtocol, differProtocolVersion)
+}
+
+// checkDifferProtocol checks the version in a response header.
+func checkDifferProtocol(v int) error {
+	if v < 0 || v > differProtocolVersion {
+		return fmt.Errorf("%w: unsupported version %d", errDifferProtocol, v)
+	}
+	return nil
+}
+
+// nextDifferPart returns the next header, body or trailer part, skipping any others. raw is
+// for the body, which must not be decoded.
+func nextDifferPart(mpr *multipart.Reader, raw bool) (*multipart.Part, error) {
+	for {
+		var p *multipart.Part
+		var err error
+		if raw {
+			p, err = mpr.NextRawPart()
+		} else {
+			p, err = mpr.NextPart()
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch p.FormName() {
+		case differHeaderName, differBodyName, differTrailerName:
+			return p, nil
+		}
+	}
+}
+
+// readDifferJson reads the next part, which must be named name, as json into v.
+func readDifferJson(mpr *multipart.Reader, name string, v any) error {
+	p, err := nextDifferPart(mpr, false)
+	if err != nil {
+		return err
+	} else if p.FormName() != name {
+		return fmt.Errorf("%w: expected part %q, got %q", errDifferProtocol, name, p.FormName())
+	}
+	return json.NewDecoder(p).Decode(v)
+}
+
+// readDifferBody returns the next part, which must be a body.
+func readDifferBody(mpr *multipart.Reader) (*multipart.Part, error) {
+	p, err := nextDifferPart(mpr, true)
+	if err != nil {
+		return nil, err
+	} else if p.FormName() != differBodyName {
+		return nil, fmt.Errorf("%w: expected part %q, got %q", errDifferProtocol, differBodyName, p.FormName())
+	}
+	return p, nil
+}
+
+// readDifferEnd checks that there's nothing but optional parts left.
+func readDifferEnd(mpr *multipart.Reader) error {
+	p, err := nextDifferPart(mpr, false)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: unexpected part %q", errDifferProtocol, p.FormName())
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Conformance tests for differ responses: what readers must accept and reject, and what
+// the differ writes for clients of each protocol version.
+
+type testPart struct{ name, data string }
+
+func makeTestResponse(parts []testPart) (*bytes.Buffer, *multipart.Writer) {
+	var buf bytes.Buffer
+	mpw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		var w io.Writer
+		if p.name == differBodyName {
+			w, _ = mpw.CreateFormFile(p.name, "delta")
+		} else {
+			w, _ = mpw.CreateFormField(p.name)
+		}
+		w.Write([]byte(p.data))
+	}
+	mpw.Close()
+	return &buf, mpw
+}
+
+func readTestResponse(parts []testPart) (differHeader, string, differTrailer, error) {
+	buf, mpw := makeTestResponse(parts)
+	mpr := multipart.NewReader(buf, mpw.Boundary())
+	var h differHeader
+	var t differTrailer
+	if err := readDifferJson(mpr, differHeaderName, &h); err != nil {
+		return h, "", t, err
+	} else if err := checkDifferProtocol(h.Protocol); err != nil {
+		return h, "", t, err
+	}
+	br, err := readDifferBody(mpr)
+	if err != nil {
+		return h, "", t, err
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return h, "", t, err
+	} else if err := readDifferJson(mpr, differTrailerName, &t); err != nil {
+		return h, "", t, err
+	}
+	return h, string(body), t, readDifferEnd(mpr)
+}
+
+func TestDifferProtocolRead(t *testing.T) {
+	header := testPart{differHeaderName, `{"Protocol":1,"Algo":"zstd","Level":3}`}
+	body := testPart{differBodyName, "delta\r\n--not a boundary"}
+	trailer := testPart{differTrailerName, `{"Ok":true}`}
+	extra := testPart{"extra", `{"anything":true}`}
+	for _, c := range []struct {
+		name  string
+		parts []testPart
+		ok    bool
+	}{
+		{"v0", []testPart{{differHeaderName, `{"Algo":"zstd","Level":3}`}, body, trailer}, true},
+		{"v1", []testPart{header, body, trailer}, true},
+		{"extra parts", []testPart{extra, header, extra, body, extra, extra, trailer, extra}, true},
+		{"unknown fields", []testPart{{differHeaderName, `{"Protocol":1,"Algo":"zstd","Future":[1]}`}, body, trailer}, true},
+		{"newer version", []testPart{{differHeaderName, `{"Protocol":99,"Algo":"zstd"}`}, body, trailer}, false},
+		{"missing trailer", []testPart{header, body}, false},
+		{"missing body", []testPart{header, trailer}, false},
+		{"two trailers", []testPart{header, body, trailer, trailer}, false},
+		{"body first", []testPart{body, header, trailer}, false},
+		{"bad json", []testPart{header, body, {differTrailerName, `{"Ok":`}}, false},
+	} {
+		h, b, tr, err := readTestResponse(c.parts)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if h.Algo != "zstd" || b != body.data || !tr.Ok {
+			t.Errorf("%s: got %+v %q %+v", c.name, h, b, tr)
+		}
+	}
+}
+
+func TestDifferProtocolWrite(t *testing.T) {
+	for _, c := range [][2]int{{-1, 0}, {0, 0}, {1, 1}, {99, differProtocolVersion}} {
+		if got := differResponseProtocol(c[0]); got != c[1] {
+			t.Errorf("request version %d: got %d, expected %d", c[0], got, c[1])
+		}
+	}
+
+	// clients from before versioning see the same json as before
+	buf, _ := json.Marshal(differHeader{Algo: "zstd"})
+	if string(buf) != `{"Algo":"zstd"}` {
+		t.Errorf("v0 header %s", buf)
+	}
+
+	// a batch with one client of each version, both failing
+	differ := httptest.NewServer(newDifferServer(&config{}).getHander())
+	defer differ.Close()
+	reqs, _ := json.Marshal([]differRequest{
+		{Protocol: differProtocolVersion, AcceptAlgos: []string{"bogus"}},
+		{AcceptAlgos: []string{"bogus"}},
+	})
+	res, err := http.Post(differ.URL+differBatchPath, "application/json", bytes.NewReader(reqs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	boundary, err := getBoundary(res.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mpr := multipart.NewReader(res.Body, boundary)
+	got := make(map[int]int)
+	for {
+		var h differHeader
+		var tr differTrailer
+		if err := readDifferJson(mpr, differHeaderName, &h); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if br, err := readDifferBody(mpr); err != nil {
+			t.Fatal(err)
+		} else if b, _ := io.ReadAll(br); len(b) != 0 {
+			t.Errorf("unexpected body %q", b)
+		}
+		if err := readDifferJson(mpr, differTrailerName, &tr); err != nil {
+			t.Fatal(err)
+		} else if tr.Ok || !strings.Contains(tr.Error, "unknown algo") {
+			t.Errorf("trailer %+v", tr)
+		}
+		got[h.Index] = h.Protocol
+	}
+	if len(got) != 2 || got[0] != differProtocolVersion || got[1] != 0 {
+		t.Errorf("header versions %v", got)
+	}
+}
+
+func TestExpandDiffHashes(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	os.MkdirAll(base, 0755)
+	data := xzTestData(200000)
+	os.WriteFile(filepath.Join(base, "file"), data, 0644)
+	baseNar := dumpNar(t, base)
+	copy(data[1000:], "changed")
+	req := filepath.Join(dir, "req")
+	os.MkdirAll(req, 0755)
+	os.WriteFile(filepath.Join(req, "file"), data, 0644)
+	reqNar := dumpNar(t, req)
+
+	baseFile, reqFile := filepath.Join(dir, "base.nar"), filepath.Join(dir, "req.nar")
+	os.WriteFile(baseFile, baseNar, 0644)
+	os.WriteFile(reqFile, reqNar, 0644)
+	var delta bytes.Buffer
+	if _, err := getAlgo(zstdGoName).Create(context.Background(), CreateArgs{
+		Base: baseFile, Request: reqFile, RequestSize: -1, Output: &delta,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	hashOf := func(b []byte) string {
+		h := sha256.New()
+		h.Write(b)
+		return nixHashString(h)
+	}
+	deltaHash, narHash := hashOf(delta.Bytes()), hashOf(reqNar)
+	corrupt := append([]byte{}, delta.Bytes()...)
+	corrupt[len(corrupt)/2] ^= 0x55
+
+	cfg := &config{AnalyticsFile: filepath.Join(dir, "analytics")}
+	s := newLocalSubstituter(cfg, newCatalog(cfg))
+	failed := func(id string) string {
+		an, _ := os.ReadFile(cfg.AnalyticsFile)
+		for _, line := range bytes.Split(an, []byte("\n")) {
+			var rec AnRecord
+			if json.Unmarshal(line, &rec) == nil && rec.D != nil && rec.D.Id == id {
+				return rec.D.Failed
+			}
+		}
+		return ""
+	}
+	for _, c := range []struct {
+		name    string
+		body    []byte
+		trailer differTrailer
+		narHash string // from the narinfo
+		err     error  // nil for any error
+		ok      bool
+	}{
+		{"good", delta.Bytes(), differTrailer{Ok: true, DeltaHash: deltaHash, NarHash: narHash}, narHash, nil, true},
+		{"no hashes", delta.Bytes(), differTrailer{Ok: true}, "", nil, true},
+		{"narinfo hash only", delta.Bytes(), differTrailer{Ok: true}, narHash, nil, true},
+		{"corrupt", corrupt, differTrailer{Ok: true, DeltaHash: deltaHash, NarHash: narHash}, narHash, errDeltaCorrupt, false},
+		{"wrong nar", delta.Bytes(), differTrailer{Ok: true, DeltaHash: deltaHash, NarHash: hashOf(baseNar)}, "", errNarHashMismatch, false},
+		{"wrong narinfo", delta.Bytes(), differTrailer{Ok: true, DeltaHash: deltaHash}, hashOf(baseNar), errNarHashMismatch, false},
+		{"corrupt no hashes", corrupt, differTrailer{Ok: true}, "", nil, false},
+	} {
+		trailer, _ := json.Marshal(c.trailer)
+		buf, mpw := makeTestResponse([]testPart{
+			{differHeaderName, `{"Protocol":1,"Algo":"zstdgo"}`},
+			{differBodyName, string(c.body)},
+			{differTrailerName, string(trailer)},
+		})
+		rec := &recent{id: c.name, narHash: c.narHash, request: differRequest{BaseStorePath: base}}
+		var out bytes.Buffer
+		_, _, err := s.expandDiff(context.Background(), rec, buf, mpw.FormDataContentType(), &out)
+		if c.ok {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			} else if !bytes.Equal(out.Bytes(), reqNar) {
+				t.Errorf("%s: output mismatch", c.name)
+			}
+		} else if err == nil {
+			t.Errorf("%s: expected error", c.name)
+		} else if bytes.Equal(out.Bytes(), reqNar) {
+			t.Errorf("%s: whole nar written despite error", c.name)
+		} else if c.err != nil && !errors.Is(err, c.err) {
+			t.Errorf("%s: got %v, expected %v", c.name, err, c.err)
+		} else if c.err == nil && errors.Is(err, errDeltaCorrupt) {
+			t.Errorf("%s: can't tell corruption without a hash: %v", c.name, err)
+		}
+	}
+
+	// a body cut short is transport corruption, unless we gave up on it ourselves
+	for _, canceled := range []bool{false, true} {
+		buf, mpw := makeTestResponse([]testPart{
+			{differHeaderName, `{"Protocol":1,"Algo":"zstdgo"}`},
+			{differBodyName, string(delta.Bytes()[:delta.Len()/2])},
+		})
+		id := fmt.Sprint("truncated ", canceled)
+		ctx, cancel := context.WithCancel(context.Background())
+		if canceled {
+			cancel()
+		}
+		rec := &recent{id: id, narHash: narHash, request: differRequest{BaseStorePath: base}}
+		var out bytes.Buffer
+		if _, _, err := s.expandDiff(ctx, rec, buf, mpw.FormDataContentType(), &out); err == nil {
+			t.Errorf("%s: expected error", id)
+		} else if exp := map[bool]string{false: failedCorrupt}[canceled]; failed(id) != exp {
+			t.Errorf("%s: recorded %q, expected %q", id, failed(id), exp)
+		}
+		cancel()
+	}
+}
+
+func TestStreamNarHash(t *testing.T) {
+	if _, err := exec.LookPath(catBin); err != nil {
+		t.Skip("no", catBin)
+	}
+	root := filepath.Join(t.TempDir(), "root")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "file"), xzTestData(10000), 0644)
+	orig := dumpNar(t, root)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write(orig) }))
+	defer upstream.Close()
+
+	// the hash is of the nar from upstream, not what the filter makes of it
+	filter := func(r io.Reader) io.Reader { return io.MultiReader(r, strings.NewReader("extra")) }
+	ns, err := streamNar(upstream.URL+"/x", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(ns); err != nil {
+		t.Fatal(err)
+	} else if err := ns.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	h.Write(orig)
+	if got, exp := ns.narHash(), nixHashString(h); got != exp {
+		t.Errorf("got %s, expected %s", got, exp)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// Most rebuilds only change the store path hashes embedded in the output: the dependencies
+// changed, so every reference to them did too. The refs filter rewrites each hash in the base
+// that refers to (an older version of) a dependency of the request with the hash the request
+// uses, before diffing. Hashes are all the same length, so it doesn't change any sizes or
+// offsets and the rewritten base is usually much closer to the request.
+//
+// The map from base hashes to request hashes is computed by the substituter and sent in the
+// differ request, so both sides rewrite exactly the same way. Only the base is filtered, so
+// there's nothing to undo after expanding.
+
+const refHashLen = 32
+
+var refAlphabet = func() (t [256]bool) {
+	for _, c := range []byte(nixbase32.Alphabet) {
+		t[c] = true
+	}
+	return
+}()
+
+// makeRefRewrites pairs up store paths referenced by the base with those referenced by the
+// request, by name, and returns a map from base hash to request hash for the ones that
+// differ. The base and request themselves are always paired. All arguments are store path
+// basenames ("hash-name").
+func makeRefRewrites(base, req string, baseRefs, reqRefs []string) map[string]string {
+	m := make(map[string]string)
+	add := func(b, r string) {
+		if bh, rh := b[:refHashLen], r[:refHashLen]; bh != rh {
+			m[bh] = rh
+		}
+	}
+	if len(base) > refHashLen && len(req) > refHashLen {
+		add(base, req)
+	}
+
+	// first by full name, then by name without version, only when unambiguous
+	for _, key := range []func(string) string{refName, refPname} {
+		bm, rm := refsByKey(baseRefs, base, key), refsByKey(reqRefs, req, key)
+		for k, b := range bm {
+			if r, ok := rm[k]; ok && b != "" && r != "" {
+				if _, done := m[b[:refHashLen]]; !done {
+					add(b, r)
+				}
+			}
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// refsByKey returns refs by key, with "" for keys that are ambiguous.
+func refsByKey(refs []string, self string, key func(string) string) map[string]string {
+	out := make(map[string]string)
+	for _, r := range refs {
+		if r == self || len(r) <= refHashLen+1 || r[refHashLen] != '-' {
+			continue
+		}
+		k := key(r)
+		if _, ok := out[k]; ok {
+			out[k] = ""
+		} else {
+			out[k] = r
+		}
+	}
+	return out
+}
+
+func refName(r string) string { return r[refHashLen+1:] }
+
+// refPname returns the name up to the version, e.g. "openssl" for "openssl-3.0.12-dev".
+func refPname(r string) string {
+	name := refName(r)
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '-' && name[i+1] >= '0' && name[i+1] <= '9' {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+func checkRefRewrites(m map[string]string) error {
+	for b, r := range m {
+		if len(b) != refHashLen || len(r) != refHashLen ||
+			nixbase32.ValidateString(b) != nil || nixbase32.ValidateString(r) != nil {
+			return fmt.Errorf("bad ref rewrite %q -> %q", b, r)
+		}
+	}
+	return nil
+}
+
+// localRefs returns the references of a local store path, as basenames.
+func localRefs(storePath string) ([]string, error) {
+	cmd := exec.Command(nixBin+"-store", "--query", "--references", storePath)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, l := range strings.Fields(string(out)) {
+		refs = append(refs, path.Base(l))
+	}
+	return refs, nil
+}
+
+// refRewriter replaces hashes in a stream. A hash is any run of 32 characters of the nix
+// base32 alphabet that ends at the current position, scanning left to right and skipping
+// past each replacement, so the result doesn't depend on how reads are split up.
+type refRewriter struct {
+	r   io.Reader
+	m   map[string]string
+	err error
+
+	buf                 []byte
+	start, scanned, end int
+	run                 int
+}
+
+func newRefRewriter(r io.Reader, m map[string]string) *refRewriter {
+	return &refRewriter{r: r, m: m, buf: make([]byte, 128*1024)}
+}
+
+func (rw *refRewriter) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		// bytes before the last partial hash can't change anymore
+		safe := rw.scanned - (refHashLen - 1)
+		if rw.err != nil {
+			safe = rw.end
+		}
+		if safe > rw.start {
+			n := copy(p, rw.buf[rw.start:safe])
+			rw.start += n
+			return n, nil
+		} else if rw.err != nil {
+			return 0, rw.err
+		}
+
+		if rw.start > 0 {
+			copy(rw.buf, rw.buf[rw.start:rw.end])
+			rw.scanned -= rw.start
+			rw.end -= rw.start
+			rw.start = 0
+		}
+		n, err := rw.r.Read(rw.buf[rw.end:])
+		rw.end += n
+		rw.scan()
+		rw.err = err
+	}
+}
+
+func (rw *refRewriter) scan() {
+	for ; rw.scanned < rw.end; rw.scanned++ {
+		if !refAlphabet[rw.buf[rw.scanned]] {
+			rw.run = 0
+			continue
+		}
+		rw.run++
+		if rw.run >= refHashLen {
+			w := rw.buf[rw.scanned+1-refHashLen : rw.scanned+1]
+			if r, ok := rw.m[string(w)]; ok {
+				copy(w, r)
+				rw.run = 0
+			}
+		}
+	}
+}
+
+// Close closes the underlying reader if it can be closed.
+func (rw *refRewriter) Close() error {
+	if c, ok := rw.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
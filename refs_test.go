@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+const (
+	hashA = "00000000000000000000000000000000"
+	hashB = "11111111111111111111111111111111"
+	hashC = "22222222222222222222222222222222"
+	hashD = "33333333333333333333333333333333"
+	hashE = "44444444444444444444444444444444"
+	hashF = "55555555555555555555555555555555"
+)
+
+func TestMakeRefRewrites(t *testing.T) {
+	for _, c := range []struct {
+		base, req         string
+		baseRefs, reqRefs []string
+		exp               map[string]string
+	}{
+		{
+			hashA + "-foo-1.0", hashB + "-foo-1.0",
+			[]string{hashA + "-foo-1.0", hashC + "-glibc-2.38"},
+			[]string{hashB + "-foo-1.0", hashD + "-glibc-2.38"},
+			map[string]string{hashA: hashB, hashC: hashD},
+		},
+		{
+			// version changes are matched by name
+			hashA + "-foo-1.0", hashB + "-foo-1.1",
+			[]string{hashC + "-openssl-3.0.12", hashE + "-zlib-1.3"},
+			[]string{hashD + "-openssl-3.0.13", hashE + "-zlib-1.3"},
+			map[string]string{hashA: hashB, hashC: hashD},
+		},
+		{
+			// ambiguous names are left alone
+			hashA + "-foo-1.0", hashB + "-foo-1.0",
+			[]string{hashC + "-python3-3.11", hashE + "-python3-3.12"},
+			[]string{hashD + "-python3-3.11.1", hashF + "-python3-3.12.1"},
+			map[string]string{hashA: hashB},
+		},
+		{
+			hashA + "-foo-1.0", hashA + "-foo-1.0",
+			[]string{hashC + "-bar"},
+			[]string{hashC + "-bar"},
+			nil,
+		},
+	} {
+		if got := makeRefRewrites(c.base, c.req, c.baseRefs, c.reqRefs); !reflect.DeepEqual(got, c.exp) {
+			t.Errorf("%s: got %v, expected %v", c.req, got, c.exp)
+		}
+	}
+}
+
+// naiveRewrite is a simple version of refRewriter to compare against.
+func naiveRewrite(b []byte, m map[string]string) []byte {
+	b = append([]byte{}, b...)
+	run := 0
+	for i := range b {
+		if !refAlphabet[b[i]] {
+			run = 0
+			continue
+		}
+		run++
+		if run >= refHashLen {
+			if r, ok := m[string(b[i+1-refHashLen:i+1])]; ok {
+				copy(b[i+1-refHashLen:], r)
+				run = 0
+			}
+		}
+	}
+	return b
+}
+
+func TestRefRewriter(t *testing.T) {
+	m := map[string]string{hashA: hashB, hashB: hashC, hashD: hashE}
+	r := rand.New(rand.NewSource(1))
+	var data []byte
+	for len(data) < 1000000 {
+		switch r.Intn(6) {
+		case 0:
+			data = append(data, "/nix/store/"+hashA+"-foo"...)
+		case 1:
+			data = append(data, hashB...) // chained in the map, but should only be replaced once
+		case 2:
+			data = append(data, "x"+hashD+hashD...)
+		default:
+			junk := make([]byte, r.Intn(200000))
+			r.Read(junk)
+			data = append(data, junk...)
+		}
+	}
+	exp := naiveRewrite(data, m)
+	if bytes.Equal(exp, data) {
+		t.Fatal("nothing rewritten")
+	}
+
+	for _, wrap := range []func(io.Reader) io.Reader{
+		func(r io.Reader) io.Reader { return r },
+		iotest.OneByteReader,
+		iotest.HalfReader,
+		iotest.DataErrReader,
+	} {
+		out, err := io.ReadAll(newRefRewriter(wrap(bytes.NewReader(data)), m))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(out, exp) {
+			t.Error("mismatch")
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type (
+	// storeNar presents a store path as a NAR with random access, without serializing it
+	// first. It keeps the NAR framing in memory and reads file contents from the store on
+	// demand.
+	storeNar struct {
+		segs []narSeg
+		size int64
+
+		lock sync.Mutex
+		f    *os.File // last opened file
+		fseg int
+	}
+
+	// narSeg is either literal framing bytes or the contents of a file.
+	narSeg struct {
+		off  int64
+		lit  []byte
+		path string
+		size int64
+	}
+)
+
+var errStoreNarChanged = errors.New("store path changed while reading")
+
+// newStoreNar builds an index of the NAR serialization of path.
+func newStoreNar(path string) (*storeNar, error) {
+	b := &storeNarBuilder{}
+	b.str("nix-archive-1")
+	if err := b.node(path); err != nil {
+		return nil, err
+	}
+	b.flush()
+	return &storeNar{segs: b.segs, size: b.off, fseg: -1}, nil
+}
+
+func (n *storeNar) Size() int64 { return n.size }
+
+func (n *storeNar) ReadAt(p []byte, off int64) (int, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	} else if off >= n.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(n.segs), func(i int) bool { return n.segs[i].off > off }) - 1
+	total := 0
+	for len(p) > 0 && i < len(n.segs) {
+		seg := &n.segs[i]
+		segOff := off - seg.off
+		var c int
+		if seg.lit != nil {
+			c = copy(p, seg.lit[segOff:])
+		} else {
+			f, err := n.open(i)
+			if err != nil {
+				return total, err
+			}
+			c, err = f.ReadAt(p[:min(int64(len(p)), seg.size-segOff)], segOff)
+			if err == io.EOF {
+				return total + c, errStoreNarChanged
+			} else if err != nil {
+				return total + c, err
+			}
+		}
+		p = p[c:]
+		off += int64(c)
+		total += c
+		i++
+	}
+	if len(p) > 0 {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+func (n *storeNar) open(i int) (*os.File, error) {
+	if n.fseg == i {
+		return n.f, nil
+	} else if n.f != nil {
+		n.f.Close()
+		n.f, n.fseg = nil, -1
+	}
+	f, err := os.Open(n.segs[i].path)
+	if err != nil {
+		return nil, err
+	}
+	n.f, n.fseg = f, i
+	return f, nil
+}
+
+func (n *storeNar) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.f != nil {
+		n.f.Close()
+		n.f, n.fseg = nil, -1
+	}
+	return nil
+}
+
+type storeNarBuilder struct {
+	segs []narSeg
+	lit  []byte
+	off  int64
+}
+
+func (b *storeNarBuilder) flush() {
+	if len(b.lit) > 0 {
+		b.segs = append(b.segs, narSeg{off: b.off, lit: b.lit})
+		b.off += int64(len(b.lit))
+		b.lit = nil
+	}
+}
+
+func (b *storeNarBuilder) int(v int64) {
+	b.lit = binary.LittleEndian.AppendUint64(b.lit, uint64(v))
+}
+
+func (b *storeNarBuilder) pad(l int64) {
+	for ; l%8 != 0; l++ {
+		b.lit = append(b.lit, 0)
+	}
+}
+
+func (b *storeNarBuilder) str(s string) {
+	b.int(int64(len(s)))
+	b.lit = append(b.lit, s...)
+	b.pad(int64(len(s)))
+}
+
+func (b *storeNarBuilder) node(path string) error {
+	st, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	b.str("(")
+	b.str("type")
+	switch mode := st.Mode(); {
+	case mode.IsRegular():
+		b.str("regular")
+		if mode&0100 != 0 {
+			b.str("executable")
+			b.str("")
+		}
+		b.str("contents")
+		b.int(st.Size())
+		if st.Size() > 0 {
+			b.flush()
+			b.segs = append(b.segs, narSeg{off: b.off, path: path, size: st.Size()})
+			b.off += st.Size()
+		}
+		b.pad(st.Size())
+	case mode&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		b.str("symlink")
+		b.str("target")
+		b.str(target)
+	case mode.IsDir():
+		b.str("directory")
+		// ReadDir sorts by name, which matches nix
+		ents, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, ent := range ents {
+			b.str("entry")
+			b.str("(")
+			b.str("name")
+			b.str(ent.Name())
+			b.str("node")
+			if err := b.node(filepath.Join(path, ent.Name())); err != nil {
+				return err
+			}
+			b.str(")")
+		}
+	default:
+		return fmt.Errorf("unsupported file type %s at %s", mode.Type(), path)
+	}
+	b.str(")")
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+func TestStoreNar(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "bin"), 0755)
+	os.MkdirAll(filepath.Join(root, "share/empty"), 0755)
+	os.WriteFile(filepath.Join(root, "bin/prog"), bytes.Repeat([]byte("elf"), 10001), 0755)
+	os.WriteFile(filepath.Join(root, "share/data"), []byte("some data"), 0644)
+	os.WriteFile(filepath.Join(root, "share/Zero"), nil, 0644)
+	os.Symlink("../bin/prog", filepath.Join(root, "share/link"))
+	os.WriteFile(filepath.Join(dir, "file"), []byte("just a file"), 0644)
+	os.Symlink("/nix/store/abc", filepath.Join(dir, "link"))
+
+	for _, p := range []string{root, filepath.Join(dir, "file"), filepath.Join(dir, "link")} {
+		var exp bytes.Buffer
+		if err := nar.DumpPath(&exp, p); err != nil {
+			t.Fatal(err)
+		}
+		sn, err := newStoreNar(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sn.Size() != int64(exp.Len()) {
+			t.Fatal(p, "size", sn.Size(), exp.Len())
+		}
+		all, err := io.ReadAll(io.NewSectionReader(sn, 0, sn.Size()))
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(all, exp.Bytes()) {
+			t.Fatal(p, "contents differ")
+		}
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 100; i++ {
+			off := r.Int63n(sn.Size())
+			buf := make([]byte, r.Int63n(sn.Size()-off)+1)
+			if _, err := sn.ReadAt(buf, off); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(buf, all[off:off+int64(len(buf))]) {
+				t.Fatal(p, "ReadAt differs at", off, len(buf))
+			}
+		}
+		if _, err := sn.ReadAt(make([]byte, 2), sn.Size()-1); err != io.EOF {
+			t.Error("expected EOF", err)
+		}
+		if _, err := sn.ReadAt(make([]byte, 2), sn.Size()+10); err != io.EOF {
+			t.Error("expected EOF past end", err)
+		}
+		sn.Close()
+	}
+}
@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"mime"
 	"mime/multipart"
 	"net/http"
@@ -43,6 +46,20 @@ type (
 		nsem    *semaphore.Weighted
 		lastReq atomic.Int64
 
+		psem      *semaphore.Weighted
+		pfMemSem  *semaphore.Weighted
+		pfDiskSem *semaphore.Weighted
+		pfQueue   chan *recent
+		noBatch   atomic.Bool // differ doesn't support batch requests
+		// nar filters the differ supports, nil until we've heard from it
+		differFilters atomic.Pointer[[]string]
+
+		infoLock  sync.Mutex
+		info      *differInfo   // from the differ, nil if we don't have it
+		infoOld   bool          // the differ is older than info requests
+		infoTime  time.Time     // when we last got an answer
+		infoFetch chan struct{} // closed when the running fetch is done
+
 		analytics *os.File
 
 		recents     *lru.Cache
@@ -50,21 +67,34 @@ type (
 	}
 
 	recent struct {
-		id      string
-		request differRequest
-		stats   *DiffStats
+		id       string
+		request  differRequest
+		stats    *DiffStats
+		fileSize int64     // compressed size from upstream
+		narHash  string    // from the narinfo, in narinfo format
+		pf       *prefetch // nil if not prefetching
+
+		chunkBases []string // non-nil to use chunk transfer instead of a diff
 	}
 )
 
 func newLocalSubstituter(cfg *config, catalog *catalog) *subst {
-	return &subst{
+	s := &subst{
 		cfg:       cfg,
 		catalog:   catalog,
 		analytics: openAnalyticsLog(cfg.AnalyticsFile),
 		recents:   lru.New(10000),
 		nisem:     semaphore.NewWeighted(40),
 		nsem:      semaphore.NewWeighted(20),
+		psem:      semaphore.NewWeighted(20),
+		pfMemSem:  semaphore.NewWeighted(cfg.PrefetchMemBytes),
+		pfDiskSem: semaphore.NewWeighted(cfg.PrefetchDiskBytes),
+		pfQueue:   make(chan *recent, 1000),
 	}
+	if cfg.PrefetchMemBytes > 0 || cfg.PrefetchDiskBytes > 0 {
+		go s.prefetchBatcher()
+	}
+	return s
 }
 
 func (s *subst) serve() error {
@@ -155,57 +185,138 @@ func (s *subst) getNar(w http.ResponseWriter, r *http.Request) (int, string, err
 }
 
 func (s *subst) getNarCommon(ctx context.Context, recent *recent, w io.Writer) (int, string, error) {
-	// make diff request
-	buf, err := json.Marshal(recent.request)
+	if recent.chunkBases != nil {
+		return s.chunkTransfer(ctx, recent, w)
+	}
+
+	var body io.ReadCloser
+	var contentType string
+	if pf := recent.pf; pf != nil && pf.claim() {
+		defer pf.free()
+		select {
+		case <-pf.done:
+		case <-ctx.Done():
+			return http.StatusInternalServerError, "canceled", nil
+		}
+		if pf.err == nil {
+			body, contentType = pf.reader(), pf.contentType
+		} else if pf.err == errNotWorthIt {
+			return s.fallbackDirect(ctx, recent, w, fallbackNotWorthIt)
+		} else {
+			log.Print("prefetch error for ", recent.request.ReqName, ": ", pf.err)
+		}
+	}
+
+	if body == nil {
+		res, status, msg, err := s.requestDiff(ctx, &recent.request)
+		if status == differStatusNotWorthIt {
+			return s.fallbackDirect(ctx, recent, w, fallbackNotWorthIt)
+		} else if err != nil || status != 0 {
+			return status, msg, err
+		}
+		body, contentType = res.Body, res.Header.Get("Content-Type")
+	}
+	defer body.Close()
+
+	return s.expandDiff(ctx, recent, body, contentType, w)
+}
+
+// writeDiffFailed records a diff that we got from the differ but couldn't use.
+func (s *subst) writeDiffFailed(recent *recent, code string) {
+	s.writeAnalytics(AnRecord{
+		D: &AnDiff{
+			Id:     recent.id,
+			Failed: code,
+		},
+	})
+}
+
+// fallbackDirect downloads the requested nar from upstream and decompresses it, for when the
+// differ decided a delta isn't worth it, or we don't have enough chunks locally.
+func (s *subst) fallbackDirect(ctx context.Context, recent *recent, w io.Writer, reason string) (int, string, error) {
+	u := url.URL{Scheme: "https", Host: recent.request.Upstream, Path: "/" + recent.request.ReqNarPath}
+	ns, err := streamNar(u.String(), nil)
 	if err != nil {
-		return http.StatusInternalServerError, "json marshal error", err
+		return http.StatusInternalServerError, "upstream nar error", err
+	}
+	copyErr := ioCopy(w, ns, nil, recent.request.ReqNarSize)
+	if err = ns.Close(); err != nil {
+		return http.StatusInternalServerError, "upstream nar decompress error", err
+	} else if copyErr != nil {
+		return http.StatusInternalServerError, "upstream nar copy error", copyErr
 	}
-	u := makeDifferUrl(s.cfg.Differ)
+
+	s.writeAnalytics(AnRecord{
+		D: &AnDiff{
+			Id:       recent.id,
+			Fallback: reason,
+		},
+	})
+
+	return 0, reason + ", downloaded directly", nil
+}
+
+// requestDiff makes a diff request to the differ. On success, the caller must close the
+// response body.
+func (s *subst) requestDiff(ctx context.Context, req *differRequest) (*http.Response, int, string, error) {
+	return s.postDiffer(ctx, differPath, req)
+}
+
+// postDiffer posts a json request to the differ at path. On success, the caller must close
+// the response body.
+func (s *subst) postDiffer(ctx context.Context, path string, req any) (*http.Response, int, string, error) {
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return nil, http.StatusInternalServerError, "json marshal error", err
+	}
+	u := makeDifferUrl(s.cfg.Differ, path)
 	postReq, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(buf))
 	if err != nil {
-		return http.StatusInternalServerError, "create req", err
+		return nil, http.StatusInternalServerError, "create req", err
 	}
 	postReq.Header.Set("Content-Type", "application/json")
 	res, err := http.DefaultClient.Do(postReq)
 	if err != nil {
-		return http.StatusInternalServerError, "differ http error", err
+		return nil, http.StatusInternalServerError, "differ http error", err
+	}
+	if filters := res.Header.Get(differNarFiltersHeader); filters != "" {
+		supported := strings.Split(filters, ",")
+		s.differFilters.Store(&supported)
 	}
-	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
 		// TODO: on some/most errors, fall back to proxying from upstream cache directly
-		return res.StatusCode, "differ http status", errors.New(res.Status)
+		return nil, res.StatusCode, "differ http status", errors.New(res.Status)
 	}
+	return res, 0, "", nil
+}
 
+func (s *subst) expandDiff(ctx context.Context, recent *recent, body io.Reader, contentType string, w io.Writer) (int, string, error) {
 	// parse multipart
-	boundary, err := getBoundary(res)
+	boundary, err := getBoundary(contentType)
 	if err != nil {
 		return http.StatusInternalServerError, "parse multipart", err
 	}
-	mpr := multipart.NewReader(res.Body, boundary)
+	mpr := multipart.NewReader(body, boundary)
 
 	// read header
-	hr, err := mpr.NextPart()
 	var h differHeader
-	if err != nil {
+	if err = readDifferJson(mpr, differHeaderName, &h); err != nil {
+		return http.StatusInternalServerError, "parse multipart header", err
+	} else if err = checkDifferProtocol(h.Protocol); err != nil {
 		return http.StatusInternalServerError, "parse multipart header", err
-	} else if hr.FormName() != differHeaderName {
-		return http.StatusInternalServerError, "parse multipart header wrong name", nil
-	} else if err = json.NewDecoder(hr).Decode(&h); err != nil {
-		return http.StatusInternalServerError, "parse multipart header json", err
 	}
 
-	algo := getAlgo(h.Algo)
+	algo := getExpandAlgo(h.Algo)
 	if algo == nil {
 		return http.StatusInternalServerError, "unknown algo", nil
 	}
 
 	// set up for reading body
-	br, err := mpr.NextRawPart()
+	br, err := readDifferBody(mpr)
 	if err != nil {
 		return http.StatusInternalServerError, "parse multipart body", err
-	} else if br.FormName() != differBodyName {
-		return http.StatusInternalServerError, "parse multipart body wrong name", nil
 	}
 
 	// get base nar
@@ -213,26 +324,50 @@ func (s *subst) getNarCommon(ctx context.Context, recent *recent, w io.Writer) (
 	procCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	writeNar := exec.CommandContext(procCtx, nixBin+"-store", "--dump", recent.request.BaseStorePath)
-	var basePipe io.Reader
-	basePipe, err = writeNar.StdoutPipe()
+	filters, err := getNarFilter(s.cfg, &recent.request)
 	if err != nil {
-		return http.StatusInternalServerError, "pipe error", err
+		return http.StatusInternalServerError, "nar filter error", err
 	}
-	writeNar.Stderr = os.Stderr
-	err = writeNar.Start()
-	if err != nil {
-		return http.StatusInternalServerError, "base dump error", err
+
+	var basePipe io.Reader
+	var baseNar *storeNar
+	waitBase := func() error { return nil }
+	if filters.base == nil {
+		// read directly from the store so algos can seek in it
+		if baseNar, err = newStoreNar(recent.request.BaseStorePath); err != nil {
+			log.Printf("can't index %s, using nix-store --dump: %v", recent.request.BaseStorePath, err)
+			baseNar = nil
+		} else {
+			defer baseNar.Close()
+			basePipe = io.NewSectionReader(baseNar, 0, baseNar.Size())
+		}
+	}
+	if basePipe == nil {
+		writeNar := exec.CommandContext(procCtx, nixBin+"-store", "--dump", recent.request.BaseStorePath)
+		basePipe, err = writeNar.StdoutPipe()
+		if err != nil {
+			return http.StatusInternalServerError, "pipe error", err
+		}
+		writeNar.Stderr = os.Stderr
+		err = writeNar.Start()
+		if err != nil {
+			return http.StatusInternalServerError, "base dump error", err
+		}
+		defer writeNar.Wait()
+		waitBase = writeNar.Wait
 	}
-	defer writeNar.Wait()
 
-	expFilter, colFilter := getNarFilter(s.cfg, &recent.request)
-	if expFilter != nil {
-		basePipe = expFilter(basePipe)
+	if baseFilter := filters.base; baseFilter != nil {
+		basePipe = baseFilter(basePipe)
 	}
+	// hash what we get and what we make, to check against the trailer and narinfo
+	deltaHash := sha256.New()
+	delta := io.TeeReader(br, deltaHash)
+	check := newNarCheckWriter(w, recent.request.ReqNarSize)
+	w = check
 	output := w
 	filterErrCh := make(chan error, 1)
-	if colFilter == nil {
+	if colFilter := filters.col; colFilter == nil {
 		filterErrCh <- nil
 	} else {
 		filtR, filtW := io.Pipe()
@@ -241,39 +376,59 @@ func (s *subst) getNarCommon(ctx context.Context, recent *recent, w io.Writer) (
 	}
 
 	// run algo
-	expandStats, err := algo.Expand(procCtx, ExpandArgs{
+	args := ExpandArgs{
 		Base:   basePipe,
-		Delta:  br,
+		Delta:  delta,
 		Output: output,
-	})
+	}
+	if baseNar != nil {
+		args.BaseAt, args.BaseSize = baseNar, baseNar.Size()
+	}
+	expandStats, algoErr := algo.Expand(procCtx, args)
+
+	// read the rest of the body so the hash covers all of it (even if the algo failed, so we
+	// can tell why), then the trailer
+	var t differTrailer
+	_, err = io.Copy(io.Discard, delta)
+	if err == nil {
+		err = readDifferJson(mpr, differTrailerName, &t)
+	}
+	if err == nil {
+		err = readDifferEnd(mpr)
+	}
 	if err != nil {
-		return http.StatusInternalServerError, "diff algo error", err
+		if ctx.Err() == nil {
+			// truncated or mangled on the way here
+			s.writeDiffFailed(recent, failedCorrupt)
+		}
+		return http.StatusInternalServerError, "parse multipart trailer", err
+	} else if !t.Ok {
+		return http.StatusInternalServerError, "", fmt.Errorf("trailer ok false: %s", t.Error)
+	} else if got := nixHashString(deltaHash); t.DeltaHash != "" && got != t.DeltaHash {
+		s.writeDiffFailed(recent, failedCorrupt)
+		return http.StatusInternalServerError, "delta corrupted in transport", fmt.Errorf("%w: got %s, expected %s", errDeltaCorrupt, got, t.DeltaHash)
+	} else if algoErr != nil {
+		if ctx.Err() == nil {
+			s.writeDiffFailed(recent, failedAlgo)
+		}
+		return http.StatusInternalServerError, "diff algo error", algoErr
 	}
 
 	filterErr := <-filterErrCh
 
 	// this should also be done now
-	if err = writeNar.Wait(); err != nil {
+	if err = waitBase(); err != nil {
 		return http.StatusInternalServerError, "base dump error", err
 	} else if filterErr != nil {
+		if ctx.Err() == nil {
+			s.writeDiffFailed(recent, failedAlgo)
+		}
 		return http.StatusInternalServerError, "nar filter error", filterErr
-	}
-
-	// read trailer
-	tr, err := mpr.NextPart()
-	var t differTrailer
-	if err != nil {
-		return http.StatusInternalServerError, "parse multipart trailer", err
-	} else if tr.FormName() != differTrailerName {
-		return http.StatusInternalServerError, "parse multipart trailer wrong name", nil
-	} else if err = json.NewDecoder(tr).Decode(&t); err != nil {
-		return http.StatusInternalServerError, "parse multipart trailer json", err
-	} else if _, err = mpr.NextPart(); err != io.EOF {
-		return http.StatusInternalServerError, "parse multipart trailing parts", nil
-	}
-
-	if !t.Ok {
-		return http.StatusInternalServerError, "", errors.New("trailer ok false")
+	} else if err = check.finish(recent.narHash, t.NarHash); err != nil {
+		if errors.Is(err, errNarHashMismatch) {
+			s.writeDiffFailed(recent, failedAlgo)
+		}
+		return http.StatusInternalServerError, "expanded nar mismatch", err
 	}
 
 	recent.stats = t.Stats.nonnil()
@@ -291,6 +446,52 @@ func (s *subst) getNarCommon(ctx context.Context, recent *recent, w io.Writer) (
 	return 0, recent.stats.String(), nil
 }
 
+// narCheckWriter hashes an expanded nar as it passes through to w, holding back the end of
+// it until finish checks the hash, so nix never gets a whole nar that doesn't match.
+type narCheckWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64 // expected size, or 0 if unknown
+	n    int64
+	tail []byte
+}
+
+// how much of the end of the nar to hold back. any truncation makes the nar unparseable.
+const narCheckHoldBack = 4096
+
+func newNarCheckWriter(w io.Writer, size int64) *narCheckWriter {
+	return &narCheckWriter{w: w, hash: sha256.New(), size: size}
+}
+
+func (c *narCheckWriter) Write(p []byte) (int, error) {
+	if c.size > 0 && c.n+int64(len(p)) > c.size {
+		return 0, fmt.Errorf("%w: longer than %d bytes", errNarHashMismatch, c.size)
+	}
+	c.n += int64(len(p))
+	c.hash.Write(p)
+	c.tail = append(c.tail, p...)
+	if over := len(c.tail) - narCheckHoldBack; over > 0 {
+		if _, err := c.w.Write(c.tail[:over]); err != nil {
+			return 0, err
+		}
+		c.tail = c.tail[:copy(c.tail, c.tail[over:])]
+	}
+	return len(p), nil
+}
+
+// finish checks the hash of everything written against each non-empty hash in exp, and writes
+// out the rest of the nar if they all match.
+func (c *narCheckWriter) finish(exp ...string) error {
+	got := nixHashString(c.hash)
+	for _, e := range exp {
+		if e != "" && got != e {
+			return fmt.Errorf("%w: got %s, expected %s", errNarHashMismatch, got, e)
+		}
+	}
+	_, err := c.w.Write(c.tail)
+	return err
+}
+
 func (s *subst) getNarInfo(w http.ResponseWriter, r *http.Request) (int, string, error) {
 	if r.Method != "GET" && r.Method != "HEAD" {
 		return http.StatusMethodNotAllowed, "", nil
@@ -353,9 +554,14 @@ func (s *subst) getNarInfoCommon(
 	if err != nil {
 		return nil, http.StatusInternalServerError, "nixpath parse error", err
 	}
-	if int(ni.FileSize) < s.cfg.MinFileSize || int(ni.FileSize) > s.cfg.MaxFileSize || int(ni.NarSize) > s.cfg.MaxNarSize {
+	maxNarSize := s.cfg.MaxNarSize
+	info, infoOld := s.getDifferInfo()
+	if info != nil && info.MaxNarSize > 0 && info.MaxNarSize < int64(maxNarSize) {
+		maxNarSize = int(info.MaxNarSize)
+	}
+	if int(ni.FileSize) < s.cfg.MinFileSize || int(ni.FileSize) > s.cfg.MaxFileSize || int(ni.NarSize) > maxNarSize {
 		code := failedTooSmall
-		if int(ni.FileSize) > s.cfg.MaxFileSize || int(ni.NarSize) > s.cfg.MaxNarSize {
+		if int(ni.FileSize) > s.cfg.MaxFileSize || int(ni.NarSize) > maxNarSize {
 			code = failedTooBig
 		}
 		s.writeAnalytics(AnRecord{
@@ -374,6 +580,12 @@ func (s *subst) getNarInfoCommon(
 
 	// see if we have any reasonable base
 	base, err := s.catalog.findBase(ni, np.Name)
+	if err != nil && s.cfg.ChunkMinNarSize > 0 && int64(ni.NarSize) >= s.cfg.ChunkMinNarSize {
+		// no single good base, but related paths might still share a lot of content
+		if bases := s.catalog.findChunkBases(ni, np.Name); len(bases) > 0 {
+			return s.setupChunkTransfer(reqid, ni, np, bases, w)
+		}
+	}
 	if err != nil || base.storePath[11:43] == hash {
 		code := failedNoBase
 		if err == nil && base.storePath[11:43] == hash {
@@ -393,24 +605,49 @@ func (s *subst) getNarInfoCommon(
 		return nil, http.StatusNotFound, "", err
 	}
 
+	narFilter := base.narFilter
+	var rewrites map[string]string
+	if s.cfg.RewriteRefs {
+		if rewrites = s.getRefRewrites(base.storePath, ni); rewrites != nil {
+			if narFilter != "" {
+				narFilter += ","
+			}
+			narFilter += narFilterRefs
+		}
+	}
+	narFilter, rewrites = s.limitRequestFilters(narFilter, rewrites, info, infoOld)
+
 	// new url for uncompressed nar
 	newUrl := "nar/" + strings.TrimPrefix(ni.NarHash.NixString(), "sha256:") + ".nar"
 
 	// record this for nar serving
 	recent := &recent{
-		id: reqid,
+		id:       reqid,
+		fileSize: int64(ni.FileSize),
+		narHash:  ni.NarHash.NixString(),
 		request: differRequest{
+			Protocol:      differProtocolVersion,
 			ReqNarPath:    ni.URL,
 			BaseStorePath: base.storePath,
-			AcceptAlgos:   strings.Split(s.cfg.DiffAlgo, ","),
-			NarFilter:     base.narFilter,
+			AcceptAlgos:   limitAlgos(strings.Split(s.cfg.DiffAlgo, ","), info),
+			NarFilter:     narFilter,
+			RefRewrites:   rewrites,
 			Upstream:      s.cfg.Upstream,
 
 			BaseNarSize: base.narSize,
 			ReqNarSize:  int64(ni.NarSize),
+			ReqFileSize: int64(ni.FileSize),
 			ReqName:     np.Name,
 		},
 	}
+	if w != nil {
+		// only prefetch for real requests, simulation asks for the nar right away
+		recent.pf = s.newPrefetch(recent)
+	}
+	if s.cfg.RaceAlgos != "" && int(ni.FileSize) >= s.cfg.RaceMinFileSize {
+		// big enough that bandwidth matters more than differ cpu
+		recent.request.RaceAlgos = limitAlgos(strings.Split(s.cfg.RaceAlgos, ","), info)
+	}
 	s.putRecent(path.Base(newUrl), recent)
 
 	// set up narinfo with new path
@@ -424,6 +661,9 @@ func (s *subst) getNarInfoCommon(
 		w.Header().Add("Content-Type", ni.ContentType())
 		w.Write([]byte(ni.String()))
 	}
+	if recent.pf != nil {
+		s.queuePrefetch(recent)
+	}
 
 	s.writeAnalytics(AnRecord{
 		R: &AnRequest{
@@ -439,6 +679,87 @@ func (s *subst) getNarInfoCommon(
 	return recent, 0, "", nil
 }
 
+// limitRequestFilters limits a filter chain to what the differ can handle, and drops the
+// rewrites if that leaves out the refs filter.
+func (s *subst) limitRequestFilters(narFilter string, rewrites map[string]string, info *differInfo, infoOld bool) (string, map[string]string) {
+	supported := s.differFilters.Load()
+	if supported == nil && infoOld {
+		// it would ignore filters it doesn't know and diff the raw nars
+		supported = &baselineNarFilters
+	}
+	if supported != nil {
+		narFilter = limitNarFilter(narFilter, *supported)
+	}
+	if info != nil {
+		// we'd recompress with different compressors than the differ checked against
+		narFilter = limitExpandToCodecs(narFilter, info)
+	}
+	if !hasNarFilter(&differRequest{NarFilter: narFilter}, narFilterRefs) {
+		rewrites = nil
+	}
+	return narFilter, rewrites
+}
+
+// getRefRewrites returns hash rewrites for the refs filter, or nil if there's nothing to
+// rewrite or we can't tell.
+func (s *subst) getRefRewrites(baseStorePath string, ni *narinfo.NarInfo) map[string]string {
+	baseRefs, err := localRefs(baseStorePath)
+	if err != nil {
+		log.Print("can't get references of ", baseStorePath, ": ", err)
+		return nil
+	}
+	return makeRefRewrites(path.Base(baseStorePath), path.Base(ni.StorePath), baseRefs, ni.References)
+}
+
+// setupChunkTransfer records a recent that will be served with chunk transfer and writes
+// the rewritten narinfo.
+func (s *subst) setupChunkTransfer(
+	reqid string,
+	ni *narinfo.NarInfo,
+	np *nixpath.NixPath,
+	bases []string,
+	w http.ResponseWriter,
+) (*recent, int, string, error) {
+	newUrl := "nar/" + strings.TrimPrefix(ni.NarHash.NixString(), "sha256:") + ".nar"
+	recent := &recent{
+		id:       reqid,
+		fileSize: int64(ni.FileSize),
+		narHash:  ni.NarHash.NixString(),
+		request: differRequest{
+			ReqNarPath: ni.URL,
+			Upstream:   s.cfg.Upstream,
+			ReqNarSize: int64(ni.NarSize),
+			ReqName:    np.Name,
+		},
+		chunkBases: bases,
+	}
+	s.putRecent(path.Base(newUrl), recent)
+
+	origFileSize := ni.FileSize
+	ni.URL = newUrl
+	ni.Compression = "none"
+	ni.FileHash = ni.NarHash
+	ni.FileSize = ni.NarSize
+
+	if w != nil {
+		w.Header().Add("Content-Type", ni.ContentType())
+		w.Write([]byte(ni.String()))
+	}
+
+	s.writeAnalytics(AnRecord{
+		R: &AnRequest{
+			Id:            reqid,
+			ReqStorePath:  ni.StorePath[len(nixpath.StoreDir)+1:],
+			BaseStorePath: bases[0][len(nixpath.StoreDir)+1:],
+			NarSize:       ni.NarSize,
+			FileSize:      origFileSize,
+			DifferRequest: &recent.request,
+		},
+	})
+
+	return recent, 0, "", nil
+}
+
 func (s *subst) request(ctx context.Context, req string) (*DiffStats, error) {
 	// req should be store name (without /nix/store)
 	hash, _, _ := strings.Cut(req, "-")
@@ -510,8 +831,8 @@ func newId() string {
 	return base64.RawStdEncoding.EncodeToString(b)
 }
 
-func getBoundary(res *http.Response) (string, error) {
-	mt, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+func getBoundary(contentType string) (string, error) {
+	mt, params, err := mime.ParseMediaType(contentType)
 	if err != nil {
 		return "", err
 	} else if mt != "multipart/form-data" {
@@ -529,19 +850,19 @@ func isNotFound(code int) bool {
 		code == http.StatusForbidden
 }
 
-func makeDifferUrl(d string) string {
+func makeDifferUrl(d, p string) string {
 	if strings.HasPrefix(d, "http://") || strings.HasPrefix(d, "https://") {
 		u, err := url.Parse(d)
 		if err != nil {
 			panic(err)
 		}
-		u.Path = differPath
+		u.Path = p
 		return u.String()
 	}
 	u := url.URL{
 		Scheme: "https",
 		Host:   d,
-		Path:   differPath,
+		Path:   p,
 	}
 	return u.String()
 }
@@ -198,15 +198,39 @@ func (s *sysChecker) localPresence(storeName string) (presenceFunc, any) {
 
 // arg should be store name (without /nix/store/)
 func (s *sysChecker) listingPresence(storeName string) (presenceFunc, any) {
-	s.reqSem.Acquire(context.Background(), 1)
+	root := s.getListing(context.Background(), storeName)
+	if root == nil {
+		return nil, nil
+	}
+	return func(p string) nar.NodeType {
+		node := &root.Root
+		for _, part := range strings.Split(p, "/") {
+			node = node.Entries[part]
+			if node == nil {
+				return TypeNone
+			}
+		}
+		return node.Type
+	}, fmt.Sprintf("narinfo %s", storeName)
+}
+
+// getListing returns the upstream listing of a store path, or nil if it can't get one.
+// arg should be store name (without /nix/store/)
+func (s *sysChecker) getListing(ctx context.Context, storeName string) *ls.Root {
+	if err := s.reqSem.Acquire(ctx, 1); err != nil {
+		return nil
+	}
 	defer s.reqSem.Release(1)
 
 	storeHash := storeName[:32]
-	res, err := s.makeListRequest(storeHash)
+	res, err := s.makeListRequest(ctx, storeHash)
 	if err != nil {
-		return nil, nil
+		return nil
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil
+	}
 
 	r := res.Body
 	switch res.Header.Get("content-encoding") {
@@ -216,27 +240,18 @@ func (s *sysChecker) listingPresence(storeName string) (presenceFunc, any) {
 
 	root, err := ls.ParseLS(r)
 	if err != nil {
-		return nil, nil
+		return nil
 	}
-	return func(p string) nar.NodeType {
-		node := &root.Root
-		for _, part := range strings.Split(p, "/") {
-			node = node.Entries[part]
-			if node == nil {
-				return TypeNone
-			}
-		}
-		return node.Type
-	}, fmt.Sprintf("narinfo %s", storeName)
+	return root
 }
 
-func (s *sysChecker) makeListRequest(storeHash string) (*http.Response, error) {
+func (s *sysChecker) makeListRequest(ctx context.Context, storeHash string) (*http.Response, error) {
 	u := url.URL{
 		Scheme: "https",
 		Host:   s.cfg.Upstream,
 		Path:   "/" + storeHash + ".ls",
 	}
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
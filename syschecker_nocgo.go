@@ -2,7 +2,12 @@
 
 package main
 
-import "github.com/nix-community/go-nix/pkg/narinfo"
+import (
+	"context"
+
+	"github.com/nix-community/go-nix/pkg/nar/ls"
+	"github.com/nix-community/go-nix/pkg/narinfo"
+)
 
 type (
 	sysType          int32
@@ -25,3 +30,6 @@ func (s *sysChecker) getSysFromStorePathBatch(storePaths []string) (outs []sysCh
 func (s *sysChecker) getSysFromNarInfo(ni *narinfo.NarInfo) sysType {
 	panic("syschecker disabled without cgo")
 }
+func (s *sysChecker) getListing(ctx context.Context, storeName string) *ls.Root {
+	panic("syschecker disabled without cgo")
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"hash"
 	"io"
 
+	"github.com/nix-community/go-nix/pkg/nixbase32"
 	"golang.org/x/exp/constraints"
 )
 
@@ -43,3 +45,8 @@ func ioCopy(dst io.Writer, src io.Reader, buf []byte, expected int64) error {
 	}
 	return nil
 }
+
+// nixHashString formats a sha256 hash the way narinfo files do.
+func nixHashString(h hash.Hash) string {
+	return "sha256:" + nixbase32.EncodeToString(h.Sum(nil))
+}
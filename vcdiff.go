@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"os"
+
+	"github.com/ulikunitz/xz"
+)
+
+// VCDIFF (RFC 3284) decoder, for expanding xdelta3 output without the binary.
+//
+// This supports what xd3Algo.Create produces: the default code table, source windows,
+// xdelta3's adler32 window checksums, and lzma secondary compression (an xz stream with no
+// check, preceded by the decompressed size). Target windows (VCD_TARGET) and custom code
+// tables are not supported; xd3Algo.Expand checks the whole delta for them first and uses the
+// binary instead.
+
+const (
+	// header indicator
+	vcdDecompress = 0x01
+	vcdCodeTable  = 0x02
+	vcdAppHeader  = 0x04
+
+	// window indicator
+	vcdSource  = 0x01
+	vcdTarget  = 0x02
+	vcdAdler32 = 0x04 // xdelta3 extension
+
+	// delta indicator
+	vcdDataComp = 0x01
+	vcdInstComp = 0x02
+	vcdAddrComp = 0x04
+
+	// secondary compressor id
+	vcdLzmaID = 2
+
+	// instruction types
+	vcdNoop = 0
+	vcdAdd  = 1
+	vcdRun  = 2
+	vcdCopy = 3
+
+	// address cache sizes for the default code table
+	vcdNearSize = 4
+	vcdSameSize = 3
+
+	// sanity limit on window and section sizes
+	vcdMaxWindow = 1 << 30
+)
+
+var (
+	vcdMagic = []byte{0xd6, 0xc3, 0xc4, 0x00}
+
+	vcdDefaultTable = makeVcdCodeTable()
+
+	errBadVcdiff         = errors.New("bad vcdiff data")
+	errVcdiffUnsupported = errors.New("unsupported vcdiff feature")
+)
+
+type (
+	vcdInst struct{ typ, size, mode byte }
+
+	vcdAddrCache struct {
+		near     [vcdNearSize]int
+		nextNear int
+		same     [vcdSameSize * 256]int
+	}
+)
+
+// makeVcdCodeTable returns the default code table from section 5.6 of the RFC.
+func makeVcdCodeTable() (t [256][2]vcdInst) {
+	i := 0
+	t[i][0] = vcdInst{vcdRun, 0, 0}
+	i++
+	for size := 0; size <= 17; size++ {
+		t[i][0] = vcdInst{vcdAdd, byte(size), 0}
+		i++
+	}
+	for mode := 0; mode <= 8; mode++ {
+		t[i][0] = vcdInst{vcdCopy, 0, byte(mode)}
+		i++
+		for size := 4; size <= 18; size++ {
+			t[i][0] = vcdInst{vcdCopy, byte(size), byte(mode)}
+			i++
+		}
+	}
+	for mode := 0; mode <= 5; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= 6; copySize++ {
+				t[i] = [2]vcdInst{{vcdAdd, byte(addSize), 0}, {vcdCopy, byte(copySize), byte(mode)}}
+				i++
+			}
+		}
+	}
+	for mode := 6; mode <= 8; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			t[i] = [2]vcdInst{{vcdAdd, byte(addSize), 0}, {vcdCopy, 4, byte(mode)}}
+			i++
+		}
+	}
+	for mode := 0; mode <= 8; mode++ {
+		t[i] = [2]vcdInst{{vcdCopy, 4, byte(mode)}, {vcdAdd, 1, 0}}
+		i++
+	}
+	return
+}
+
+// vcdiffSupported reads a whole delta and returns true if vcdiffDecode can handle all of it,
+// so we can fall back to the binary before writing any output.
+func vcdiffSupported(r io.Reader) bool {
+	br := bufio.NewReader(r)
+	if _, err := vcdReadHeader(br); err != nil {
+		return false
+	}
+	for {
+		ind, err := br.ReadByte()
+		if err == io.EOF {
+			return true
+		} else if err != nil || ind&vcdTarget != 0 {
+			return false
+		}
+		if ind&vcdSource != 0 {
+			if _, err = vcdReadInt(br); err != nil {
+				return false
+			} else if _, err = vcdReadInt(br); err != nil {
+				return false
+			}
+		}
+		if deltaLen, err := vcdReadInt(br); err != nil {
+			return false
+		} else if _, err = br.Discard(deltaLen); err != nil {
+			return false
+		}
+	}
+}
+
+// vcdiffDecode applies the delta from r to base and writes the result to w.
+func vcdiffDecode(ctx context.Context, base io.ReaderAt, baseSize int64, r *bufio.Reader, w io.Writer) error {
+	secondary, err := vcdReadHeader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		ind, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if ind&vcdTarget != 0 {
+			return fmt.Errorf("%w: target window", errVcdiffUnsupported)
+		}
+
+		var src *io.SectionReader
+		if ind&vcdSource != 0 {
+			srcLen, err := vcdReadInt(r)
+			if err != nil {
+				return err
+			}
+			srcPos, err := vcdReadInt(r)
+			if err != nil {
+				return err
+			} else if int64(srcPos+srcLen) > baseSize {
+				return fmt.Errorf("%w: source segment out of range", errBadVcdiff)
+			}
+			src = io.NewSectionReader(base, int64(srcPos), int64(srcLen))
+		}
+
+		deltaLen, err := vcdReadInt(r)
+		if err != nil {
+			return err
+		} else if deltaLen > vcdMaxWindow {
+			return fmt.Errorf("%w: window too big", errBadVcdiff)
+		}
+		delta := make([]byte, deltaLen)
+		if _, err = io.ReadFull(r, delta); err != nil {
+			return fmt.Errorf("%w: %v", errBadVcdiff, err)
+		}
+
+		out, err := vcdDecodeWindow(ind, src, delta, secondary)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(out); err != nil {
+			return err
+		}
+	}
+}
+
+// vcdReadHeader reads the file header and returns the secondary compressor id.
+func vcdReadHeader(r *bufio.Reader) (byte, error) {
+	magic := make([]byte, len(vcdMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, err
+	} else if !bytes.Equal(magic, vcdMagic) {
+		return 0, fmt.Errorf("%w: bad magic", errBadVcdiff)
+	}
+	ind, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	} else if ind&vcdCodeTable != 0 {
+		return 0, fmt.Errorf("%w: custom code table", errVcdiffUnsupported)
+	}
+	var secondary byte
+	if ind&vcdDecompress != 0 {
+		if secondary, err = r.ReadByte(); err != nil {
+			return 0, err
+		} else if secondary != vcdLzmaID {
+			return 0, fmt.Errorf("%w: secondary compressor %d", errVcdiffUnsupported, secondary)
+		}
+	}
+	if ind&vcdAppHeader != 0 {
+		l, err := vcdReadInt(r)
+		if err != nil {
+			return 0, err
+		} else if _, err = r.Discard(l); err != nil {
+			return 0, err
+		}
+	}
+	return secondary, nil
+}
+
+func vcdDecodeWindow(ind byte, src *io.SectionReader, delta []byte, secondary byte) ([]byte, error) {
+	dr := bytes.NewReader(delta)
+	var lens [4]int // target, data, inst, addr
+	var deltaInd byte
+	var err error
+	if lens[0], err = vcdReadInt(dr); err != nil {
+		return nil, err
+	} else if deltaInd, err = dr.ReadByte(); err != nil {
+		return nil, err
+	}
+	for i := 1; i < 4; i++ {
+		if lens[i], err = vcdReadInt(dr); err != nil {
+			return nil, err
+		}
+	}
+	var sum []byte
+	if ind&vcdAdler32 != 0 {
+		sum = make([]byte, 4)
+		if _, err = io.ReadFull(dr, sum); err != nil {
+			return nil, err
+		}
+	}
+	if lens[0] > vcdMaxWindow || lens[1]+lens[2]+lens[3] != dr.Len() {
+		return nil, fmt.Errorf("%w: bad section lengths", errBadVcdiff)
+	}
+	rest := delta[len(delta)-dr.Len():]
+	data := rest[:lens[1]]
+	inst := rest[lens[1] : lens[1]+lens[2]]
+	addr := rest[lens[1]+lens[2]:]
+
+	if deltaInd&(vcdDataComp|vcdInstComp|vcdAddrComp) != 0 && secondary == 0 {
+		return nil, fmt.Errorf("%w: compressed section without compressor", errBadVcdiff)
+	}
+	for _, s := range []struct {
+		bit byte
+		p   *[]byte
+	}{{vcdDataComp, &data}, {vcdInstComp, &inst}, {vcdAddrComp, &addr}} {
+		if deltaInd&s.bit != 0 {
+			if *s.p, err = vcdDecompressSection(*s.p); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	tgt, err := vcdRunInstructions(src, data, inst, addr, lens[0])
+	if err != nil {
+		return nil, err
+	}
+	if sum != nil && adler32.Checksum(tgt) != binary.BigEndian.Uint32(sum) {
+		return nil, fmt.Errorf("%w: window checksum mismatch", errBadVcdiff)
+	}
+	return tgt, nil
+}
+
+func vcdRunInstructions(src *io.SectionReader, data, inst, addr []byte, tgtLen int) ([]byte, error) {
+	tgt := make([]byte, 0, tgtLen)
+	srcLen := 0
+	if src != nil {
+		srcLen = int(src.Size())
+	}
+	ir := bytes.NewReader(inst)
+	ar := bytes.NewReader(addr)
+	var cache vcdAddrCache
+	for ir.Len() > 0 {
+		idx, _ := ir.ReadByte()
+		for _, in := range vcdDefaultTable[idx] {
+			if in.typ == vcdNoop {
+				continue
+			}
+			size := int(in.size)
+			if size == 0 {
+				var err error
+				if size, err = vcdReadInt(ir); err != nil {
+					return nil, err
+				}
+			}
+			if len(tgt)+size > tgtLen {
+				return nil, fmt.Errorf("%w: target window overflow", errBadVcdiff)
+			}
+
+			switch in.typ {
+			case vcdAdd:
+				if size > len(data) {
+					return nil, fmt.Errorf("%w: data section underflow", errBadVcdiff)
+				}
+				tgt = append(tgt, data[:size]...)
+				data = data[size:]
+			case vcdRun:
+				if len(data) < 1 {
+					return nil, fmt.Errorf("%w: data section underflow", errBadVcdiff)
+				}
+				b := data[0]
+				data = data[1:]
+				for i := 0; i < size; i++ {
+					tgt = append(tgt, b)
+				}
+			case vcdCopy:
+				here := srcLen + len(tgt)
+				a, err := cache.decode(ar, here, in.mode)
+				if err != nil {
+					return nil, err
+				} else if a < 0 || a >= here {
+					return nil, fmt.Errorf("%w: bad copy address", errBadVcdiff)
+				}
+				if a < srcLen {
+					// from source, possibly continuing into target
+					l := len(tgt)
+					n := min(size, srcLen-a)
+					tgt = tgt[:l+n]
+					if _, err := src.ReadAt(tgt[l:], int64(a)); err != nil {
+						return nil, err
+					}
+					a, size = srcLen, size-n
+				}
+				// from target, may overlap the data being written
+				for i := a - srcLen; i < a-srcLen+size; i++ {
+					tgt = append(tgt, tgt[i])
+				}
+			}
+		}
+	}
+	if len(tgt) != tgtLen {
+		return nil, fmt.Errorf("%w: short target window", errBadVcdiff)
+	}
+	return tgt, nil
+}
+
+func (c *vcdAddrCache) decode(r *bytes.Reader, here int, mode byte) (int, error) {
+	var a int
+	switch {
+	case mode == 0: // self
+		v, err := vcdReadInt(r)
+		if err != nil {
+			return 0, err
+		}
+		a = v
+	case mode == 1: // here
+		v, err := vcdReadInt(r)
+		if err != nil {
+			return 0, err
+		}
+		a = here - v
+	case int(mode)-2 < vcdNearSize:
+		v, err := vcdReadInt(r)
+		if err != nil {
+			return 0, err
+		}
+		a = c.near[mode-2] + v
+	default:
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("%w: address section underflow", errBadVcdiff)
+		}
+		a = c.same[(int(mode)-2-vcdNearSize)*256+int(b)]
+	}
+	c.near[c.nextNear] = a
+	c.nextNear = (c.nextNear + 1) % vcdNearSize
+	if a >= 0 {
+		c.same[a%len(c.same)] = a
+	}
+	return a, nil
+}
+
+// vcdDecompressSection decodes an lzma-compressed section in xdelta3's format.
+func vcdDecompressSection(sec []byte) ([]byte, error) {
+	r := bytes.NewReader(sec)
+	size, err := vcdReadInt(r)
+	if err != nil {
+		return nil, err
+	} else if size > vcdMaxWindow {
+		return nil, fmt.Errorf("%w: section too big", errBadVcdiff)
+	}
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadVcdiff, err)
+	}
+	out := make([]byte, size)
+	if _, err = io.ReadFull(xr, out); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadVcdiff, err)
+	}
+	return out, nil
+}
+
+// vcdReadInt reads a VCDIFF integer: big-endian base 128 with continuation bits.
+func vcdReadInt(r io.ByteReader) (int, error) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", errBadVcdiff, err)
+		}
+		v = v<<7 | uint64(c&0x7f)
+		if c&0x80 == 0 {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: integer too big", errBadVcdiff)
+}
+
+// spoolDelta copies a delta to an unlinked temp file, so it can be read more than once.
+func spoolDelta(r io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp("", "delta")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if err = ioCopy(f, r, nil, -1); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// spoolBase is like mapBase but copies non-file bases to an unlinked temp file first, so they
+// don't take memory.
+func spoolBase(r io.Reader) ([]byte, func(), error) {
+	if f, ok := r.(*os.File); ok && mappable(f) {
+		return mapBase(f)
+	}
+	f, err := os.CreateTemp("", "basenar")
+	if err != nil {
+		return nil, nil, err
+	}
+	os.Remove(f.Name())
+	if err = ioCopy(f, r, nil, -1); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	b, unmap, err := mapBase(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return b, func() { unmap(); f.Close() }, nil
+}
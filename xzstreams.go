@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// xz files can have several concatenated streams (with padding between them), and each
+// stream can have many blocks: multi-threaded xz splits its input into blocks and records
+// their sizes in the block headers, which single-threaded xz doesn't. parseXzStreams parses
+// the whole container so we can ask xz to do the same thing again.
+
+type (
+	xzStream struct {
+		offset         int64 // of the stream in the file
+		compressedSize int64 // not including padding
+		size           int64 // uncompressed
+		padding        int64 // zero bytes after the stream
+		options        []string
+	}
+
+	xzBlock struct {
+		size     int64 // uncompressed
+		hasSizes bool  // block header records sizes
+		filters  []string
+	}
+)
+
+var xzBcjFilters = map[uint64]string{
+	0x04: "x86", 0x05: "powerpc", 0x06: "ia64", 0x07: "arm",
+	0x08: "armthumb", 0x09: "sparc", 0x0a: "arm64", 0x0b: "riscv",
+}
+
+// parseXzStreams parses all streams in an xz file and returns them in order, with the
+// options to pass to xz (after -c) to reproduce each one.
+func parseXzStreams(buf []byte) ([]xzStream, error) {
+	var streams []xzStream
+	end := int64(len(buf))
+	for end > 0 {
+		var pad int64
+		for end >= 4 && bytes.Equal(buf[end-4:end], []byte{0, 0, 0, 0}) {
+			end -= 4
+			pad += 4
+		}
+		st, err := parseXzStream(buf, end)
+		if err != nil {
+			return nil, err
+		}
+		st.padding = pad
+		streams = append([]xzStream{st}, streams...)
+		end = st.offset
+	}
+	if len(streams) == 0 {
+		return nil, fmt.Errorf("%w: no streams", errBadXzData)
+	}
+	return streams, nil
+}
+
+// parseXzStream parses the stream that ends at end.
+func parseXzStream(buf []byte, end int64) (xzStream, error) {
+	if end < 24 {
+		return xzStream{}, fmt.Errorf("%w: too short", errBadXzData)
+	}
+	footer := buf[end-12 : end]
+	if !bytes.Equal(footer[10:], []byte{'Y', 'Z'}) ||
+		binary.LittleEndian.Uint32(footer) != crc32.ChecksumIEEE(footer[4:10]) {
+		return xzStream{}, fmt.Errorf("%w: bad stream footer", errBadXzData)
+	}
+	flags := footer[8:10]
+	checkSize, err := xzCheckSize(flags)
+	if err != nil {
+		return xzStream{}, err
+	}
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	if indexSize > end-24 {
+		return xzStream{}, fmt.Errorf("%w: bad index size", errBadXzData)
+	}
+	index := buf[end-12-indexSize : end-12]
+	sizes, err := parseXzIndex(index)
+	if err != nil {
+		return xzStream{}, err
+	}
+
+	// the index tells us where the stream starts
+	var blocksSize int64
+	for _, s := range sizes {
+		blocksSize += (s[0] + 3) &^ 3
+	}
+	start := end - 12 - indexSize - blocksSize - 12
+	if blocksSize < 0 || start < 0 {
+		return xzStream{}, fmt.Errorf("%w: bad index", errBadXzData)
+	}
+	header := buf[start : start+12]
+	if !bytes.Equal(header[:6], []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}) ||
+		!bytes.Equal(header[6:8], flags) ||
+		binary.LittleEndian.Uint32(header[8:]) != crc32.ChecksumIEEE(header[6:8]) {
+		return xzStream{}, fmt.Errorf("%w: bad stream header", errBadXzData)
+	}
+
+	var blocks []xzBlock
+	var total int64
+	pos := start + 12
+	for _, s := range sizes {
+		b, err := parseXzBlockHeader(buf[pos:], s[0]-int64(checkSize), s[1])
+		if err != nil {
+			return xzStream{}, err
+		}
+		blocks = append(blocks, b)
+		total += s[1]
+		pos += (s[0] + 3) &^ 3
+	}
+	opts, err := xzStreamOptions(flags, blocks)
+	if err != nil {
+		return xzStream{}, err
+	}
+	return xzStream{
+		offset:         start,
+		compressedSize: end - start,
+		size:           total,
+		options:        opts,
+	}, nil
+}
+
+func xzCheckSize(flags []byte) (int, error) {
+	if flags[0] != 0 || flags[1]&0xf0 != 0 {
+		return 0, fmt.Errorf("%w: bad stream flags", errBadXzData)
+	}
+	switch flags[1] {
+	case 0x00:
+		return 0, nil
+	case 0x01:
+		return 4, nil
+	case 0x04:
+		return 8, nil
+	case 0x0A:
+		return 32, nil
+	}
+	return 0, fmt.Errorf("%w: unknown check type %v", errBadXzData, flags[1])
+}
+
+func xzCheckOption(flags []byte) string {
+	switch flags[1] {
+	case 0x00:
+		return "--check=none"
+	case 0x01:
+		return "--check=crc32"
+	case 0x04:
+		return "--check=crc64"
+	default:
+		return "--check=sha256"
+	}
+}
+
+// parseXzIndex returns the unpadded and uncompressed size of each block.
+func parseXzIndex(index []byte) ([][2]int64, error) {
+	if len(index) < 8 || index[0] != 0 ||
+		binary.LittleEndian.Uint32(index[len(index)-4:]) != crc32.ChecksumIEEE(index[:len(index)-4]) {
+		return nil, fmt.Errorf("%w: bad index", errBadXzData)
+	}
+	i := 1
+	nRec, l := readVarint(index[i:])
+	i += l
+	if l == 0 || nRec > uint64(len(index)) {
+		return nil, fmt.Errorf("%w: bad index", errBadXzData)
+	}
+	sizes := make([][2]int64, nRec)
+	for r := range sizes {
+		for j := range sizes[r] {
+			v, l := readVarint(index[i:])
+			if l == 0 || v > 1<<62 {
+				return nil, fmt.Errorf("%w: bad index record", errBadXzData)
+			}
+			sizes[r][j] = int64(v)
+			i += l
+		}
+		if sizes[r][0] < 5 { // smallest block header and no data
+			return nil, fmt.Errorf("%w: bad index record", errBadXzData)
+		}
+	}
+	return sizes, nil
+}
+
+// parseXzBlockHeader parses the header of a block, checking it against the sizes from the
+// index (dataSize is the header and compressed data without the check).
+func parseXzBlockHeader(b []byte, dataSize, size int64) (xzBlock, error) {
+	if len(b) < 1 || b[0] == 0 {
+		return xzBlock{}, fmt.Errorf("%w: bad block header", errBadXzData)
+	}
+	hdrSize := (int(b[0]) + 1) * 4
+	if hdrSize > len(b) || int64(hdrSize) > dataSize ||
+		binary.LittleEndian.Uint32(b[hdrSize-4:]) != crc32.ChecksumIEEE(b[:hdrSize-4]) {
+		return xzBlock{}, fmt.Errorf("%w: bad block header", errBadXzData)
+	}
+	h := b[:hdrSize-4]
+	flags := h[1]
+	if flags&0x3c != 0 {
+		return xzBlock{}, fmt.Errorf("%w: bad block flags", errBadXzData)
+	}
+	block := xzBlock{size: size, hasSizes: flags&0xc0 != 0}
+	i := 2
+	if flags&0x40 != 0 {
+		v, l := readVarint(h[i:])
+		if l == 0 || int64(v) != dataSize-int64(hdrSize) {
+			return xzBlock{}, fmt.Errorf("%w: block compressed size mismatch", errBadXzData)
+		}
+		i += l
+	}
+	if flags&0x80 != 0 {
+		v, l := readVarint(h[i:])
+		if l == 0 || int64(v) != size {
+			return xzBlock{}, fmt.Errorf("%w: block uncompressed size mismatch", errBadXzData)
+		}
+		i += l
+	}
+	for f := 0; f <= int(flags&0x03); f++ {
+		id, l := readVarint(h[i:])
+		if l == 0 {
+			return xzBlock{}, fmt.Errorf("%w: bad filter flags", errBadXzData)
+		}
+		i += l
+		propSize, l := readVarint(h[i:])
+		if l == 0 || propSize > uint64(len(h)-i-l) {
+			return xzBlock{}, fmt.Errorf("%w: bad filter flags", errBadXzData)
+		}
+		i += l
+		props := h[i : i+int(propSize)]
+		i += int(propSize)
+
+		switch {
+		case id == 0x21: // lzma2
+			if propSize != 1 || props[0]&0x3f > 40 {
+				return xzBlock{}, fmt.Errorf("%w: bad lzma2 props", errBadXzData)
+			}
+			bits := int(props[0] & 0x3f)
+			dictSize := int64(1<<32 - 1)
+			if bits < 40 {
+				dictSize = int64(2|(bits&1)) << (bits/2 + 11)
+			}
+			block.filters = append(block.filters, fmt.Sprintf("--lzma2=dict=%d", dictSize))
+		case xzBcjFilters[id] != "":
+			if propSize == 4 && binary.LittleEndian.Uint32(props) != 0 {
+				block.filters = append(block.filters, fmt.Sprintf("--%s=start=%d", xzBcjFilters[id], binary.LittleEndian.Uint32(props)))
+			} else if propSize == 0 || propSize == 4 {
+				block.filters = append(block.filters, "--"+xzBcjFilters[id])
+			} else {
+				return xzBlock{}, fmt.Errorf("%w: bad bcj props", errBadXzData)
+			}
+		case id == 0x03: // delta
+			if propSize != 1 {
+				return xzBlock{}, fmt.Errorf("%w: bad delta props", errBadXzData)
+			}
+			block.filters = append(block.filters, fmt.Sprintf("--delta=dist=%d", int(props[0])+1))
+		default:
+			return xzBlock{}, fmt.Errorf("%w: unknown filter %v", errBadXzData, id)
+		}
+	}
+	if !bytes.Equal(h[i:], make([]byte, len(h)-i)) {
+		return xzBlock{}, fmt.Errorf("%w: bad block header padding", errBadXzData)
+	}
+	return block, nil
+}
+
+// xzStreamOptions returns options for xz that should produce a stream with these blocks.
+func xzStreamOptions(flags []byte, blocks []xzBlock) ([]string, error) {
+	opts := []string{xzCheckOption(flags)}
+	if len(blocks) == 0 {
+		return append(opts, "-T1"), nil
+	}
+	first := blocks[0]
+	for i, b := range blocks {
+		if b.hasSizes != first.hasSizes || !equalStrings(b.filters, first.filters) {
+			return nil, fmt.Errorf("%w: blocks differ", errBadXzData)
+		} else if i < len(blocks)-1 && b.size != first.size {
+			return nil, fmt.Errorf("%w: uneven block sizes", errBadXzData)
+		}
+	}
+	// multi-threaded xz records sizes in block headers, and the output is the same for any
+	// number of threads. note that the header is padded to fit the largest possible sizes for
+	// the configured block size, so a single block only matches if it used the default.
+	if first.hasSizes {
+		opts = append(opts, "-T2")
+	} else {
+		opts = append(opts, "-T1")
+	}
+	if len(blocks) > 1 {
+		opts = append(opts, fmt.Sprintf("--block-size=%d", first.size))
+	}
+	return append(opts, first.filters...), nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func xzTestData(n int) []byte {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = "abcdefgh"[r.Intn(8)]
+	}
+	return data
+}
+
+func xzCompress(t testing.TB, data []byte, args ...string) []byte {
+	cmd := exec.Command(xzBin, append([]string{"-c"}, args...)...)
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(args, err)
+	}
+	return out
+}
+
+func TestExpandXzStreams(t *testing.T) {
+	if _, err := exec.LookPath(xzBin); err != nil {
+		t.Skip("no", xzBin)
+	}
+	data := xzTestData(300000)
+	half := len(data) / 2
+
+	for _, tc := range []struct {
+		name    string
+		make    func() []byte
+		streams int
+	}{
+		{"single", func() []byte { return xzCompress(t, data, "-T1") }, 1},
+		{"threaded", func() []byte { return xzCompress(t, data, "-T2") }, 1},
+		{"blocks", func() []byte { return xzCompress(t, data, "-T1", "--block-size=70000") }, 1},
+		{"threaded blocks", func() []byte { return xzCompress(t, data, "-T4", "--block-size=100000") }, 1},
+		{"sha256", func() []byte { return xzCompress(t, data, "-T1", "--check=sha256") }, 1},
+		{"bcj start", func() []byte { return xzCompress(t, data, "-T1", "--x86=start=4096", "--lzma2=preset=6") }, 1},
+		{"delta", func() []byte { return xzCompress(t, data, "-T1", "--delta=dist=4", "--lzma2=preset=6") }, 1},
+		{"concatenated", func() []byte {
+			return append(xzCompress(t, data[:half], "-T1"), xzCompress(t, data[half:], "-T2", "--check=crc32")...)
+		}, 2},
+		{"padded", func() []byte {
+			out := append(xzCompress(t, data[:half], "-T1"), 0, 0, 0, 0)
+			return append(append(out, xzCompress(t, data[half:], "-T1")...), 0, 0, 0, 0, 0, 0, 0, 0)
+		}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			xzData := tc.make()
+			streams, err := parseXzStreams(xzData)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(streams) != tc.streams {
+				t.Fatalf("got %d streams, expected %d", len(streams), tc.streams)
+			}
+
+			root := filepath.Join(t.TempDir(), "root")
+			os.MkdirAll(root, 0755)
+			os.WriteFile(filepath.Join(root, "file"), xzData, 0644)
+			orig := dumpNar(t, root)
+
+			stats := make(map[string]int)
+			opts := narExpanderOptions{Version: 6, Stats: stats}
+			expanded, err := io.ReadAll(ExpandNar(bytes.NewReader(orig), opts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if exp := map[string]int{"xz:expanded": 1}; !reflect.DeepEqual(stats, exp) {
+				t.Errorf("stats %v, expected %v", stats, exp)
+			}
+			collapsed, err := io.ReadAll(CollapseNar(bytes.NewReader(expanded), opts))
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(collapsed, orig) {
+				t.Error("round trip mismatch")
+			}
+		})
+	}
+}
+
+func TestParseXzBcjStart(t *testing.T) {
+	if _, err := exec.LookPath(xzBin); err != nil {
+		t.Skip("no", xzBin)
+	}
+	data := xzTestData(50000)
+	for _, tc := range []struct {
+		filter string
+		exp    string
+	}{
+		{"--x86", "--x86"},
+		{"--x86=start=0", "--x86"},
+		{"--x86=start=4096", "--x86=start=4096"},
+		{"--arm64=start=1024", "--arm64=start=1024"},
+	} {
+		xzData := xzCompress(t, data, "-T1", tc.filter, "--lzma2=preset=6")
+		info, err := parseXz(xzData)
+		if err != nil {
+			t.Fatal(tc.filter, err)
+		}
+		found := false
+		for _, o := range info.options {
+			found = found || o == tc.exp
+		}
+		if !found {
+			t.Errorf("%s: options %v, expected %s", tc.filter, info.options, tc.exp)
+		}
+
+		// the options reproduce it (xz before 5.4 defaulted to one thread, like -T1)
+		recomp := xzCompress(t, data, append([]string{"-T1"}, info.options...)...)
+		if !bytes.Equal(recomp, xzData) {
+			t.Error(tc.filter, "options don't reproduce the original")
+		}
+	}
+}
+
+func FuzzParseXz(f *testing.F) {
+	if _, err := exec.LookPath(xzBin); err == nil {
+		data := xzTestData(50000)
+		f.Add(xzCompress(f, data, "-T1"))
+		f.Add(xzCompress(f, data, "-T2", "--block-size=20000"))
+		f.Add(xzCompress(f, data, "-T1", "--arm64", "--lzma2=preset=1"))
+		f.Add(append(xzCompress(f, data[:100]), append(make([]byte, 4), xzCompress(f, nil)...)...))
+	}
+	f.Add([]byte{0xFD, '7', 'z', 'X', 'Z', 0x00})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		parseXz(buf)
+		streams, err := parseXzStreams(buf)
+		if err != nil {
+			return
+		}
+		var end int64
+		for _, st := range streams {
+			if st.offset != end || st.compressedSize < 32 || st.size < 0 {
+				t.Fatalf("bad stream %+v at %d", st, end)
+			}
+			end = st.offset + st.compressedSize + st.padding
+		}
+		if end != int64(len(buf)) {
+			t.Fatalf("streams end at %d, expected %d", end, len(buf))
+		}
+	})
+}
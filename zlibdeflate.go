@@ -0,0 +1,851 @@
+package main
+
+import (
+	"io"
+)
+
+// zlibDeflate writes a raw deflate stream of data to w that's bit-for-bit identical to what
+// zlib produces at the given level (1–9) with the default window size, memLevel and strategy,
+// which is what almost every zip, jar and wheel writer uses. Go's compress/flate makes
+// different choices, so it can't be used to reproduce existing files.
+//
+// This follows the structure of zlib's deflate.c and trees.c closely on purpose: any
+// deviation in match finding or block splitting changes the output. Callers must still
+// verify the result, since other zlib versions and forks (e.g. zlib-ng) differ.
+func zlibDeflate(w io.Writer, data []byte, level int) error {
+	d := &zlibDeflater{
+		w:      w,
+		in:     data,
+		cfg:    zdConfigTable[level],
+		window: make([]byte, 2*zdWSize),
+		head:   make([]uint16, zdHashSize),
+		prev:   make([]uint16, zdWSize),
+		syms:   make([]zdSym, 0, zdSymEnd),
+
+		matchLength: zdMinMatch - 1,
+		prevLength:  zdMinMatch - 1,
+	}
+	d.initBlock()
+	if d.cfg.slow {
+		d.deflateSlow()
+	} else {
+		d.deflateFast()
+	}
+	return d.err
+}
+
+const (
+	zdWSize        = 1 << 15
+	zdWMask        = zdWSize - 1
+	zdHashBits     = 8 + 7 // memLevel + 7
+	zdHashSize     = 1 << zdHashBits
+	zdHashMask     = zdHashSize - 1
+	zdMinMatch     = 3
+	zdMaxMatch     = 258
+	zdHashShift    = (zdHashBits + zdMinMatch - 1) / zdMinMatch
+	zdMinLookahead = zdMaxMatch + zdMinMatch + 1
+	zdMaxDist      = zdWSize - zdMinLookahead
+	zdTooFar       = 4096
+	zdSymEnd       = 1<<(8+6) - 1 // lit_bufsize - 1
+
+	zdLiterals    = 256
+	zdEndBlock    = 256
+	zdLengthCodes = 29
+	zdLCodes      = zdLiterals + 1 + zdLengthCodes
+	zdDCodes      = 30
+	zdBLCodes     = 19
+	zdHeapSize    = 2*zdLCodes + 1
+	zdMaxBits     = 15
+	zdMaxBLBits   = 7
+
+	zdRep3_6      = 16
+	zdRepz3_10    = 17
+	zdRepz11_138  = 18
+	zdStoredBlock = 0
+	zdStaticTrees = 1
+	zdDynTrees    = 2
+)
+
+type (
+	zdConfig struct {
+		good, lazy, nice, chain int
+		slow                    bool
+	}
+
+	zdSym struct {
+		dist uint16
+		lc   uint8
+	}
+
+	// zdNode is zlib's ct_data without the unions.
+	zdNode struct {
+		freq, code, dad, len int
+	}
+
+	zdDesc struct {
+		tree      []zdNode
+		maxCode   int
+		stree     []zdNode
+		extra     []int
+		extraBase int
+		elems     int
+		maxLength int
+	}
+
+	zlibDeflater struct {
+		w   io.Writer
+		err error
+		cfg zdConfig
+		in  []byte
+
+		// gnu makes this behave like GNU gzip's deflate instead (see gzipdeflate.go)
+		gnu     bool
+		level   int
+		eof     bool
+		numDist int
+
+		window []byte
+		head   []uint16
+		prev   []uint16
+		insH   uint
+
+		strstart, lookahead, blockStart, insert int
+		matchLength, prevLength                 int
+		matchStart, prevMatch                   int
+		matchAvailable                          bool
+
+		dynL    [zdHeapSize]zdNode
+		dynD    [2*zdDCodes + 1]zdNode
+		blTree  [2*zdBLCodes + 1]zdNode
+		heap    [zdHeapSize]int
+		depth   [zdHeapSize]int
+		heapLen int
+		heapMax int
+		blCount [zdMaxBits + 1]int
+
+		optLen, staticLen int
+		syms              []zdSym
+
+		out    []byte
+		bitBuf uint64
+		bitN   uint
+	}
+)
+
+var zdConfigTable = [10]zdConfig{
+	{0, 0, 0, 0, false}, // stored, not supported
+	{4, 4, 8, 4, false},
+	{4, 5, 16, 8, false},
+	{4, 6, 32, 32, false},
+	{4, 4, 16, 16, true},
+	{8, 16, 32, 32, true},
+	{8, 16, 128, 128, true},
+	{8, 32, 128, 256, true},
+	{32, 128, 258, 1024, true},
+	{32, 258, 258, 4096, true},
+}
+
+var (
+	zdExtraLBits  = []int{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	zdExtraDBits  = []int{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	zdExtraBLBits = []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 3, 7}
+	zdBLOrder     = []int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+	zdLengthCode [256]int
+	zdDistCode   [512]int
+	zdBaseLength [zdLengthCodes]int
+	zdBaseDist   [zdDCodes]int
+	zdStaticL    [zdLCodes + 2]zdNode
+	zdStaticD    [zdDCodes]zdNode
+)
+
+func init() {
+	// tr_static_init
+	length := 0
+	code := 0
+	for ; code < zdLengthCodes-1; code++ {
+		zdBaseLength[code] = length
+		for n := 0; n < 1<<zdExtraLBits[code]; n++ {
+			zdLengthCode[length] = code
+			length++
+		}
+	}
+	zdLengthCode[length-1] = code
+	dist := 0
+	for code = 0; code < 16; code++ {
+		zdBaseDist[code] = dist
+		for n := 0; n < 1<<zdExtraDBits[code]; n++ {
+			zdDistCode[dist] = code
+			dist++
+		}
+	}
+	dist >>= 7
+	for ; code < zdDCodes; code++ {
+		zdBaseDist[code] = dist << 7
+		for n := 0; n < 1<<(zdExtraDBits[code]-7); n++ {
+			zdDistCode[256+dist] = code
+			dist++
+		}
+	}
+
+	var blCount [zdMaxBits + 1]int
+	for n := range zdStaticL {
+		switch {
+		case n <= 143:
+			zdStaticL[n].len = 8
+		case n <= 255:
+			zdStaticL[n].len = 9
+		case n <= 279:
+			zdStaticL[n].len = 7
+		default:
+			zdStaticL[n].len = 8
+		}
+		blCount[zdStaticL[n].len]++
+	}
+	zdGenCodes(zdStaticL[:], zdLCodes+1, blCount[:])
+	for n := range zdStaticD {
+		zdStaticD[n] = zdNode{len: 5, code: zdBitReverse(n, 5)}
+	}
+}
+
+func zdDCode(dist int) int {
+	if dist < 256 {
+		return zdDistCode[dist]
+	}
+	return zdDistCode[256+dist>>7]
+}
+
+func zdBitReverse(code, l int) int {
+	res := 0
+	for ; l > 0; l-- {
+		res = res<<1 | code&1
+		code >>= 1
+	}
+	return res
+}
+
+func zdGenCodes(tree []zdNode, maxCode int, blCount []int) {
+	var nextCode [zdMaxBits + 1]int
+	code := 0
+	for bits := 1; bits <= zdMaxBits; bits++ {
+		code = (code + blCount[bits-1]) << 1
+		nextCode[bits] = code
+	}
+	for n := 0; n <= maxCode; n++ {
+		l := tree[n].len
+		if l == 0 {
+			continue
+		}
+		tree[n].code = zdBitReverse(nextCode[l], l)
+		nextCode[l]++
+	}
+}
+
+// match finding (deflate.c)
+
+func (d *zlibDeflater) updateHash(c byte) {
+	d.insH = (d.insH<<zdHashShift ^ uint(c)) & zdHashMask
+}
+
+func (d *zlibDeflater) insertString(str int) int {
+	d.updateHash(d.window[str+zdMinMatch-1])
+	h := d.head[d.insH]
+	d.prev[str&zdWMask] = h
+	d.head[d.insH] = uint16(str)
+	return int(h)
+}
+
+func (d *zlibDeflater) slideHash() {
+	for _, t := range [][]uint16{d.head, d.prev} {
+		for i, m := range t {
+			if m >= zdWSize {
+				t[i] = m - zdWSize
+			} else {
+				t[i] = 0
+			}
+		}
+	}
+}
+
+func (d *zlibDeflater) fillWindow() {
+	for {
+		more := len(d.window) - d.lookahead - d.strstart
+		if d.strstart >= zdWSize+zdMaxDist {
+			copy(d.window, d.window[zdWSize:2*zdWSize-more])
+			d.matchStart -= zdWSize
+			d.strstart -= zdWSize
+			d.blockStart -= zdWSize
+			if d.insert > d.strstart {
+				d.insert = d.strstart
+			}
+			d.slideHash()
+			more += zdWSize
+		}
+		if len(d.in) == 0 {
+			return
+		}
+		pos := d.strstart + d.lookahead
+		n := copy(d.window[pos:pos+more], d.in)
+		d.in = d.in[n:]
+		d.lookahead += n
+
+		if d.lookahead+d.insert >= zdMinMatch {
+			str := d.strstart - d.insert
+			d.insH = uint(d.window[str])
+			d.updateHash(d.window[str+1])
+			for d.insert > 0 {
+				d.updateHash(d.window[str+zdMinMatch-1])
+				d.prev[str&zdWMask] = d.head[d.insH]
+				d.head[d.insH] = uint16(str)
+				str++
+				d.insert--
+				if d.lookahead+d.insert < zdMinMatch {
+					break
+				}
+			}
+		}
+		if d.lookahead >= zdMinLookahead || len(d.in) == 0 {
+			return
+		}
+	}
+}
+
+func (d *zlibDeflater) longestMatch(cur int) int {
+	chain := d.cfg.chain
+	win := d.window
+	scan := d.strstart
+	bestLen := d.prevLength
+	nice := d.cfg.nice
+	limit := 0
+	if d.strstart > zdMaxDist {
+		limit = d.strstart - zdMaxDist
+	}
+	scanEnd1, scanEnd := win[scan+bestLen-1], win[scan+bestLen]
+
+	if d.prevLength >= d.cfg.good {
+		chain >>= 2
+	}
+	if nice > d.lookahead && !d.gnu {
+		nice = d.lookahead
+	}
+	for {
+		m := cur
+		if win[m+bestLen] == scanEnd && win[m+bestLen-1] == scanEnd1 &&
+			win[m] == win[scan] && win[m+1] == win[scan+1] {
+			// like zlib, skip byte 2 (implied by the hash) and look at no more than
+			// zdMaxMatch bytes, even past the end of the input
+			l := 3
+			for l < zdMaxMatch && win[scan+l] == win[m+l] {
+				l++
+			}
+			if l > bestLen {
+				d.matchStart = cur
+				bestLen = l
+				if l >= nice {
+					break
+				}
+				scanEnd1, scanEnd = win[scan+bestLen-1], win[scan+bestLen]
+			}
+		}
+		cur = int(d.prev[cur&zdWMask])
+		if cur <= limit {
+			break
+		}
+		if chain--; chain == 0 {
+			break
+		}
+	}
+	if bestLen <= d.lookahead || d.gnu {
+		return bestLen
+	}
+	return d.lookahead
+}
+
+func (d *zlibDeflater) flushBlock(last bool) {
+	var buf []byte
+	if d.blockStart >= 0 {
+		buf = d.window[d.blockStart:d.strstart]
+	}
+	d.trFlushBlock(buf, d.strstart-d.blockStart, last)
+	d.blockStart = d.strstart
+	if d.err == nil && len(d.out) > 0 {
+		_, d.err = d.w.Write(d.out)
+	}
+	d.out = d.out[:0]
+}
+
+func (d *zlibDeflater) deflateFast() {
+	for d.err == nil {
+		if d.lookahead < zdMinLookahead {
+			d.fillWindow()
+			if d.lookahead == 0 {
+				break
+			}
+		}
+		hashHead := 0
+		if d.lookahead >= zdMinMatch {
+			hashHead = d.insertString(d.strstart)
+		}
+		if hashHead != 0 && d.strstart-hashHead <= zdMaxDist {
+			d.matchLength = d.longestMatch(hashHead)
+		}
+		var bflush bool
+		if d.matchLength >= zdMinMatch {
+			bflush = d.tallyDist(d.strstart-d.matchStart, d.matchLength-zdMinMatch)
+			d.lookahead -= d.matchLength
+			if d.matchLength <= d.cfg.lazy && d.lookahead >= zdMinMatch {
+				// max_insert_length is max_lazy for the fast levels
+				d.matchLength--
+				for {
+					d.strstart++
+					d.insertString(d.strstart)
+					if d.matchLength--; d.matchLength == 0 {
+						break
+					}
+				}
+				d.strstart++
+			} else {
+				d.strstart += d.matchLength
+				d.matchLength = 0
+				d.insH = uint(d.window[d.strstart])
+				d.updateHash(d.window[d.strstart+1])
+			}
+		} else {
+			bflush = d.tallyLit(d.window[d.strstart])
+			d.lookahead--
+			d.strstart++
+		}
+		if bflush {
+			d.flushBlock(false)
+		}
+	}
+	if d.err == nil {
+		d.flushBlock(true)
+	}
+}
+
+func (d *zlibDeflater) deflateSlow() {
+	for d.err == nil {
+		if d.lookahead < zdMinLookahead {
+			d.fillWindow()
+			if d.lookahead == 0 {
+				break
+			}
+		}
+		hashHead := 0
+		if d.lookahead >= zdMinMatch {
+			hashHead = d.insertString(d.strstart)
+		}
+		d.prevLength, d.prevMatch = d.matchLength, d.matchStart
+		d.matchLength = zdMinMatch - 1
+		if hashHead != 0 && d.prevLength < d.cfg.lazy && d.strstart-hashHead <= zdMaxDist {
+			d.matchLength = d.longestMatch(hashHead)
+			if d.matchLength == zdMinMatch && d.strstart-d.matchStart > zdTooFar {
+				d.matchLength = zdMinMatch - 1
+			}
+		}
+		if d.prevLength >= zdMinMatch && d.matchLength <= d.prevLength {
+			maxInsert := d.strstart + d.lookahead - zdMinMatch
+			bflush := d.tallyDist(d.strstart-1-d.prevMatch, d.prevLength-zdMinMatch)
+			d.lookahead -= d.prevLength - 1
+			d.prevLength -= 2
+			for {
+				if d.strstart++; d.strstart <= maxInsert {
+					d.insertString(d.strstart)
+				}
+				if d.prevLength--; d.prevLength == 0 {
+					break
+				}
+			}
+			d.matchAvailable = false
+			d.matchLength = zdMinMatch - 1
+			d.strstart++
+			if bflush {
+				d.flushBlock(false)
+			}
+		} else if d.matchAvailable {
+			if d.tallyLit(d.window[d.strstart-1]) {
+				d.flushBlock(false)
+			}
+			d.strstart++
+			d.lookahead--
+		} else {
+			d.matchAvailable = true
+			d.strstart++
+			d.lookahead--
+		}
+	}
+	if d.err == nil {
+		if d.matchAvailable {
+			d.tallyLit(d.window[d.strstart-1])
+			d.matchAvailable = false
+		}
+		d.flushBlock(true)
+	}
+}
+
+// huffman trees and output (trees.c)
+
+func (d *zlibDeflater) initBlock() {
+	for n := 0; n < zdLCodes; n++ {
+		d.dynL[n].freq = 0
+	}
+	for n := 0; n < zdDCodes; n++ {
+		d.dynD[n].freq = 0
+	}
+	for n := 0; n < zdBLCodes; n++ {
+		d.blTree[n].freq = 0
+	}
+	d.dynL[zdEndBlock].freq = 1
+	d.optLen, d.staticLen = 0, 0
+	d.syms = d.syms[:0]
+	d.numDist = 0
+}
+
+func (d *zlibDeflater) tallyLit(c byte) bool {
+	d.syms = append(d.syms, zdSym{dist: 0, lc: c})
+	d.dynL[c].freq++
+	return d.blockFull()
+}
+
+func (d *zlibDeflater) tallyDist(dist, lc int) bool {
+	d.syms = append(d.syms, zdSym{dist: uint16(dist), lc: uint8(lc)})
+	dist--
+	d.dynL[zdLengthCode[lc]+zdLiterals+1].freq++
+	d.dynD[zdDCode(dist)].freq++
+	d.numDist++
+	return d.blockFull()
+}
+
+func (d *zlibDeflater) blockFull() bool {
+	if d.gnu {
+		return d.gnuBlockFull()
+	}
+	return len(d.syms) == zdSymEnd
+}
+
+func (d *zlibDeflater) sendBits(v, n int) {
+	d.bitBuf |= uint64(v) << d.bitN
+	d.bitN += uint(n)
+	for d.bitN >= 8 {
+		d.out = append(d.out, byte(d.bitBuf))
+		d.bitBuf >>= 8
+		d.bitN -= 8
+	}
+}
+
+func (d *zlibDeflater) sendCode(c int, tree []zdNode) {
+	d.sendBits(tree[c].code, tree[c].len)
+}
+
+func (d *zlibDeflater) biWindup() {
+	if d.bitN > 0 {
+		d.out = append(d.out, byte(d.bitBuf))
+	}
+	d.bitBuf, d.bitN = 0, 0
+}
+
+func zdSmaller(tree []zdNode, n, m int, depth []int) bool {
+	return tree[n].freq < tree[m].freq || (tree[n].freq == tree[m].freq && depth[n] <= depth[m])
+}
+
+func (d *zlibDeflater) pqDownHeap(tree []zdNode, k int) {
+	v := d.heap[k]
+	j := k << 1
+	for j <= d.heapLen {
+		if j < d.heapLen && zdSmaller(tree, d.heap[j+1], d.heap[j], d.depth[:]) {
+			j++
+		}
+		if zdSmaller(tree, v, d.heap[j], d.depth[:]) {
+			break
+		}
+		d.heap[k] = d.heap[j]
+		k = j
+		j <<= 1
+	}
+	d.heap[k] = v
+}
+
+func (d *zlibDeflater) genBitlen(desc *zdDesc) {
+	tree := desc.tree
+	overflow := 0
+	for bits := range d.blCount {
+		d.blCount[bits] = 0
+	}
+	tree[d.heap[d.heapMax]].len = 0 // root
+	h := d.heapMax + 1
+	for ; h < zdHeapSize; h++ {
+		n := d.heap[h]
+		bits := tree[tree[n].dad].len + 1
+		if bits > desc.maxLength {
+			bits = desc.maxLength
+			overflow++
+		}
+		tree[n].len = bits
+		if n > desc.maxCode {
+			continue // not a leaf
+		}
+		d.blCount[bits]++
+		xbits := 0
+		if n >= desc.extraBase {
+			xbits = desc.extra[n-desc.extraBase]
+		}
+		f := tree[n].freq
+		d.optLen += f * (bits + xbits)
+		if desc.stree != nil {
+			d.staticLen += f * (desc.stree[n].len + xbits)
+		}
+	}
+	if overflow == 0 {
+		return
+	}
+	for overflow > 0 {
+		bits := desc.maxLength - 1
+		for d.blCount[bits] == 0 {
+			bits--
+		}
+		d.blCount[bits]--
+		d.blCount[bits+1] += 2
+		d.blCount[desc.maxLength]--
+		overflow -= 2
+	}
+	for bits := desc.maxLength; bits != 0; bits-- {
+		n := d.blCount[bits]
+		for n != 0 {
+			h--
+			m := d.heap[h]
+			if m > desc.maxCode {
+				continue
+			}
+			if tree[m].len != bits {
+				d.optLen += (bits - tree[m].len) * tree[m].freq
+				tree[m].len = bits
+			}
+			n--
+		}
+	}
+}
+
+func (d *zlibDeflater) buildTree(desc *zdDesc) {
+	tree := desc.tree
+	maxCode := -1
+	d.heapLen, d.heapMax = 0, zdHeapSize
+	for n := 0; n < desc.elems; n++ {
+		if tree[n].freq != 0 {
+			d.heapLen++
+			d.heap[d.heapLen] = n
+			maxCode = n
+			d.depth[n] = 0
+		} else {
+			tree[n].len = 0
+		}
+	}
+	// force at least two codes of non-zero frequency
+	for d.heapLen < 2 {
+		node := 0
+		if maxCode < 2 {
+			maxCode++
+			node = maxCode
+		}
+		d.heapLen++
+		d.heap[d.heapLen] = node
+		tree[node].freq = 1
+		d.depth[node] = 0
+		d.optLen--
+		if desc.stree != nil {
+			d.staticLen -= desc.stree[node].len
+		}
+	}
+	desc.maxCode = maxCode
+
+	for n := d.heapLen / 2; n >= 1; n-- {
+		d.pqDownHeap(tree, n)
+	}
+	node := desc.elems
+	for {
+		n := d.heap[1]
+		d.heap[1] = d.heap[d.heapLen]
+		d.heapLen--
+		d.pqDownHeap(tree, 1)
+		m := d.heap[1]
+
+		d.heapMax--
+		d.heap[d.heapMax] = n
+		d.heapMax--
+		d.heap[d.heapMax] = m
+
+		tree[node].freq = tree[n].freq + tree[m].freq
+		if d.depth[n] >= d.depth[m] {
+			d.depth[node] = d.depth[n] + 1
+		} else {
+			d.depth[node] = d.depth[m] + 1
+		}
+		tree[n].dad, tree[m].dad = node, node
+		d.heap[1] = node
+		node++
+		d.pqDownHeap(tree, 1)
+		if d.heapLen < 2 {
+			break
+		}
+	}
+	d.heapMax--
+	d.heap[d.heapMax] = d.heap[1]
+
+	d.genBitlen(desc)
+	zdGenCodes(tree, maxCode, d.blCount[:])
+}
+
+// scanTree counts the code lengths of tree in blTree. It leaves a guard entry after maxCode
+// that sendTree relies on.
+func (d *zlibDeflater) scanTree(tree []zdNode, maxCode int) {
+	prevlen, nextlen, count := -1, tree[0].len, 0
+	maxCount, minCount := 7, 4
+	if nextlen == 0 {
+		maxCount, minCount = 138, 3
+	}
+	tree[maxCode+1].len = 0xffff
+	for n := 0; n <= maxCode; n++ {
+		curlen := nextlen
+		nextlen = tree[n+1].len
+		if count++; count < maxCount && curlen == nextlen {
+			continue
+		} else if count < minCount {
+			d.blTree[curlen].freq += count
+		} else if curlen != 0 {
+			if curlen != prevlen {
+				d.blTree[curlen].freq++
+			}
+			d.blTree[zdRep3_6].freq++
+		} else if count <= 10 {
+			d.blTree[zdRepz3_10].freq++
+		} else {
+			d.blTree[zdRepz11_138].freq++
+		}
+		count, prevlen = 0, curlen
+		if nextlen == 0 {
+			maxCount, minCount = 138, 3
+		} else if curlen == nextlen {
+			maxCount, minCount = 6, 3
+		} else {
+			maxCount, minCount = 7, 4
+		}
+	}
+}
+
+func (d *zlibDeflater) sendTree(tree []zdNode, maxCode int) {
+	prevlen, nextlen, count := -1, tree[0].len, 0
+	maxCount, minCount := 7, 4
+	if nextlen == 0 {
+		maxCount, minCount = 138, 3
+	}
+	for n := 0; n <= maxCode; n++ {
+		curlen := nextlen
+		nextlen = tree[n+1].len
+		if count++; count < maxCount && curlen == nextlen {
+			continue
+		} else if count < minCount {
+			for ; count != 0; count-- {
+				d.sendCode(curlen, d.blTree[:])
+			}
+		} else if curlen != 0 {
+			if curlen != prevlen {
+				d.sendCode(curlen, d.blTree[:])
+				count--
+			}
+			d.sendCode(zdRep3_6, d.blTree[:])
+			d.sendBits(count-3, 2)
+		} else if count <= 10 {
+			d.sendCode(zdRepz3_10, d.blTree[:])
+			d.sendBits(count-3, 3)
+		} else {
+			d.sendCode(zdRepz11_138, d.blTree[:])
+			d.sendBits(count-11, 7)
+		}
+		count, prevlen = 0, curlen
+		if nextlen == 0 {
+			maxCount, minCount = 138, 3
+		} else if curlen == nextlen {
+			maxCount, minCount = 6, 3
+		} else {
+			maxCount, minCount = 7, 4
+		}
+	}
+}
+
+func (d *zlibDeflater) compressBlock(ltree, dtree []zdNode) {
+	for _, s := range d.syms {
+		dist, lc := int(s.dist), int(s.lc)
+		if dist == 0 {
+			d.sendCode(lc, ltree)
+			continue
+		}
+		code := zdLengthCode[lc]
+		d.sendCode(code+zdLiterals+1, ltree)
+		if extra := zdExtraLBits[code]; extra != 0 {
+			d.sendBits(lc-zdBaseLength[code], extra)
+		}
+		dist--
+		code = zdDCode(dist)
+		d.sendCode(code, dtree)
+		if extra := zdExtraDBits[code]; extra != 0 {
+			d.sendBits(dist-zdBaseDist[code], extra)
+		}
+	}
+	d.sendCode(zdEndBlock, ltree)
+}
+
+func (d *zlibDeflater) trFlushBlock(buf []byte, storedLen int, last bool) {
+	lastBit := 0
+	if last {
+		lastBit = 1
+	}
+	lDesc := zdDesc{tree: d.dynL[:], stree: zdStaticL[:], extra: zdExtraLBits, extraBase: zdLiterals + 1, elems: zdLCodes, maxLength: zdMaxBits}
+	dDesc := zdDesc{tree: d.dynD[:], stree: zdStaticD[:], extra: zdExtraDBits, elems: zdDCodes, maxLength: zdMaxBits}
+	blDesc := zdDesc{tree: d.blTree[:], extra: zdExtraBLBits, elems: zdBLCodes, maxLength: zdMaxBLBits}
+
+	d.buildTree(&lDesc)
+	d.buildTree(&dDesc)
+	// build_bl_tree
+	d.scanTree(d.dynL[:], lDesc.maxCode)
+	d.scanTree(d.dynD[:], dDesc.maxCode)
+	d.buildTree(&blDesc)
+	maxBLIndex := zdBLCodes - 1
+	for ; maxBLIndex >= 3; maxBLIndex-- {
+		if d.blTree[zdBLOrder[maxBLIndex]].len != 0 {
+			break
+		}
+	}
+	d.optLen += 3*(maxBLIndex+1) + 5 + 5 + 4
+
+	optLenb := (d.optLen + 3 + 7) >> 3
+	staticLenb := (d.staticLen + 3 + 7) >> 3
+	if staticLenb <= optLenb {
+		optLenb = staticLenb
+	}
+
+	if storedLen+4 <= optLenb && buf != nil {
+		d.sendBits(zdStoredBlock<<1+lastBit, 3)
+		d.biWindup()
+		d.out = append(d.out, byte(storedLen), byte(storedLen>>8), ^byte(storedLen), ^byte(storedLen>>8))
+		d.out = append(d.out, buf...)
+	} else if staticLenb == optLenb {
+		d.sendBits(zdStaticTrees<<1+lastBit, 3)
+		d.compressBlock(zdStaticL[:], zdStaticD[:])
+	} else {
+		d.sendBits(zdDynTrees<<1+lastBit, 3)
+		lcodes, dcodes, blcodes := lDesc.maxCode+1, dDesc.maxCode+1, maxBLIndex+1
+		d.sendBits(lcodes-257, 5)
+		d.sendBits(dcodes-1, 5)
+		d.sendBits(blcodes-4, 4)
+		for rank := 0; rank < blcodes; rank++ {
+			d.sendBits(d.blTree[zdBLOrder[rank]].len, 3)
+		}
+		d.sendTree(d.dynL[:], lcodes-1)
+		d.sendTree(d.dynD[:], dcodes-1)
+		d.compressBlock(d.dynL[:], d.dynD[:])
+	}
+	d.initBlock()
+	if last {
+		d.biWindup()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func TestZlibDeflate(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("no python3 to compare with zlib")
+	}
+
+	r := rand.New(rand.NewSource(1))
+	words := []string{"the ", "quick ", "brown ", "fox ", "jumps\n", "over ", "lazy ", "dog. "}
+	var text []byte
+	for len(text) < 1000000 {
+		text = append(text, words[r.Intn(len(words))]...)
+		if r.Intn(50) == 0 {
+			junk := make([]byte, r.Intn(300))
+			r.Read(junk)
+			text = append(text, junk...)
+		}
+	}
+	random := make([]byte, 100000)
+	r.Read(random)
+
+	for name, data := range map[string][]byte{
+		"empty":  nil,
+		"short":  []byte("a"),
+		"text":   text,
+		"small":  text[:1000],
+		"random": random,
+		"zeros":  make([]byte, 300000),
+	} {
+		for level := 1; level <= 9; level++ {
+			py := fmt.Sprintf("import sys, zlib; c = zlib.compressobj(%d, zlib.DEFLATED, -15); "+
+				"sys.stdout.buffer.write(c.compress(sys.stdin.buffer.read()) + c.flush())", level)
+			cmd := exec.Command("python3", "-c", py)
+			cmd.Stdin = bytes.NewReader(data)
+			exp, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got bytes.Buffer
+			if err := zlibDeflate(&got, data, level); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(got.Bytes(), exp) {
+				t.Errorf("%s level %d: got %d bytes, expected %d", name, level, got.Len(), len(exp))
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+// zstgoAlgo produces and consumes the same format as zstd --patch-from (a zstd frame using
+// the base as a raw dictionary), but runs in-process. The base can be used directly from
+// memory or an mmapped file, so expanding doesn't need a temp file copy or the zstd binary.
+// Deltas from zstAlgo can be expanded with this and vice versa.
+//
+// Only the "best" encoder indexes the whole dictionary, so we always use that and ignore the
+// level.
+
+type zstgoAlgo struct{ level int }
+
+const (
+	// same as --long=31 for the zstd binary
+	zstgoMaxWindow = 1 << 31
+)
+
+func (a *zstgoAlgo) Name() string       { return zstdGoName }
+func (a *zstgoAlgo) SetLevel(level int) { a.level = level }
+
+func (a *zstgoAlgo) Create(ctx context.Context, args CreateArgs) (*DiffStats, error) {
+	start := time.Now()
+
+	baseFile, err := os.Open(args.Base)
+	if err != nil {
+		return nil, err
+	}
+	defer baseFile.Close()
+	base, unmap, err := mapBase(baseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer unmap()
+
+	var req io.Reader
+	reqSize := args.RequestSize
+	if args.RequestReader != nil {
+		req = args.RequestReader
+	} else {
+		reqFile, err := os.Open(args.Request)
+		if err != nil {
+			return nil, err
+		}
+		defer reqFile.Close()
+		req = reqFile
+		reqSize = int64(fileSize(args.Request))
+	}
+
+	cw := countWriter{w: args.Output}
+	enc, err := zstd.NewWriter(
+		&cw,
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderDictRaw(0, base),
+		zstd.WithWindowSize(zstgoWindowSize(int64(len(base)), reqSize)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := countReader{r: req}
+	if err = ioCopy(enc, &ctxReader{ctx: ctx, r: &cr}, nil, -1); err != nil {
+		enc.Close()
+		return nil, err
+	} else if err = enc.Close(); err != nil {
+		return nil, err
+	}
+
+	stats := &DiffStats{
+		DiffSize:   cw.c,
+		NarSize:    cr.c,
+		Algo:       a.Name(),
+		Level:      a.level,
+		CmpTotalMs: time.Now().Sub(start).Milliseconds(),
+	}
+	return stats, nil
+}
+
+func (_ *zstgoAlgo) Expand(ctx context.Context, args ExpandArgs) (*DiffStats, error) {
+	start := time.Now()
+
+	base, unmap, err := args.memBase()
+	if err != nil {
+		return nil, err
+	}
+	defer unmap()
+
+	dec, err := zstd.NewReader(
+		&ctxReader{ctx: ctx, r: args.Delta},
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderDictRaw(0, base),
+		zstd.WithDecoderMaxWindow(zstgoMaxWindow),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	if err = ioCopy(args.Output, dec, nil, -1); err != nil {
+		return nil, fmt.Errorf("zstd decode: %w", err)
+	}
+
+	stats := &DiffStats{
+		ExpTotalMs: time.Now().Sub(start).Milliseconds(),
+	}
+	return stats, nil
+}
+
+// zstgoWindowSize returns a window big enough to reference all of the base from anywhere in
+// the request, if possible.
+func zstgoWindowSize(baseSize, reqSize int64) int {
+	if reqSize < 0 {
+		reqSize = baseSize
+	}
+	need := baseSize + reqSize
+	if need <= zstd.MinWindowSize {
+		return zstd.MinWindowSize
+	} else if need >= zstd.MaxWindowSize {
+		return zstd.MaxWindowSize
+	}
+	return 1 << bits.Len64(uint64(need-1))
+}
+
+// mapBase returns the contents of r, mmapped if it's a regular file, otherwise read into
+// memory.
+func mapBase(r io.Reader) ([]byte, func(), error) {
+	if f, ok := r.(*os.File); ok && mappable(f) {
+		st, err := f.Stat()
+		if err != nil {
+			return nil, nil, err
+		} else if st.Size() == 0 {
+			return nil, func() {}, nil
+		}
+		b, err := syscall.Mmap(int(f.Fd()), 0, int(st.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, nil, err
+		}
+		return b, func() { syscall.Munmap(b) }, nil
+	}
+	b, err := io.ReadAll(r)
+	return b, func() {}, err
+}
+
+// memfdBase copies r into an anonymous memory file and maps it. Unlike spoolBase it doesn't
+// use TMPDIR, which the service puts on a size-limited tmpfs.
+func memfdBase(r io.Reader) ([]byte, func(), error) {
+	fd, err := unix.MemfdCreate("basenar", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := os.NewFile(uintptr(fd), "basenar")
+	if err = ioCopy(f, r, nil, -1); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	b, unmap, err := mapBase(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return b, func() { unmap(); f.Close() }, nil
+}
+
+// mappable returns true if f is a regular file that hasn't been read from yet.
+func mappable(f *os.File) bool {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil || pos != 0 {
+		return false
+	}
+	st, err := f.Stat()
+	return err == nil && st.Mode().IsRegular()
+}
+
+// ctxReader stops reading when ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
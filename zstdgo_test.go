@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestZstdGo(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	old := make([]byte, 1000000)
+	r.Read(old)
+	new := append([]byte{}, old[:300000]...)
+	new = append(new, []byte("inserted")...)
+	new = append(new, old[500000:]...)
+
+	for _, pair := range []struct{ old, new []byte }{
+		{old, new},
+		{nil, new},
+		{old, nil},
+	} {
+		algoRoundTrip(t, getAlgo(zstdGoName), pair.old, pair.new)
+	}
+	if size := algoRoundTrip(t, getAlgo(zstdGoName), old, new); size > 1000 {
+		t.Error("delta too big", size)
+	}
+}
+
+// TestZstdGoInterop checks that zstd --patch-from and zstgoAlgo can expand each other's deltas.
+func TestZstdGoInterop(t *testing.T) {
+	if _, err := exec.LookPath(zstdBin); err != nil {
+		t.Skip("no zstd")
+	}
+	r := rand.New(rand.NewSource(2))
+	old := make([]byte, 1000000)
+	r.Read(old)
+	new := append([]byte{}, old...)
+	copy(new[400000:], "changed")
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	req := filepath.Join(dir, "req")
+	os.WriteFile(base, old, 0644)
+	os.WriteFile(req, new, 0644)
+
+	ctx := context.Background()
+	for _, pair := range [][2]DiffAlgo{
+		{getAlgo(zstdName), getAlgo(zstdGoName)},
+		{getAlgo(zstdGoName), getAlgo(zstdName)},
+	} {
+		var delta, out bytes.Buffer
+		if _, err := pair[0].Create(ctx, CreateArgs{Base: base, Request: req, Output: &delta}); err != nil {
+			t.Fatal(pair[0].Name(), "create", err)
+		}
+		baseFile, err := os.Open(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pair[1].Expand(ctx, ExpandArgs{Base: baseFile, Delta: &delta, Output: &out})
+		baseFile.Close()
+		if err != nil {
+			t.Fatal(pair[1].Name(), "expand", err)
+		} else if !bytes.Equal(out.Bytes(), new) {
+			t.Fatal(pair[0].Name(), "->", pair[1].Name(), "mismatch")
+		}
+	}
+}
+
+// tmpWatchReaderAt notes if any file under dir is open while it's being read.
+type tmpWatchReaderAt struct {
+	r    io.ReaderAt
+	dir  string
+	used bool
+}
+
+func (w *tmpWatchReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	fds, _ := os.ReadDir("/proc/self/fd")
+	for _, fd := range fds {
+		if l, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err == nil && strings.HasPrefix(l, w.dir) {
+			w.used = true
+		}
+	}
+	return w.r.ReadAt(p, off)
+}
+
+// TestZstdBigBaseAt checks that a seekable base too big for the heap stays out of TMPDIR.
+func TestZstdBigBaseAt(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	old := make([]byte, 3000000)
+	r.Read(old)
+	new := append([]byte{}, old...)
+	copy(new[2000000:], "changed")
+
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base")
+	req := filepath.Join(dir, "req")
+	os.WriteFile(base, old, 0644)
+	os.WriteFile(req, new, 0644)
+	var delta bytes.Buffer
+	ctx := context.Background()
+	if _, err := getAlgo(zstdGoName).Create(ctx, CreateArgs{Base: base, Request: req, Output: &delta}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(m int64) { memBaseMax = m }(memBaseMax)
+	memBaseMax = 1 << 20
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	for _, name := range []string{zstdName, zstdGoName} {
+		var out bytes.Buffer
+		baseAt := &tmpWatchReaderAt{r: bytes.NewReader(old), dir: tmp}
+		args := ExpandArgs{
+			Base:     bytes.NewReader(old),
+			BaseAt:   baseAt,
+			BaseSize: int64(len(old)),
+			Delta:    bytes.NewReader(delta.Bytes()),
+			Output:   &out,
+		}
+		if _, err := getExpandAlgo(name).Expand(ctx, args); err != nil {
+			t.Fatal(name, err)
+		} else if !bytes.Equal(out.Bytes(), new) {
+			t.Fatal(name, "mismatch")
+		}
+		if ents, _ := os.ReadDir(tmp); baseAt.used || len(ents) > 0 {
+			t.Errorf("%s: base went through TMPDIR", name)
+		}
+	}
+}